@@ -385,6 +385,7 @@ func (api *RetestethAPI) SetChainParams(ctx context.Context, chainParams ChainPa
 			DatasetsInMem:    1,
 			DatasetsOnDisk:   2,
 			DatasetsLockMmap: false,
+			ChainConfig:      chainConfig.Ubqhash,
 		}, nil, false)
 	default:
 		return false, fmt.Errorf("unrecognised seal engine: %s", chainParams.SealEngine)
@@ -63,8 +63,13 @@ func (w *wizard) makeGenesis() {
 	choice := w.read()
 	switch {
 	case choice == "1":
-		// In case of ubqhash, we're pretty much done
-		genesis.Config.Ubqhash = new(params.UbqhashConfig)
+		// In case of ubqhash, we're pretty much done, running Flux from genesis
+		// with the mainnet monetary policy
+		genesis.Config.Ubqhash = &params.UbqhashConfig{
+			DigishieldModBlock: new(big.Int),
+			FluxBlock:          new(big.Int),
+			MonetaryPolicy:     params.MainnetChainConfig.Ubqhash.MonetaryPolicy,
+		}
 		genesis.ExtraData = make([]byte, 32)
 
 	case choice == "" || choice == "2":
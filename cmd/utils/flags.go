@@ -1598,6 +1598,7 @@ func MakeChain(ctx *cli.Context, stack *node.Node, readOnly bool) (chain *core.B
 				DatasetsInMem:    eth.DefaultConfig.Ubqhash.DatasetsInMem,
 				DatasetsOnDisk:   eth.DefaultConfig.Ubqhash.DatasetsOnDisk,
 				DatasetsLockMmap: eth.DefaultConfig.Ubqhash.DatasetsLockMmap,
+				ChainConfig:      config.Ubqhash,
 			}, nil, false)
 		}
 	}
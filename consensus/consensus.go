@@ -19,6 +19,7 @@ package consensus
 
 import (
 	"math/big"
+	"sort"
 
 	"github.com/ubiq/go-ubiq/v5/common"
 	"github.com/ubiq/go-ubiq/v5/core/state"
@@ -46,7 +47,7 @@ type ChainHeaderReader interface {
 	GetHeaderByHash(hash common.Hash) *types.Header
 
 	// CalcPastMedianTime calculates the median time of the previous few blocks
-	// prior to, and including, the passed block node.
+	// prior to, and including, the passed block node, or nil if any is unknown.
 	CalcPastMedianTime(number uint64, parent *types.Header) *big.Int
 
 	// GetBlock retrieves a block from the database by hash and number.
@@ -127,3 +128,34 @@ type PoW interface {
 	// Hashrate returns the current mining hashrate of a PoW consensus engine.
 	Hashrate() float64
 }
+
+// PastMedianTime calculates the median time of the window blocks prior to, and
+// including, the block with the given number, retrieving them through getHeader.
+// If set, parent stands in for the block with the given number. Close to genesis
+// the median spans the blocks available. Nil is returned if any of the blocks is
+// missing or the window is empty.
+func PastMedianTime(number uint64, parent *types.Header, window uint64, getHeader func(number uint64) *types.Header) *big.Int {
+	if window == 0 {
+		return nil
+	}
+	limit := uint64(0)
+	if number >= window {
+		limit = number - window + 1
+	}
+	timestamps := make([]uint64, 0, number-limit+1)
+	for i := number; ; i-- {
+		header := parent
+		if header == nil || i != number {
+			header = getHeader(i)
+		}
+		if header == nil {
+			return nil
+		}
+		timestamps = append(timestamps, header.Time)
+		if i == limit {
+			break
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return new(big.Int).SetUint64(timestamps[len(timestamps)/2])
+}
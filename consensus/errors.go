@@ -31,6 +31,11 @@ var (
 	// to the current node.
 	ErrFutureBlock = errors.New("block in the future")
 
+	// ErrFutureBlockRetryable is returned when a block's timestamp is in the future
+	// according to the current node, but close enough that the block may become
+	// valid shortly and is worth queueing for a retry.
+	ErrFutureBlockRetryable = errors.New("block in the near future")
+
 	// ErrInvalidNumber is returned if a block's number doesn't equal its parent's
 	// plus one.
 	ErrInvalidNumber = errors.New("invalid block number")
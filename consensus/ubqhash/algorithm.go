@@ -52,6 +52,14 @@ const (
 	uip1Epoch = 22
 )
 
+// EpochBounds returns the epoch a block number belongs to, along with the numbers
+// of the first and last blocks of that epoch.
+func EpochBounds(number uint64) (epoch, start, end uint64) {
+	epoch = number / epochLength
+	start = epoch * epochLength
+	return epoch, start, start + epochLength - 1
+}
+
 // cacheSize returns the size of the ubqhash verification cache that belongs to a certain
 // block number.
 func cacheSize(block uint64) uint64 {
@@ -282,9 +290,10 @@ func generateDatasetItem(cache []uint32, index uint32, keccak512 hasher) []byte
 	return mix
 }
 
-// generateDataset generates the entire ubqhash dataset for mining.
+// generateDataset generates the entire ubqhash dataset for mining on the given
+// number of goroutines (0 = GOMAXPROCS).
 // This method places the result into dest in machine byte order.
-func generateDataset(dest []uint32, epoch uint64, cache []uint32) {
+func generateDataset(dest []uint32, epoch uint64, cache []uint32, threads int) {
 	// Print some debug logs to allow analysis on low end devices
 	logger := log.New("epoch", epoch)
 
@@ -309,7 +318,9 @@ func generateDataset(dest []uint32, epoch uint64, cache []uint32) {
 	dataset := *(*[]byte)(unsafe.Pointer(&header))
 
 	// Generate the dataset on many goroutines since it takes a while
-	threads := runtime.NumCPU()
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
 	size := uint64(len(dataset))
 
 	var pend sync.WaitGroup
@@ -349,6 +360,38 @@ func generateDataset(dest []uint32, epoch uint64, cache []uint32) {
 	pend.Wait()
 }
 
+// datasetChecksum calculates the Keccak-256 checksum of a dataset, hashing its
+// content in little endian byte order regardless of the machine's.
+func datasetChecksum(dataset []uint32) common.Hash {
+	keccak256 := sha3.NewLegacyKeccak256()
+
+	buf := make([]byte, hashBytes)
+	for i := 0; i < len(dataset); i += hashWords {
+		n := 0
+		for j := i; j < i+hashWords && j < len(dataset); j++ {
+			binary.LittleEndian.PutUint32(buf[n:], dataset[j])
+			n += 4
+		}
+		keccak256.Write(buf[:n])
+	}
+	return common.BytesToHash(keccak256.Sum(nil))
+}
+
+// expectedDatasetChecksum calculates the checksum a dataset of the given size
+// generated from the cache must have, the same way datasetChecksum does. The
+// dataset items are generated one by one and hashed without keeping the dataset
+// around, so it's as slow as generating the dataset single threaded.
+func expectedDatasetChecksum(cache []uint32, size uint64) common.Hash {
+	var (
+		keccak256 = sha3.NewLegacyKeccak256()
+		keccak512 = makeHasher(sha3.NewLegacyKeccak512())
+	)
+	for index := uint32(0); uint64(index) < size/hashBytes; index++ {
+		keccak256.Write(generateDatasetItem(cache, index, keccak512))
+	}
+	return common.BytesToHash(keccak256.Sum(nil))
+}
+
 // hashimoto aggregates data from the full dataset in order to produce our final
 // value for a particular header hash and nonce.
 func hashimoto(hash []byte, nonce uint64, size uint64, lookup func(index uint32) []uint32) ([]byte, []byte) {
@@ -29,6 +29,7 @@ import (
 	"github.com/ubiq/go-ubiq/v5/common"
 	"github.com/ubiq/go-ubiq/v5/common/hexutil"
 	"github.com/ubiq/go-ubiq/v5/core/types"
+	"github.com/ubiq/go-ubiq/v5/params"
 )
 
 // prepare converts an ubqhash cache or dataset from a byte stream into the internal
@@ -651,7 +652,7 @@ func TestDatasetGeneration(t *testing.T) {
 		generateCache(cache, tt.epoch, seedHash(tt.epoch*epochLength+1))
 
 		dataset := make([]uint32, tt.datasetSize/4)
-		generateDataset(dataset, tt.epoch, cache)
+		generateDataset(dataset, tt.epoch, cache, 0)
 
 		want := make([]uint32, tt.datasetSize/4)
 		prepare(want, tt.dataset)
@@ -670,7 +671,7 @@ func TestHashimoto(t *testing.T) {
 	generateCache(cache, 0, make([]byte, 32))
 
 	dataset := make([]uint32, 32*1024/4)
-	generateDataset(dataset, 0, cache)
+	generateDataset(dataset, 0, cache, 0)
 
 	// Create a block to verify
 	hash := hexutil.MustDecode("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
@@ -695,6 +696,68 @@ func TestHashimoto(t *testing.T) {
 	}
 }
 
+// Tests that block numbers are mapped to the correct epochs and epoch bounds.
+func TestEpochBounds(t *testing.T) {
+	tests := []struct {
+		number, epoch, start, end uint64
+	}{
+		{0, 0, 0, 29999},
+		{15000, 0, 0, 29999},
+		{29999, 0, 0, 29999},
+		{30000, 1, 30000, 59999},
+		{59999, 1, 30000, 59999},
+		{1234567, 41, 1230000, 1259999},
+	}
+	for i, tt := range tests {
+		epoch, start, end := EpochBounds(tt.number)
+		if epoch != tt.epoch || start != tt.start || end != tt.end {
+			t.Errorf("test %d: bounds mismatch: have (%d, %d, %d), want (%d, %d, %d)", i, epoch, start, end, tt.epoch, tt.start, tt.end)
+		}
+	}
+}
+
+// Tests that the seed hash chain holds the seed hash of every epoch up to the
+// requested one.
+func TestSeedHashChain(t *testing.T) {
+	for _, epoch := range []uint64{0, 1, 2, 50} {
+		seeds := SeedHashChain(epoch)
+		if len(seeds) != int(epoch)+1 {
+			t.Fatalf("epoch %d: seed count mismatch: have %d, want %d", epoch, len(seeds), epoch+1)
+		}
+		for i, seed := range seeds {
+			if want := SeedHash(uint64(i) * epochLength); !bytes.Equal(seed, want) {
+				t.Errorf("epoch %d: seed %d mismatch: have %x, want %x", epoch, i, seed, want)
+			}
+		}
+	}
+}
+
+// Tests that datasets generated with a capped number of threads are identical to
+// the ones generated with the default parallelism.
+func TestDatasetGenerationThreads(t *testing.T) {
+	cache := make([]uint32, 1024/4)
+	generateCache(cache, 0, make([]byte, 32))
+
+	want := make([]uint32, 32*1024/4)
+	generateDataset(want, 0, cache, 0)
+
+	for _, threads := range []int{1, 3, 1000} {
+		dataset := make([]uint32, 32*1024/4)
+		generateDataset(dataset, 0, cache, threads)
+
+		if !reflect.DeepEqual(dataset, want) {
+			t.Errorf("threads %d: dataset mismatch", threads)
+		}
+	}
+	// Ensure the engine honours the configured thread count too
+	ubqhash := New(Config{PowMode: ModeTest, DatasetsInMem: 1, GenerationThreads: 1, ChainConfig: params.TestChainConfig.Ubqhash}, nil, false)
+	defer ubqhash.Close()
+
+	if dataset := ubqhash.dataset(1, false); !dataset.generated() || !reflect.DeepEqual(dataset.dataset, want) {
+		t.Errorf("engine dataset mismatch")
+	}
+}
+
 // Tests that caches generated on disk may be done concurrently.
 func TestConcurrentDiskCacheGeneration(t *testing.T) {
 	// Create a temp folder to generate the caches into
@@ -729,7 +792,7 @@ func TestConcurrentDiskCacheGeneration(t *testing.T) {
 
 		go func(idx int) {
 			defer pend.Done()
-			ubqhash := New(Config{cachedir, 0, 1, false, "", 0, 0, false, ModeNormal, nil}, nil, false)
+			ubqhash := New(Config{CacheDir: cachedir, CachesOnDisk: 1, PowMode: ModeNormal, ChainConfig: params.TestChainConfig.Ubqhash}, nil, false)
 			defer ubqhash.Close()
 			if err := ubqhash.VerifySeal(nil, block.Header()); err != nil {
 				t.Errorf("proc %d: block verification failed: %v", idx, err)
@@ -755,7 +818,7 @@ func BenchmarkSmallDatasetGeneration(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		dataset := make([]uint32, 32*65536/4)
-		generateDataset(dataset, 0, cache)
+		generateDataset(dataset, 0, cache, 0)
 	}
 }
 
@@ -778,7 +841,7 @@ func BenchmarkHashimotoFullSmall(b *testing.B) {
 	generateCache(cache, 0, make([]byte, 32))
 
 	dataset := make([]uint32, 32*65536/4)
-	generateDataset(dataset, 0, cache)
+	generateDataset(dataset, 0, cache, 0)
 
 	hash := hexutil.MustDecode("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
 
@@ -797,7 +860,7 @@ func benchmarkHashimotoFullMmap(b *testing.B, name string, lock bool) {
 		defer os.RemoveAll(tmpdir)
 
 		d := &dataset{epoch: 0}
-		d.generate(tmpdir, 1, lock, false)
+		d.generate(tmpdir, 1, lock, false, 0)
 		var hash [common.HashLength]byte
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
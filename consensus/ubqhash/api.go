@@ -90,20 +90,7 @@ func (api *API) SubmitWork(nonce types.BlockNonce, hash, digest common.Hash) boo
 // It accepts the miner hash rate and an identifier which must be unique
 // between nodes.
 func (api *API) SubmitHashRate(rate hexutil.Uint64, id common.Hash) bool {
-	if api.ubqhash.remote == nil {
-		return false
-	}
-
-	var done = make(chan struct{}, 1)
-	select {
-	case api.ubqhash.remote.submitRateCh <- &hashrate{done: done, rate: uint64(rate), id: id}:
-	case <-api.ubqhash.remote.exitCh:
-		return false
-	}
-
-	// Block until hash rate submitted successfully.
-	<-done
-	return true
+	return api.ubqhash.SubmitHashRate(id, rate)
 }
 
 // GetHashrate returns the current hashrate for local CPU miner and remote miner.
@@ -18,10 +18,16 @@ package ubqhash
 
 import (
 	"bytes"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"math"
 	"math/big"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	mapset "github.com/deckarep/golang-set"
@@ -30,6 +36,7 @@ import (
 	"github.com/ubiq/go-ubiq/v5/core/state"
 	"github.com/ubiq/go-ubiq/v5/core/types"
 	"github.com/ubiq/go-ubiq/v5/log"
+	"github.com/ubiq/go-ubiq/v5/metrics"
 	"github.com/ubiq/go-ubiq/v5/params"
 	"github.com/ubiq/go-ubiq/v5/rlp"
 	"github.com/ubiq/go-ubiq/v5/trie"
@@ -51,6 +58,8 @@ var (
 		MaxAdjustDown:   big.NewInt(16), // 16%
 		MaxAdjustUp:     big.NewInt(8),  // 8%
 		Factor:          big.NewInt(100),
+
+		RetargetSmoothingDivisor: big.NewInt(4),
 	}
 
 	digishieldV3ModConfig = &diffConfig{
@@ -58,6 +67,8 @@ var (
 		MaxAdjustDown:   big.NewInt(3), // 3%
 		MaxAdjustUp:     big.NewInt(2), // 2%
 		Factor:          big.NewInt(100),
+
+		RetargetSmoothingDivisor: big.NewInt(4),
 	}
 
 	fluxConfig = &diffConfig{
@@ -66,6 +77,8 @@ var (
 		MaxAdjustUp:     big.NewInt(3), // 0.3%
 		Dampen:          big.NewInt(1), // 0.1%
 		Factor:          big.NewInt(1000),
+
+		RetargetSmoothingDivisor: big.NewInt(4),
 	}
 )
 
@@ -75,6 +88,33 @@ type diffConfig struct {
 	MaxAdjustUp     *big.Int `json:"maxAdjustUp"`
 	Dampen          *big.Int `json:"dampen,omitempty"`
 	Factor          *big.Int `json:"factor"`
+
+	// RetargetSmoothingDivisor is the divisor the deviation of the actual timespan
+	// from the averaging window timespan is scaled down by before clamping, which
+	// chain configs may override from their retarget smoothing fork on (nil = 4).
+	RetargetSmoothingDivisor *big.Int `json:"retargetSmoothingDivisor,omitempty"`
+}
+
+// relaxed returns a copy of the parameters with the adjustment bounds widened by
+// forkGraceFactor.
+func (c *diffConfig) relaxed() *diffConfig {
+	relaxed := *c
+	factor := big.NewInt(forkGraceFactor)
+
+	relaxed.MaxAdjustDown = new(big.Int).Mul(c.MaxAdjustDown, factor)
+	relaxed.MaxAdjustUp = new(big.Int).Mul(c.MaxAdjustUp, factor)
+	if c.Dampen != nil {
+		relaxed.Dampen = new(big.Int).Mul(c.Dampen, factor)
+	}
+	return &relaxed
+}
+
+// smoothingDivisor returns the retarget smoothing divisor, defaulting to 4.
+func (c *diffConfig) smoothingDivisor() *big.Int {
+	if c.RetargetSmoothingDivisor == nil || c.RetargetSmoothingDivisor.Sign() <= 0 {
+		return big.NewInt(4)
+	}
+	return c.RetargetSmoothingDivisor
 }
 
 // Various error messages to mark blocks invalid. These should be private to
@@ -82,14 +122,22 @@ type diffConfig struct {
 // codebase, inherently breaking if the engine is swapped out. Please put common
 // error types into the consensus package.
 var (
-	errZeroBlockTime     = errors.New("timestamp equals parent's")
-	errTooManyUncles     = errors.New("too many uncles")
-	errDuplicateUncle    = errors.New("duplicate uncle")
-	errUncleIsAncestor   = errors.New("uncle is ancestor")
-	errDanglingUncle     = errors.New("uncle's parent is not ancestor")
-	errInvalidDifficulty = errors.New("non-positive difficulty")
-	errInvalidMixDigest  = errors.New("invalid mix digest")
-	errInvalidPoW        = errors.New("invalid proof-of-work")
+	errInvalidNumber        = errors.New("nil or negative block number")
+	errZeroBlockTime        = errors.New("timestamp equals parent's")
+	errMedianTimeGap        = errors.New("timestamp too far beyond median time past")
+	errTooManyUncles        = errors.New("too many uncles")
+	errStaleUncle           = errors.New("uncle too old")
+	errDuplicateUncle       = errors.New("duplicate uncle")
+	errUncleIsAncestor      = errors.New("uncle is ancestor")
+	errDanglingUncle        = errors.New("uncle's parent is not ancestor")
+	errInvalidDifficulty    = errors.New("non-positive difficulty")
+	errMinimumDifficulty    = errors.New("difficulty at minimum floor")
+	errInvalidMixDigest     = errors.New("invalid mix digest")
+	errInvalidPoW           = errors.New("invalid proof-of-work")
+	errVerifyBudgetExceeded = errors.New("header verification budget exceeded")
+	errEngineClosed         = errors.New("ubqhash engine closed")
+	errNonContiguousBatch   = errors.New("non-contiguous header batch")
+	errImplausibleGasUsed   = errors.New("gas used too low for transactions")
 )
 
 // Author implements consensus.Engine, returning the header's coinbase as the
@@ -105,12 +153,16 @@ func (ubqhash *Ubqhash) VerifyHeader(chain consensus.ChainHeaderReader, header *
 	if ubqhash.config.PowMode == ModeFullFake {
 		return nil
 	}
+	// Reject malformed block numbers before they're used for lookups
+	if header.Number == nil || header.Number.Sign() < 0 {
+		return errInvalidNumber
+	}
 	// Short circuit if the header is known, or it's parent not
 	number := header.Number.Uint64()
 	if chain.GetHeader(header.Hash(), number) != nil {
 		return nil
 	}
-	parent := chain.GetHeader(header.ParentHash, number-1)
+	parent := ubqhash.getParent(chain, header.ParentHash, number-1)
 	if parent == nil {
 		return consensus.ErrUnknownAncestor
 	}
@@ -118,10 +170,84 @@ func (ubqhash *Ubqhash) VerifyHeader(chain consensus.ChainHeaderReader, header *
 	return ubqhash.verifyHeader(chain, header, parent, false, seal)
 }
 
+// VerifyHeaderWithBody is similar to VerifyHeader, but also checks the header
+// against the transactions of its block body. If CheckBodyGasUsed is enabled, a
+// block with transactions claiming less gas used than an intrinsic transaction
+// costs is flagged as implausible.
+func (ubqhash *Ubqhash) VerifyHeaderWithBody(chain consensus.ChainHeaderReader, header *types.Header, txs []*types.Transaction, seal bool) error {
+	if err := ubqhash.VerifyHeader(chain, header, seal); err != nil {
+		return err
+	}
+	if ubqhash.config.PowMode == ModeFullFake || !ubqhash.config.CheckBodyGasUsed {
+		return nil
+	}
+	if len(txs) > 0 && header.GasUsed < params.TxGas {
+		return fmt.Errorf("%w: have %d, want at least %d for %d txs", errImplausibleGasUsed, header.GasUsed, params.TxGas, len(txs))
+	}
+	return nil
+}
+
+// VerifyHeaderDetailed is similar to VerifyHeader, but also reports conditions of
+// a valid header that aren't errors yet are worth surfacing, such as a difficulty
+// pinned at the minimum floor or a retarget clamped to one of its bounds. The
+// warnings are only gathered if the header passes verification.
+func (ubqhash *Ubqhash) VerifyHeaderDetailed(chain consensus.ChainHeaderReader, header *types.Header, seal bool) ([]string, error) {
+	if err := ubqhash.VerifyHeader(chain, header, seal); err != nil {
+		return nil, err
+	}
+	if ubqhash.config.PowMode == ModeFullFake || header.Number.Sign() == 0 {
+		return nil, nil
+	}
+	var warnings []string
+	if header.Difficulty.Cmp(params.MinimumDifficulty) == 0 {
+		warnings = append(warnings, fmt.Sprintf("difficulty at minimum floor %v", params.MinimumDifficulty))
+	}
+	parent := ubqhash.getParent(chain, header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return warnings, nil
+	}
+	config := chain.Config().Ubqhash
+	if r := difficultyAlgorithmAt(config, parent.Number).retargetAt(ubqhash.medianTimeChain(chain), header.Time, parent, TargetBlockTime(config, header.Number)); r != nil {
+		switch r.clamp {
+		case RetargetMaxIncrease:
+			warnings = append(warnings, fmt.Sprintf("timespan %v clamped to minimum %v", r.raw, r.clamped))
+		case RetargetMaxDecrease:
+			warnings = append(warnings, fmt.Sprintf("timespan %v clamped to maximum %v", r.raw, r.clamped))
+		}
+	}
+	return warnings, nil
+}
+
 // VerifyHeaders is similar to VerifyHeader, but verifies a batch of headers
 // concurrently. The method returns a quit channel to abort the operations and
 // a results channel to retrieve the async verifications.
 func (ubqhash *Ubqhash) VerifyHeaders(chain consensus.ChainHeaderReader, headers []*types.Header, seals []bool) (chan<- struct{}, <-chan error) {
+	return ubqhash.verifyHeaders(chain, headers, seals, 0)
+}
+
+// VerifyHeadersWithBudget is similar to VerifyHeaders, but limits the total time
+// spent on verifying the batch. Once the budget is exceeded, no further headers
+// are verified and every header without a result yet is reported as failed with
+// a budget-exceeded error. A non-positive budget leaves the time unbounded.
+func (ubqhash *Ubqhash) VerifyHeadersWithBudget(chain consensus.ChainHeaderReader, headers []*types.Header, seals []bool, budget time.Duration) (chan<- struct{}, <-chan error) {
+	return ubqhash.verifyHeaders(chain, headers, seals, budget)
+}
+
+// VerifyHeadersCollect verifies a batch of headers like VerifyHeaders, but waits
+// for all of them to be checked instead of stopping at the first failure. The
+// returned slice holds the result of every header, in the order of the headers.
+func (ubqhash *Ubqhash) VerifyHeadersCollect(chain consensus.ChainHeaderReader, headers []*types.Header, seals []bool) []error {
+	abort, results := ubqhash.VerifyHeaders(chain, headers, seals)
+	defer close(abort)
+
+	errs := make([]error, len(headers))
+	for i := range errs {
+		errs[i] = <-results
+	}
+	return errs
+}
+
+func (ubqhash *Ubqhash) verifyHeaders(chain consensus.ChainHeaderReader, headers []*types.Header, seals []bool, budget time.Duration) (chan<- struct{}, <-chan error) {
 	// If we're running a full engine faking, accept any input as valid
 	if ubqhash.config.PowMode == ModeFullFake || len(headers) == 0 {
 		abort, results := make(chan struct{}), make(chan error, len(headers))
@@ -131,11 +257,30 @@ func (ubqhash *Ubqhash) VerifyHeaders(chain consensus.ChainHeaderReader, headers
 		return abort, results
 	}
 
+	// Refuse batches with gaps in their numbering if requested
+	if ubqhash.config.StrictHeaderBatches {
+		if err := checkContiguousHeaders(headers); err != nil {
+			abort, results := make(chan struct{}), make(chan error, len(headers))
+			for i := 0; i < len(headers); i++ {
+				results <- err
+			}
+			return abort, results
+		}
+	}
 	// Spawn as many workers as allowed threads
 	workers := runtime.GOMAXPROCS(0)
 	if len(headers) < workers {
 		workers = len(headers)
 	}
+	// Refuse new batches once the engine is closed
+	quit, ok := ubqhash.trackVerifiers(workers + 1)
+	if !ok {
+		abort, results := make(chan struct{}), make(chan error, len(headers))
+		for i := 0; i < len(headers); i++ {
+			results <- errEngineClosed
+		}
+		return abort, results
+	}
 
 	// Create a task channel and spawn the verifiers
 	var (
@@ -146,6 +291,7 @@ func (ubqhash *Ubqhash) VerifyHeaders(chain consensus.ChainHeaderReader, headers
 	)
 	for i := 0; i < workers; i++ {
 		go func() {
+			defer ubqhash.verifiers.Done()
 			for index := range inputs {
 				errors[index] = ubqhash.verifyHeaderWorker(chain, headers, seals, index)
 				done <- index
@@ -155,12 +301,19 @@ func (ubqhash *Ubqhash) VerifyHeaders(chain consensus.ChainHeaderReader, headers
 
 	errorsOut := make(chan error, len(headers))
 	go func() {
+		defer ubqhash.verifiers.Done()
 		defer close(inputs)
 		var (
 			in, out = 0, 0
 			checked = make([]bool, len(headers))
 			inputs  = inputs
+			timeout <-chan time.Time
 		)
+		if budget > 0 {
+			timer := time.NewTimer(budget)
+			defer timer.Stop()
+			timeout = timer.C
+		}
 		for {
 			select {
 			case inputs <- in:
@@ -175,6 +328,28 @@ func (ubqhash *Ubqhash) VerifyHeaders(chain consensus.ChainHeaderReader, headers
 						return
 					}
 				}
+			case <-timeout:
+				// Out of time, deliver the results already available and fail the
+				// rest. Headers still being verified are left to finish unobserved.
+				for ; out < len(headers); out++ {
+					if checked[out] {
+						errorsOut <- errors[out]
+					} else {
+						errorsOut <- errVerifyBudgetExceeded
+					}
+				}
+				return
+			case <-quit:
+				// Engine closed, deliver the results already available and fail
+				// the rest. Workers finish the headers they are verifying.
+				for ; out < len(headers); out++ {
+					if checked[out] {
+						errorsOut <- errors[out]
+					} else {
+						errorsOut <- errEngineClosed
+					}
+				}
+				return
 			case <-abort:
 				return
 			}
@@ -183,10 +358,39 @@ func (ubqhash *Ubqhash) VerifyHeaders(chain consensus.ChainHeaderReader, headers
 	return abort, errorsOut
 }
 
+// VerifyHeadersFull is similar to VerifyHeaders, but verifies the seal of every
+// header in the batch. Headers of the same epoch share the engine's verification
+// cache, which is generated at most once per epoch for the whole batch.
+func (ubqhash *Ubqhash) VerifyHeadersFull(chain consensus.ChainHeaderReader, headers []*types.Header) (chan<- struct{}, <-chan error) {
+	seals := make([]bool, len(headers))
+	for i := range seals {
+		seals[i] = true
+	}
+	return ubqhash.VerifyHeaders(chain, headers, seals)
+}
+
+// checkContiguousHeaders checks that the numbers of the given headers form a
+// contiguous increasing sequence, returning an error identifying the first gap.
+func checkContiguousHeaders(headers []*types.Header) error {
+	for i := 1; i < len(headers); i++ {
+		prev, number := headers[i-1].Number, headers[i].Number
+		if prev == nil || number == nil {
+			return fmt.Errorf("%w: header %d or %d without number", errNonContiguousBatch, i-1, i)
+		}
+		if want := new(big.Int).Add(prev, common.Big1); number.Cmp(want) != 0 {
+			return fmt.Errorf("%w: header %d is #%v, want #%v", errNonContiguousBatch, i, number, want)
+		}
+	}
+	return nil
+}
+
 func (ubqhash *Ubqhash) verifyHeaderWorker(chain consensus.ChainHeaderReader, headers []*types.Header, seals []bool, index int) error {
+	if headers[index].Number == nil || headers[index].Number.Sign() < 0 {
+		return errInvalidNumber
+	}
 	var parent *types.Header
 	if index == 0 {
-		parent = chain.GetHeader(headers[0].ParentHash, headers[0].Number.Uint64()-1)
+		parent = ubqhash.getParent(chain, headers[0].ParentHash, headers[0].Number.Uint64()-1)
 	} else if headers[index-1].Hash() == headers[index].ParentHash {
 		parent = headers[index-1]
 	}
@@ -199,6 +403,18 @@ func (ubqhash *Ubqhash) verifyHeaderWorker(chain consensus.ChainHeaderReader, he
 	return ubqhash.verifyHeader(chain, headers[index], parent, false, seals[index])
 }
 
+// getParent retrieves the parent header with the given hash and number from the
+// configured parent provider, falling back to the chain if it has none or hands
+// out a different header.
+func (ubqhash *Ubqhash) getParent(chain consensus.ChainHeaderReader, hash common.Hash, number uint64) *types.Header {
+	if provide := ubqhash.config.ParentProvider; provide != nil {
+		if parent := provide(hash, number); parent != nil && parent.Number.Uint64() == number && parent.Hash() == hash {
+			return parent
+		}
+	}
+	return chain.GetHeader(hash, number)
+}
+
 // VerifyUncles verifies that the given block's uncles conform to the consensus
 // rules of the stock Ethereum ubqhash engine.
 func (ubqhash *Ubqhash) VerifyUncles(chain consensus.ChainHeaderReader, block *types.Block) error {
@@ -206,6 +422,10 @@ func (ubqhash *Ubqhash) VerifyUncles(chain consensus.ChainHeaderReader, block *t
 	if ubqhash.config.PowMode == ModeFullFake {
 		return nil
 	}
+	// Blocks below the trusted checkpoint were verified already
+	if checkpoint := ubqhash.config.TrustedCheckpoint; checkpoint > 0 && block.NumberU64() <= checkpoint {
+		return nil
+	}
 	// Verify that there are at most 2 uncles included in this block
 	if len(block.Uncles()) > maxUncles {
 		return errTooManyUncles
@@ -228,52 +448,209 @@ func (ubqhash *Ubqhash) VerifyUncles(chain consensus.ChainHeaderReader, block *t
 	ancestors[block.Hash()] = block.Header()
 	uncles.Add(block.Hash())
 
+	// Past the lenient uncle seal fork, invalid uncle seals only forfeit the
+	// uncle's reward. The seals are verified here all the same, and the uncles
+	// denied a reward handed on to the finalization of the block
+	config := ubqhash.chainConfig(chain)
+	lenient := config.IsLenientUncleSeal(block.Number())
+	denied := make(map[common.Hash]struct{})
+
 	// Verify each of the uncles that it's recent, but not an ancestor
 	for _, uncle := range block.Uncles() {
 		// Make sure every uncle is rewarded only once
 		hash := uncle.Hash()
 		if uncles.Contains(hash) {
-			return errDuplicateUncle
+			return rejectUncle(uncleDuplicateCounter, errDuplicateUncle)
 		}
 		uncles.Add(hash)
 
 		// Make sure the uncle has a valid ancestry
 		if ancestors[hash] != nil {
-			return errUncleIsAncestor
+			return rejectUncle(uncleAncestorCounter, errUncleIsAncestor)
 		}
 		if ancestors[uncle.ParentHash] == nil || uncle.ParentHash == block.ParentHash() {
-			return errDanglingUncle
+			return rejectUncle(uncleDanglingCounter, errDanglingUncle)
 		}
-		if err := ubqhash.verifyHeader(chain, uncle, ancestors[uncle.ParentHash], true, true); err != nil {
-			return err
+		if config.MaxUncleAge > 0 && config.IsMaxUncleAge(block.Number()) && uncle.Time+config.MaxUncleAge < block.Time() {
+			return rejectUncle(uncleStaleCounter, errStaleUncle)
+		}
+		if err := ubqhash.verifyHeader(chain, uncle, ancestors[uncle.ParentHash], true, !lenient); err != nil {
+			return rejectUncle(uncleHeaderCounter, err)
+		}
+		if lenient {
+			if err := ubqhash.verifySeal(chain, uncle, false); err != nil {
+				denied[hash] = struct{}{}
+			}
 		}
 	}
+	if lenient && len(block.Uncles()) > 0 {
+		ubqhash.recordUncleDecision(block.Hash(), block.NumberU64(), denied)
+	}
 	return nil
 }
 
+var (
+	// Uncle rejection counters by reason, so the causes of uncle rejections
+	// across the network can be told apart
+	uncleDuplicateCounter = metrics.NewRegisteredCounter("ubqhash/uncles/rejected/duplicate", nil)
+	uncleAncestorCounter  = metrics.NewRegisteredCounter("ubqhash/uncles/rejected/ancestor", nil)
+	uncleDanglingCounter  = metrics.NewRegisteredCounter("ubqhash/uncles/rejected/dangling", nil)
+	uncleStaleCounter     = metrics.NewRegisteredCounter("ubqhash/uncles/rejected/stale", nil)
+	uncleHeaderCounter    = metrics.NewRegisteredCounter("ubqhash/uncles/rejected/header", nil)
+)
+
+// rejectUncle counts an uncle rejection with the given reason counter and
+// returns the error unchanged.
+func rejectUncle(counter metrics.Counter, err error) error {
+	counter.Inc(1)
+	return err
+}
+
+// recordDifficultyMismatch tracks how far off a rejected header's difficulty was
+// from the expected one, in parts per million of the expected difficulty, so
+// rounding bugs can be told apart from fabricated difficulties.
+func recordDifficultyMismatch(expected, have *big.Int) {
+	if !metrics.Enabled {
+		return
+	}
+	ratio := new(big.Int).Sub(expected, have)
+	ratio.Abs(ratio)
+	ratio.Mul(ratio, big.NewInt(1000000))
+	ratio.Div(ratio, expected)
+	if !ratio.IsInt64() {
+		ratio.SetInt64(math.MaxInt64)
+	}
+	metrics.GetOrRegisterHistogram("ubqhash/difficulty/mismatch", nil, metrics.NewExpDecaySample(1028, 0.015)).Update(ratio.Int64())
+}
+
+// UncleInclusionMap returns the hashes of the uncles included by each canonical
+// block in the inclusive range [from, to], keyed by block number. Blocks without
+// uncles, or whose bodies are unavailable, are omitted.
+func UncleInclusionMap(chain consensus.ChainHeaderReader, from, to uint64) map[uint64][]common.Hash {
+	inclusions := make(map[uint64][]common.Hash)
+	for number := from; number <= to; number++ {
+		if header := chain.GetHeaderByNumber(number); header != nil {
+			if block := chain.GetBlock(header.Hash(), number); block != nil && len(block.Uncles()) > 0 {
+				hashes := make([]common.Hash, len(block.Uncles()))
+				for i, uncle := range block.Uncles() {
+					hashes[i] = uncle.Hash()
+				}
+				inclusions[number] = hashes
+			}
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return inclusions
+}
+
 // verifyHeader checks whether a header conforms to the consensus rules of the
-// stock Ethereum ubqhash engine.
-// See YP section 4.3.4. "Block Header Validity"
+// stock Ethereum ubqhash engine, reporting any rejection to the configured
+// OnHeaderRejected hook.
 func (ubqhash *Ubqhash) verifyHeader(chain consensus.ChainHeaderReader, header, parent *types.Header, uncle bool, seal bool) error {
+	return ubqhash.reportRejection(header, ubqhash.checkHeader(chain, header, parent, uncle, seal, nil))
+}
+
+// reportRejection passes a header verification failure to the configured
+// OnHeaderRejected hook, returning the error as is.
+func (ubqhash *Ubqhash) reportRejection(header *types.Header, err error) error {
+	if err != nil && ubqhash.config.OnHeaderRejected != nil {
+		if ubqhash.config.PowMode != ModeFake && ubqhash.config.PowMode != ModeFullFake {
+			ubqhash.config.OnHeaderRejected(header, err)
+		}
+	}
+	return err
+}
+
+// checkHeader checks whether a header conforms to the consensus rules of the
+// stock Ethereum ubqhash engine. If a frozen rule set is given, it's used in
+// place of the rules derived from the live chain config.
+// See YP section 4.3.4. "Block Header Validity"
+func (ubqhash *Ubqhash) checkHeader(chain consensus.ChainHeaderReader, header, parent *types.Header, uncle bool, seal bool, rules *ConsensusRules) error {
+	// Ensure that the header's block number is present and non-negative
+	if header.Number == nil || header.Number.Sign() < 0 {
+		return errInvalidNumber
+	}
+	chain = ubqhash.medianTimeChain(chain)
+
+	maxExtraDataSize, gasLimitBoundDivisor, minGasLimit := params.MaximumExtraDataSize, params.GasLimitBoundDivisor, params.MinGasLimit
+	if rules != nil {
+		maxExtraDataSize, gasLimitBoundDivisor, minGasLimit = rules.MaximumExtraDataSize, rules.GasLimitBoundDivisor, rules.MinGasLimit
+	}
 	// Ensure that the header's extra-data section is of a reasonable size
-	if uint64(len(header.Extra)) > params.MaximumExtraDataSize {
-		return fmt.Errorf("extra-data too long: %d > %d", len(header.Extra), params.MaximumExtraDataSize)
+	if uint64(len(header.Extra)) > maxExtraDataSize {
+		return fmt.Errorf("extra-data too long: %d > %d", len(header.Extra), maxExtraDataSize)
+	}
+	if validate := ubqhash.config.ExtraDataValidator; validate != nil {
+		if err := validate(header.Number.Uint64(), header.Extra); err != nil {
+			return err
+		}
+	}
+	if validate := ubqhash.config.CoinbaseValidator; validate != nil {
+		if err := validate(header.Coinbase, header.Number.Uint64()); err != nil {
+			return err
+		}
 	}
 	// Verify the header's timestamp
 	if !uncle {
-		if header.Time > uint64(time.Now().Add(allowedFutureBlockTime).Unix()) {
+		now := ubqhash.now()
+		if margin := ubqhash.config.ChainTimeMargin; margin > 0 {
+			median := chain.CalcPastMedianTime(parent.Number.Uint64(), parent)
+			if median == nil {
+				return consensus.ErrUnknownAncestor
+			}
+			now = time.Unix(median.Int64(), 0).Add(margin)
+		}
+		limit := uint64(now.Add(allowedFutureBlockTime).Unix())
+		if header.Time > limit || (ubqhash.config.FutureBoundaryInclusive && header.Time == limit) {
+			// Blocks only slightly ahead of us may be queued and retried later
+			retry := ubqhash.config.FutureBlockRetryTime
+			if retry > 0 && header.Time <= uint64(now.Add(allowedFutureBlockTime+retry).Unix()) {
+				return consensus.ErrFutureBlockRetryable
+			}
 			return consensus.ErrFutureBlock
 		}
 	}
 	if header.Time <= parent.Time {
 		return errZeroBlockTime
 	}
+	// Verify the header's timestamp isn't unreasonably far ahead of the chain's
+	// own median time, which would allow manipulating the difficulty
+	if config := chain.Config().Ubqhash; !uncle && config.MaxMedianTimeGap > 0 && config.IsMaxMedianTimeGap(header.Number) {
+		median := pastMedianTime(chain, parent)
+		if median == nil {
+			return consensus.ErrUnknownAncestor
+		}
+		if limit := new(big.Int).Add(median, new(big.Int).SetUint64(config.MaxMedianTimeGap)); new(big.Int).SetUint64(header.Time).Cmp(limit) > 0 {
+			return errMedianTimeGap
+		}
+	}
 	// Verify the block's difficulty based in it's timestamp and parent's difficulty
-	expected := ubqhash.CalcDifficulty(chain, header.Time, parent)
+	var expected *big.Int
+	if fixed := ubqhash.fixedTestDifficulty(); fixed != nil {
+		expected = fixed
+	} else if rules != nil {
+		expected = rules.Algorithm.calcDifficulty(chain, header.Time, parent, rules)
+		expected = capDifficultyIncrease(expected, parent.Difficulty, rules.MaxDifficultyIncrease)
+		if rules.MaxDifficultyBits > 0 {
+			expected = capDifficultyBits(expected, rules.MaxDifficultyBits)
+		}
+	} else {
+		expected = ubqhash.CalcDifficulty(chain, header.Time, parent)
+	}
 
+	if header.Difficulty == nil {
+		return errInvalidDifficulty
+	}
 	if expected.Cmp(header.Difficulty) != 0 {
+		recordDifficultyMismatch(expected, header.Difficulty)
 		return fmt.Errorf("invalid difficulty: have %v, want %v", header.Difficulty, expected)
 	}
+	// Past its fork, refuse blocks whose difficulty is pinned at the minimum floor
+	if chain.Config().Ubqhash.IsRejectMinimumDifficulty(header.Number) && expected.Cmp(params.MinimumDifficulty) == 0 {
+		return errMinimumDifficulty
+	}
 	// Verify that the gas limit is <= 2^63-1
 	cap := uint64(0x7fffffffffffffff)
 	if header.GasLimit > cap {
@@ -289,9 +666,9 @@ func (ubqhash *Ubqhash) verifyHeader(chain consensus.ChainHeaderReader, header,
 	if diff < 0 {
 		diff *= -1
 	}
-	limit := parent.GasLimit / params.GasLimitBoundDivisor
+	limit := parent.GasLimit / gasLimitBoundDivisor
 
-	if uint64(diff) >= limit || header.GasLimit < params.MinGasLimit {
+	if uint64(diff) >= limit || header.GasLimit < minGasLimit {
 		return fmt.Errorf("invalid gas limit: have %d, want %d += %d", header.GasLimit, parent.GasLimit, limit)
 	}
 	// Verify that the block number is parent's +1
@@ -308,38 +685,38 @@ func (ubqhash *Ubqhash) verifyHeader(chain consensus.ChainHeaderReader, header,
 }
 
 // Difficulty timespans
-func averagingWindowTimespan(config *diffConfig) *big.Int {
+func averagingWindowTimespan(config *diffConfig, target *big.Int) *big.Int {
 	x := new(big.Int)
-	return x.Mul(config.AveragingWindow, big88)
+	return x.Mul(config.AveragingWindow, target)
 }
 
-func minActualTimespan(config *diffConfig, dampen bool) *big.Int {
+func minActualTimespan(config *diffConfig, target *big.Int, dampen bool) *big.Int {
 	x := new(big.Int)
 	y := new(big.Int)
 	z := new(big.Int)
 	if dampen {
 		x.Sub(config.Factor, config.Dampen)
-		y.Mul(averagingWindowTimespan(config), x)
+		y.Mul(averagingWindowTimespan(config, target), x)
 		z.Div(y, config.Factor)
 	} else {
 		x.Sub(config.Factor, config.MaxAdjustUp)
-		y.Mul(averagingWindowTimespan(config), x)
+		y.Mul(averagingWindowTimespan(config, target), x)
 		z.Div(y, config.Factor)
 	}
 	return z
 }
 
-func maxActualTimespan(config *diffConfig, dampen bool) *big.Int {
+func maxActualTimespan(config *diffConfig, target *big.Int, dampen bool) *big.Int {
 	x := new(big.Int)
 	y := new(big.Int)
 	z := new(big.Int)
 	if dampen {
 		x.Add(config.Factor, config.Dampen)
-		y.Mul(averagingWindowTimespan(config), x)
+		y.Mul(averagingWindowTimespan(config, target), x)
 		z.Div(y, config.Factor)
 	} else {
 		x.Add(config.Factor, config.MaxAdjustDown)
-		y.Mul(averagingWindowTimespan(config), x)
+		y.Mul(averagingWindowTimespan(config, target), x)
 		z.Div(y, config.Factor)
 	}
 	return z
@@ -349,178 +726,1181 @@ func maxActualTimespan(config *diffConfig, dampen bool) *big.Int {
 // that a new block should have when created at time given the parent block's time
 // and difficulty.
 func (ubqhash *Ubqhash) CalcDifficulty(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int {
-	return CalcDifficulty(chain, time, parent)
+	if fixed := ubqhash.fixedTestDifficulty(); fixed != nil {
+		return fixed
+	}
+	if external := ubqhash.externalDifficultyAlgorithm(); external != nil {
+		return external(chain, time, parent)
+	}
+	chain = ubqhash.medianTimeChain(chain)
+
+	diff := CalcDifficulty(chain, time, parent)
+	if audit := ubqhash.config.DifficultyAuditLog; audit != nil {
+		audit(newDifficultyAuditRecord(chain, time, parent, diff))
+	}
+	return diff
 }
 
-// CalcDifficulty determines which difficulty algorithm to use for calculating a new block
-func CalcDifficulty(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int {
-	parentTime := parent.Time
-	parentNumber := parent.Number
-	parentDiff := parent.Difficulty
+// DifficultyFunc is a difficulty adjustment algorithm, returning the difficulty a
+// new block should have when created at time on top of parent.
+type DifficultyFunc func(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int
+
+var (
+	externalAlgorithms     = make(map[string]DifficultyFunc)
+	externalAlgorithmsLock sync.RWMutex
+)
 
-	config := chain.Config()
-	ubqhashConfig := config.Ubqhash
+// RegisterDifficultyAlgorithm registers an external difficulty algorithm under the
+// given name, replacing any previously registered one, or removes it if fn is nil.
+// Engines in ModeTest or ModeFake select it through ExternalDifficultyAlgorithm.
+func RegisterDifficultyAlgorithm(name string, fn DifficultyFunc) {
+	externalAlgorithmsLock.Lock()
+	defer externalAlgorithmsLock.Unlock()
 
-	if parentNumber.Cmp(ubqhashConfig.FluxBlock) < 0 {
-		if parentNumber.Cmp(ubqhashConfig.DigishieldModBlock) < 0 {
-			// Original DigishieldV3
-			return calcDifficultyDigishieldV3(chain, parentNumber, parentDiff, parent, digishieldV3Config)
-		}
-		// Modified DigishieldV3
-		return calcDifficultyDigishieldV3(chain, parentNumber, parentDiff, parent, digishieldV3ModConfig)
+	if fn == nil {
+		delete(externalAlgorithms, name)
+		return
 	}
-	// Flux
-	return calcDifficultyFlux(chain, big.NewInt(int64(time)), big.NewInt(int64(parentTime)), parentNumber, parentDiff, parent)
+	externalAlgorithms[name] = fn
 }
 
-// calcDifficultyDigishieldV3 is the original difficulty adjustment algorithm.
-// It returns the difficulty that a new block should have when created at time
-// given the parent block's time and difficulty.
-// Based on Digibyte's Digishield v3 retargeting
-func calcDifficultyDigishieldV3(chain consensus.ChainHeaderReader, parentNumber, parentDiff *big.Int, parent *types.Header, digishield *diffConfig) *big.Int {
-	// holds intermediate values to make the algo easier to read & audit
-	x := new(big.Int)
-	nFirstBlock := new(big.Int)
-	nFirstBlock.Sub(parentNumber, digishield.AveragingWindow)
-
-	log.Debug(fmt.Sprintf("CalcDifficulty parentNumber: %v parentDiff: %v", parentNumber, parentDiff))
+// externalDifficultyAlgorithm returns the registered difficulty algorithm the
+// engine is configured to use, or nil if it uses the built-in ones. Production
+// engines never use external algorithms.
+func (ubqhash *Ubqhash) externalDifficultyAlgorithm() DifficultyFunc {
+	name := ubqhash.config.ExternalDifficultyAlgorithm
+	if name == "" || (ubqhash.config.PowMode != ModeTest && ubqhash.config.PowMode != ModeFake) {
+		return nil
+	}
+	externalAlgorithmsLock.RLock()
+	defer externalAlgorithmsLock.RUnlock()
 
-	// Check we have enough blocks
-	if parentNumber.Cmp(digishield.AveragingWindow) < 1 {
-		log.Debug(fmt.Sprintf("CalcDifficulty: parentNumber(%+x) < digishieldV3Config.AveragingWindow(%+x)", parentNumber, digishield.AveragingWindow))
-		x.Set(parentDiff)
-		return x
+	fn := externalAlgorithms[name]
+	if fn == nil {
+		log.Warn("Unknown external difficulty algorithm, using built-in", "name", name)
 	}
+	return fn
+}
 
-	// Limit adjustment step
-	// Use medians to prevent time-warp attacks
-	nLastBlockTime := chain.CalcPastMedianTime(parentNumber.Uint64(), parent)
-	nFirstBlockTime := chain.CalcPastMedianTime(nFirstBlock.Uint64(), parent)
-	nActualTimespan := new(big.Int)
-	nActualTimespan.Sub(nLastBlockTime, nFirstBlockTime)
-	log.Debug(fmt.Sprintf("CalcDifficulty nActualTimespan = %v before dampening", nActualTimespan))
+// CalcDifficulty determines which difficulty algorithm to use for calculating a new block
+func CalcDifficulty(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int {
+	ubqhashConfig := chain.Config().Ubqhash
+	rules := difficultyRulesAt(ubqhashConfig, new(big.Int).Add(parent.Number, common.Big1))
+	diff := difficultyAlgorithmAt(ubqhashConfig, parent.Number).calcDifficulty(chain, time, parent, &rules)
+	diff = capDifficultyIncrease(diff, parent.Difficulty, rules.MaxDifficultyIncrease)
+	return capDifficultyBits(diff, rules.MaxDifficultyBits)
+}
 
-	y := new(big.Int)
-	y.Sub(nActualTimespan, averagingWindowTimespan(digishield))
-	y.Div(y, big.NewInt(4))
-	nActualTimespan.Add(y, averagingWindowTimespan(digishield))
-	log.Debug(fmt.Sprintf("CalcDifficulty nActualTimespan = %v before bounds", nActualTimespan))
+// MaxDifficultyBits returns the bit width the difficulty of the block with the
+// given number is clamped to, which is 256 bits unless overridden by the chain
+// config at that block.
+func MaxDifficultyBits(config *params.UbqhashConfig, number *big.Int) uint64 {
+	if config == nil || config.MaxDifficultyBits == 0 || !config.IsMaxDifficultyBits(number) {
+		return 256
+	}
+	return config.MaxDifficultyBits
+}
 
-	if nActualTimespan.Cmp(minActualTimespan(digishield, false)) < 0 {
-		nActualTimespan.Set(minActualTimespan(digishield, false))
-		log.Debug("CalcDifficulty Minimum Timespan set")
-	} else if nActualTimespan.Cmp(maxActualTimespan(digishield, false)) > 0 {
-		nActualTimespan.Set(maxActualTimespan(digishield, false))
-		log.Debug("CalcDifficulty Maximum Timespan set")
+// capDifficultyBits clamps the difficulty to the largest value representable in
+// the given number of bits, logging whenever it has to.
+func capDifficultyBits(diff *big.Int, bits uint64) *big.Int {
+	if uint64(diff.BitLen()) <= bits {
+		return diff
 	}
+	limit := new(big.Int).Lsh(common.Big1, uint(bits))
+	limit.Sub(limit, common.Big1)
 
-	log.Debug(fmt.Sprintf("CalcDifficulty nActualTimespan = %v final\n", nActualTimespan))
+	log.Error("Difficulty exceeds maximum bit width, clamping", "difficulty", diff, "bits", bits)
+	return limit
+}
 
-	// Retarget
-	x.Mul(parentDiff, averagingWindowTimespan(digishield))
-	log.Debug(fmt.Sprintf("CalcDifficulty parentDiff * AveragingWindowTimespan: %v", x))
+// maxDifficultyIncrease returns the cap on the difficulty increase of the block
+// with the given number in basis points, or nil if it is unbounded.
+func maxDifficultyIncrease(config *params.UbqhashConfig, number *big.Int) *uint64 {
+	if config == nil || !config.IsMaxPerBlockDifficultyIncrease(number) {
+		return nil
+	}
+	return config.MaxPerBlockDifficultyIncrease
+}
 
-	x.Div(x, nActualTimespan)
-	log.Debug(fmt.Sprintf("CalcDifficulty x / nActualTimespan: %v", x))
+// capDifficultyIncrease limits the difficulty to at most maxIncrease basis points
+// above the parent's difficulty. A nil maxIncrease leaves it unbounded.
+func capDifficultyIncrease(diff, parentDiff *big.Int, maxIncrease *uint64) *big.Int {
+	if maxIncrease == nil {
+		return diff
+	}
+	limit := new(big.Int).SetUint64(10000 + *maxIncrease)
+	limit.Mul(limit, parentDiff)
+	limit.Div(limit, big.NewInt(10000))
 
-	if x.Cmp(params.MinimumDifficulty) < 0 {
-		x.Set(params.MinimumDifficulty)
+	if diff.Cmp(limit) > 0 {
+		return limit
 	}
+	return diff
+}
 
-	return x
+// CalcDifficultyWithOverride calculates the difficulty of a new block the same
+// way CalcDifficulty does, but with the timestamps of the blocks numbered in the
+// overrides replaced by the given alternate ones. The overrides only apply within
+// the past median time calculation; the raw parent time used by Flux to decide
+// whether to dampen is left untouched.
+func CalcDifficultyWithOverride(chain consensus.ChainHeaderReader, time uint64, parent *types.Header, overrides map[uint64]uint64) *big.Int {
+	if len(overrides) == 0 {
+		return CalcDifficulty(chain, time, parent)
+	}
+	return CalcDifficulty(&overrideChainReader{ChainHeaderReader: chain, overrides: overrides}, time, parent)
 }
 
-func calcDifficultyFlux(chain consensus.ChainHeaderReader, time, parentTime, parentNumber, parentDiff *big.Int, parent *types.Header) *big.Int {
-	x := new(big.Int)
-	nFirstBlock := new(big.Int)
-	nFirstBlock.Sub(parentNumber, fluxConfig.AveragingWindow)
+// medianTimeChainReader is a chain header reader that delegates past median time
+// calculations to a user supplied function.
+type medianTimeChainReader struct {
+	consensus.ChainHeaderReader
+	medianTime func(number uint64, parent *types.Header) *big.Int
+}
 
-	// Check we have enough blocks
-	if parentNumber.Cmp(fluxConfig.AveragingWindow) < 1 {
-		log.Debug(fmt.Sprintf("CalcDifficulty: parentNumber(%+x) < fluxConfig.AveragingWindow(%+x)", parentNumber, fluxConfig.AveragingWindow))
-		x.Set(parentDiff)
-		return x
+// CalcPastMedianTime returns the median time supplied by the override function.
+func (r *medianTimeChainReader) CalcPastMedianTime(number uint64, parent *types.Header) *big.Int {
+	return r.medianTime(number, parent)
+}
+
+// medianTimeChain wraps the chain to use the configured median time function,
+// if there is one.
+func (ubqhash *Ubqhash) medianTimeChain(chain consensus.ChainHeaderReader) consensus.ChainHeaderReader {
+	if ubqhash.config.MedianTimeFunc == nil {
+		return chain
 	}
+	if _, ok := chain.(*medianTimeChainReader); ok {
+		return chain
+	}
+	return &medianTimeChainReader{chain, ubqhash.config.MedianTimeFunc}
+}
 
-	diffTime := new(big.Int)
-	diffTime.Sub(time, parentTime)
+// medianTimeBlocks is the number of blocks the past median time is calculated
+// over. It mirrors the window used by core.HeaderChain.
+const medianTimeBlocks = 11
 
-	nLastBlockTime := chain.CalcPastMedianTime(parentNumber.Uint64(), parent)
-	nFirstBlockTime := chain.CalcPastMedianTime(nFirstBlock.Uint64(), parent)
-	nActualTimespan := new(big.Int)
-	nActualTimespan.Sub(nLastBlockTime, nFirstBlockTime)
+// MedianTimeWindow returns the number of blocks the difficulty algorithm's past
+// median times span when retargeting the block with the given number, which is
+// medianTimeBlocks unless overridden by the chain config at that block.
+func MedianTimeWindow(config *params.UbqhashConfig, number *big.Int) uint64 {
+	if config == nil || config.MedianTimeWindow == 0 || !config.IsMedianTimeWindow(number) {
+		return medianTimeBlocks
+	}
+	return config.MedianTimeWindow
+}
 
-	y := new(big.Int)
-	y.Sub(nActualTimespan, averagingWindowTimespan(fluxConfig))
-	y.Div(y, big.NewInt(4))
-	nActualTimespan.Add(y, averagingWindowTimespan(fluxConfig))
-
-	if nActualTimespan.Cmp(minActualTimespan(fluxConfig, false)) < 0 {
-		doubleBig88 := new(big.Int)
-		doubleBig88.Mul(big88, big.NewInt(2))
-		if diffTime.Cmp(doubleBig88) > 0 {
-			nActualTimespan.Set(minActualTimespan(fluxConfig, true))
-		} else {
-			nActualTimespan.Set(minActualTimespan(fluxConfig, false))
+// pastMedianTime returns the past median time of the given parent as the
+// difficulty algorithm retargeting its child measures it, spanning the median
+// time window of the chain config over the parent's ancestry.
+func pastMedianTime(chain consensus.ChainHeaderReader, parent *types.Header) *big.Int {
+	chain = difficultyAlgorithmAt(chain.Config().Ubqhash, parent.Number).ancestryChainReader(chain, parent)
+	return chain.CalcPastMedianTime(parent.Number.Uint64(), parent)
+}
+
+// overrideChainReader is a chain header reader that calculates past median
+// times using alternate timestamps for some of the blocks.
+type overrideChainReader struct {
+	consensus.ChainHeaderReader
+	overrides map[uint64]uint64 // Alternate timestamps by block number
+	window    uint64            // Number of blocks the median is calculated over (0 = medianTimeBlocks)
+}
+
+// CalcPastMedianTime calculates the median time of the previous few blocks the
+// same way core.HeaderChain does, substituting the overridden timestamps and
+// spanning the reader's median window.
+func (r *overrideChainReader) CalcPastMedianTime(number uint64, parent *types.Header) *big.Int {
+	override := func(header *types.Header) *types.Header {
+		if header == nil {
+			return nil
 		}
-	} else if nActualTimespan.Cmp(maxActualTimespan(fluxConfig, false)) > 0 {
-		halfBig88 := new(big.Int)
-		halfBig88.Div(big88, big.NewInt(2))
-		if diffTime.Cmp(halfBig88) < 0 {
-			nActualTimespan.Set(maxActualTimespan(fluxConfig, true))
-		} else {
-			nActualTimespan.Set(maxActualTimespan(fluxConfig, false))
+		alt, ok := r.overrides[header.Number.Uint64()]
+		if !ok {
+			return header
 		}
+		cpy := *header
+		cpy.Time = alt
+		return &cpy
+	}
+	window := r.window
+	if window == 0 {
+		window = medianTimeBlocks
 	}
+	return consensus.PastMedianTime(number, override(parent), window, func(number uint64) *types.Header {
+		return override(r.GetHeaderByNumber(number))
+	})
+}
 
-	x.Mul(parentDiff, averagingWindowTimespan(fluxConfig))
-	x.Div(x, nActualTimespan)
+// DifficultyAlgorithm identifies one of the difficulty adjustment algorithms used
+// throughout the history of the chain.
+type DifficultyAlgorithm uint
 
-	if x.Cmp(params.MinimumDifficulty) < 0 {
-		x.Set(params.MinimumDifficulty)
+const (
+	DigishieldV3    DifficultyAlgorithm = iota // Original DigishieldV3
+	DigishieldV3Mod                            // Modified DigishieldV3
+	Flux                                       // Flux
+	FluxArithmetic                             // Flux on raw block times, for research only
+)
+
+// String implements fmt.Stringer, returning the lowercase name of the algorithm.
+func (algo DifficultyAlgorithm) String() string {
+	switch algo {
+	case DigishieldV3:
+		return "digishieldv3"
+	case DigishieldV3Mod:
+		return "digishieldv3mod"
+	case Flux:
+		return "flux"
+	case FluxArithmetic:
+		return "fluxarithmetic"
+	default:
+		return "unknown"
 	}
+}
 
-	return x
+// ConsensusRules is a snapshot of the consensus parameters in effect at a given
+// block height, allowing historical blocks to be verified against the rules of
+// their era regardless of later chain config changes.
+type ConsensusRules struct {
+	Number *big.Int // Block number the rules were snapshotted for
+
+	Algorithm       DifficultyAlgorithm // Difficulty algorithm for blocks at this height
+	TargetBlockTime *big.Int            // Block time in seconds the difficulty adjustment aims for
+
+	BlockReward     *big.Int // Base block reward paid to the miner
+	UncleBaseReward *big.Int // Reward the uncle rewards and inclusion bonuses derive from
+
+	MaximumExtraDataSize uint64 // Maximum size of the header extra-data
+	GasLimitBoundDivisor uint64 // Bound divisor of the gas limit change
+	MinGasLimit          uint64 // Minimum the gas limit may ever be
+
+	MaxDifficultyIncrease *uint64 // Cap on the per-block difficulty increase in basis points (nil = unbounded)
+	MaxDifficultyBits     uint64  // Bit width difficulties are clamped to (0 = unbounded)
+
+	BootstrapAlgorithm       string // Algorithm retargeting blocks until the averaging window is filled
+	RelaxedBounds            bool   // Whether the adjustment bounds are widened by a difficulty fork grace period
+	RetargetSmoothingDivisor uint64 // Divisor smoothing the retarget (0 = algorithm default)
+	MedianTimeWindow         uint64 // Number of blocks past median times span
+	AncestryMedianTime       bool   // Whether past median times follow the parent's ancestry over the canonical chain
 }
 
-// VerifySeal implements consensus.Engine, checking whether the given block satisfies
-// the PoW difficulty requirements.
-func (ubqhash *Ubqhash) VerifySeal(chain consensus.ChainHeaderReader, header *types.Header) error {
-	return ubqhash.verifySeal(chain, header, false)
+// RulesAt snapshots the consensus rules the chain config defines for the block
+// with the given number.
+func RulesAt(config *params.ChainConfig, number *big.Int) ConsensusRules {
+	initialReward, blockReward := CalcBaseBlockReward(config.Ubqhash, number)
+
+	uncleBaseReward := initialReward
+	if config.IsByzantium(number) {
+		uncleBaseReward = new(big.Int).Set(blockReward)
+	}
+	rules := difficultyRulesAt(config.Ubqhash, number)
+	rules.Algorithm = difficultyAlgorithmAt(config.Ubqhash, new(big.Int).Sub(number, common.Big1))
+	rules.BlockReward = blockReward
+	rules.UncleBaseReward = uncleBaseReward
+	rules.MaximumExtraDataSize = params.MaximumExtraDataSize
+	rules.GasLimitBoundDivisor = params.GasLimitBoundDivisor
+	rules.MinGasLimit = params.MinGasLimit
+	return rules
 }
 
-// verifySeal checks whether a block satisfies the PoW difficulty requirements,
-// either using the usual ethash cache for it, or alternatively using a full DAG
-// to make remote mining fast.
-func (ubqhash *Ubqhash) verifySeal(chain consensus.ChainHeaderReader, header *types.Header, fulldag bool) error {
-	// If we're running a fake PoW, accept any seal as valid
-	if ubqhash.config.PowMode == ModeFake || ubqhash.config.PowMode == ModeFullFake {
-		time.Sleep(ubqhash.fakeDelay)
-		if ubqhash.fakeFail == header.Number.Uint64() {
-			return errInvalidPoW
+// difficultyRulesAt snapshots the chain config parameters the difficulty
+// algorithm reads when retargeting the block with the given number. The
+// algorithm itself is left to the caller.
+func difficultyRulesAt(config *params.UbqhashConfig, number *big.Int) ConsensusRules {
+	parentNumber := new(big.Int).Sub(number, common.Big1)
+	rules := ConsensusRules{
+		Number:             new(big.Int).Set(number),
+		TargetBlockTime:    TargetBlockTime(config, number),
+		MaxDifficultyBits:  MaxDifficultyBits(config, number),
+		BootstrapAlgorithm: bootstrapAlgorithm(config, number),
+		RelaxedBounds:      inForkGrace(config, parentNumber),
+		MedianTimeWindow:   MedianTimeWindow(config, number),
+	}
+	if maxIncrease := maxDifficultyIncrease(config, number); maxIncrease != nil {
+		rules.MaxDifficultyIncrease = new(uint64)
+		*rules.MaxDifficultyIncrease = *maxIncrease
+	}
+	if config != nil {
+		if config.RetargetSmoothingDivisor > 0 && config.IsRetargetSmoothing(number) {
+			rules.RetargetSmoothingDivisor = config.RetargetSmoothingDivisor
 		}
+		rules.AncestryMedianTime = config.IsAncestryMedianTime(number)
+	}
+	return rules
+}
+
+// VerifyHeaderAtRules checks whether a header, including its seal, conforms to
+// the given frozen consensus rules instead of the ones of the live chain config.
+func (ubqhash *Ubqhash) VerifyHeaderAtRules(chain consensus.ChainHeaderReader, header, parent *types.Header, rules ConsensusRules) error {
+	if ubqhash.config.PowMode == ModeFullFake {
 		return nil
 	}
-	// If we're running a shared PoW, delegate verification to it
-	if ubqhash.shared != nil {
-		return ubqhash.shared.verifySeal(chain, header, fulldag)
+	return ubqhash.reportRejection(header, ubqhash.checkHeader(chain, header, parent, false, true, &rules))
+}
+
+// difficultyAlgorithmAt returns the difficulty algorithm used to calculate the
+// difficulty of the child of the block with the given number. Unset forks never
+// activate.
+func difficultyAlgorithmAt(config *params.UbqhashConfig, parentNumber *big.Int) DifficultyAlgorithm {
+	if config.FluxBlock == nil || parentNumber.Cmp(config.FluxBlock) < 0 {
+		if config.DigishieldModBlock == nil || parentNumber.Cmp(config.DigishieldModBlock) < 0 {
+			return DigishieldV3
+		}
+		return DigishieldV3Mod
 	}
-	// Ensure that we have a valid difficulty for the block
-	if header.Difficulty.Sign() <= 0 {
-		return errInvalidDifficulty
+	if config.FluxArithmeticTimespan {
+		return FluxArithmetic
 	}
-	// Recompute the digest and PoW values
-	number := header.Number.Uint64()
+	return Flux
+}
 
-	var (
-		digest []byte
-		result []byte
-	)
-	// If fast-but-heavy PoW verification was requested, use an ethash dataset
-	if fulldag {
-		dataset := ubqhash.dataset(number, true)
+// bootstrapAlgorithm returns the bootstrap algorithm the chain config selects for
+// the block with the given number.
+func bootstrapAlgorithm(config *params.UbqhashConfig, number *big.Int) string {
+	if config == nil || !config.IsBootstrapAlgorithm(number) {
+		return params.BootstrapHold
+	}
+	return config.BootstrapAlgorithm
+}
+
+// calcDifficulty calculates the difficulty of a new block created at time on top
+// of parent using the algorithm, following the given rules instead of the chain
+// config. The difficulty caps of the rules are left to the caller.
+func (algo DifficultyAlgorithm) calcDifficulty(chain consensus.ChainHeaderReader, time uint64, parent *types.Header, rules *ConsensusRules) *big.Int {
+	target := rules.TargetBlockTime
+
+	// Use the bootstrap algorithm, if any, until the averaging window is filled
+	if rules.BootstrapAlgorithm == params.BootstrapPerBlock && parent.Number.Cmp(algo.diffConfig().AveragingWindow) < 1 {
+		return calcDifficultyBootstrap(time, parent, target)
+	}
+	chain = algo.ancestryChainReaderAt(chain, parent, rules.MedianTimeWindow, rules.AncestryMedianTime)
+	config := algo.diffConfigWith(rules.RelaxedBounds, rules.RetargetSmoothingDivisor)
+
+	switch algo {
+	case DigishieldV3:
+		// Original DigishieldV3
+		return calcDifficultyDigishieldV3(chain, parent.Number, parent.Difficulty, parent, config, target)
+	case DigishieldV3Mod:
+		// Modified DigishieldV3
+		return calcDifficultyDigishieldV3(chain, parent.Number, parent.Difficulty, parent, config, target)
+	case FluxArithmetic:
+		// Flux on raw block times
+		return calcDifficultyFlux(chain, big.NewInt(int64(time)), big.NewInt(int64(parent.Time)), parent.Number, parent.Difficulty, parent, config, target, true)
+	default:
+		// Flux
+		return calcDifficultyFlux(chain, big.NewInt(int64(time)), big.NewInt(int64(parent.Time)), parent.Number, parent.Difficulty, parent, config, target, false)
+	}
+}
+
+// forkGraceFactor is how many times wider the adjustment bounds of a difficulty
+// algorithm are during the grace period after it activated. Four widens Flux's
+// 0.5% and 0.3% bounds to 2% and 1.2%, in line with the 3% and 2% bounds of the
+// modified DigiShield V3 it succeeds, so the difficulty keeps moving at about the
+// pace it did before the fork. The widened MaxAdjustUp must stay below Factor for
+// every algorithm, or the minimum actual timespan would drop to zero.
+const forkGraceFactor = 4
+
+// diffConfigAt returns the parameters of the difficulty algorithm for a child of
+// the given parent, with the adjustment bounds relaxed if the parent is within
+// the configured grace period after a difficulty fork and the child is past the
+// grace period fork. The median window of the
+// freshly activated algorithm still spans blocks retargeted by its predecessor,
+// which the relaxed bounds let it catch up with faster. Past the retarget
+// smoothing fork, the chain config's smoothing divisor is used.
+func (algo DifficultyAlgorithm) diffConfigAt(config *params.UbqhashConfig, parentNumber *big.Int) *diffConfig {
+	rules := difficultyRulesAt(config, new(big.Int).Add(parentNumber, common.Big1))
+	return algo.diffConfigWith(rules.RelaxedBounds, rules.RetargetSmoothingDivisor)
+}
+
+// diffConfigWith returns the parameters of the difficulty algorithm with the
+// adjustment bounds relaxed if requested, and the given smoothing divisor if it
+// is non-zero.
+func (algo DifficultyAlgorithm) diffConfigWith(relaxed bool, smoothing uint64) *diffConfig {
+	diff := algo.diffConfig()
+	if relaxed {
+		diff = diff.relaxed()
+	}
+	if smoothing > 0 {
+		smoothed := *diff
+		smoothed.RetargetSmoothingDivisor = new(big.Int).SetUint64(smoothing)
+		diff = &smoothed
+	}
+	return diff
+}
+
+// inForkGrace reports whether the child of the block with the given number falls
+// within the grace period after a difficulty fork, past the grace period fork.
+func inForkGrace(config *params.UbqhashConfig, parentNumber *big.Int) bool {
+	if config == nil || config.DifficultyForkGrace == 0 || !config.IsDifficultyForkGrace(new(big.Int).Add(parentNumber, common.Big1)) {
+		return false
+	}
+	grace := new(big.Int).SetUint64(config.DifficultyForkGrace)
+	for _, fork := range []*big.Int{config.DigishieldModBlock, config.FluxBlock} {
+		if fork == nil || fork.Sign() <= 0 || parentNumber.Cmp(fork) < 0 {
+			continue
+		}
+		if parentNumber.Cmp(new(big.Int).Add(fork, grace)) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// DifficultyMedianTimes returns the past median times at the start and the end
+// of the averaging window the difficulty algorithm measures the actual timespan
+// over, when calculating the difficulty of a child of the given parent. If the
+// chain is still shorter than the window, the algorithm keeps the parent's
+// difficulty without looking at median times, and nil is returned for both.
+func DifficultyMedianTimes(chain consensus.ChainHeaderReader, parent *types.Header) (firstMedian, lastMedian *big.Int) {
+	window := difficultyAlgorithmAt(chain.Config().Ubqhash, parent.Number).diffConfig().AveragingWindow
+	if parent.Number.Cmp(window) < 1 {
+		return nil, nil
+	}
+	chain = difficultyAlgorithmAt(chain.Config().Ubqhash, parent.Number).ancestryChainReader(chain, parent)
+
+	first := new(big.Int).Sub(parent.Number, window)
+	return chain.CalcPastMedianTime(first.Uint64(), parent), chain.CalcPastMedianTime(parent.Number.Uint64(), parent)
+}
+
+// ancestryChainReader returns a chain reader calculating past median times over
+// the ancestry of the given parent instead of the canonical chain. The two only
+// differ if the parent is not canonical, such as an uncle being promoted during
+// a reorg, in which case the timestamps of its non-canonical ancestors within
+// reach of the algorithm are overridden. Before the ancestry median time fork the
+// canonical chain is used regardless, as it always was. User supplied overrides
+// take precedence, and median times injected through MedianTimeFunc are left
+// alone. The medians span the median time window of the chain config.
+func (algo DifficultyAlgorithm) ancestryChainReader(chain consensus.ChainHeaderReader, parent *types.Header) consensus.ChainHeaderReader {
+	number := new(big.Int).Add(parent.Number, common.Big1)
+	config := chain.Config().Ubqhash
+	return algo.ancestryChainReaderAt(chain, parent, MedianTimeWindow(config, number), config.IsAncestryMedianTime(number))
+}
+
+// ancestryChainReaderAt is ancestryChainReader with the median time window and
+// whether to follow the parent's ancestry given instead of read from the chain
+// config.
+func (algo DifficultyAlgorithm) ancestryChainReaderAt(chain consensus.ChainHeaderReader, parent *types.Header, window uint64, ancestry bool) consensus.ChainHeaderReader {
+	// Injected median times are taken as they are
+	if _, ok := chain.(*medianTimeChainReader); ok {
+		return chain
+	}
+	if window == 0 {
+		window = medianTimeBlocks
+	}
+	var (
+		overrides = make(map[uint64]uint64)
+		depth     = algo.diffConfig().AveragingWindow.Uint64() + window
+	)
+	if !ancestry {
+		depth = 0
+	}
+	for header := parent; header != nil && uint64(len(overrides)) < depth; {
+		number := header.Number.Uint64()
+		if canonical := chain.GetHeaderByNumber(number); canonical != nil && canonical.Hash() == header.Hash() {
+			break
+		}
+		overrides[number] = header.Time
+		if number == 0 {
+			break
+		}
+		header = chain.GetHeader(header.ParentHash, number-1)
+	}
+	if len(overrides) == 0 && window == medianTimeBlocks {
+		return chain
+	}
+	if base, ok := chain.(*overrideChainReader); ok {
+		for number, time := range base.overrides {
+			overrides[number] = time
+		}
+		chain = base.ChainHeaderReader
+	}
+	return &overrideChainReader{chain, overrides, window}
+}
+
+// diffConfig returns the parameters of the difficulty algorithm.
+func (algo DifficultyAlgorithm) diffConfig() *diffConfig {
+	switch algo {
+	case DigishieldV3:
+		return digishieldV3Config
+	case DigishieldV3Mod:
+		return digishieldV3ModConfig
+	default:
+		return fluxConfig
+	}
+}
+
+// CheckDifficultyHealth recomputes the difficulty of the given head block from
+// its parent and reports an error if it diverges from the stored one, serving as
+// a quick liveness probe of the difficulty algorithm against the chain. The
+// genesis block has no difficulty to recompute and always passes.
+func CheckDifficultyHealth(chain consensus.ChainHeaderReader, head *types.Header) error {
+	if head.Number.Sign() == 0 {
+		return nil
+	}
+	parent := chain.GetHeader(head.ParentHash, head.Number.Uint64()-1)
+	if parent == nil {
+		return consensus.ErrUnknownAncestor
+	}
+	if expected := CalcDifficulty(chain, head.Time, parent); expected.Cmp(head.Difficulty) != 0 {
+		return fmt.Errorf("invalid difficulty: have %v, want %v", head.Difficulty, expected)
+	}
+	return nil
+}
+
+// VerifyCheckpointDifficulty checks that the cumulative difficulty of the canonical
+// chain up to and including each of the given checkpoint blocks meets minWork,
+// guarding against a low-work fork posing as the canonical chain. The checkpoints
+// must be in ascending order. Difficulties are summed from genesis in a single
+// pass up to the last checkpoint.
+func VerifyCheckpointDifficulty(chain consensus.ChainHeaderReader, checkpoints []uint64, minWork *big.Int) error {
+	var (
+		work = new(big.Int)
+		next = uint64(0)
+	)
+	for i, checkpoint := range checkpoints {
+		if i > 0 && checkpoint <= checkpoints[i-1] {
+			return fmt.Errorf("unsorted checkpoints: #%d after #%d", checkpoint, checkpoints[i-1])
+		}
+		for ; next <= checkpoint; next++ {
+			header := chain.GetHeaderByNumber(next)
+			if header == nil {
+				return fmt.Errorf("missing header #%d", next)
+			}
+			work.Add(work, header.Difficulty)
+		}
+		if work.Cmp(minWork) < 0 {
+			return fmt.Errorf("insufficient work at checkpoint #%d: have %v, want at least %v", checkpoint, work, minWork)
+		}
+	}
+	return nil
+}
+
+// SimulateDifficulty runs the difficulty algorithm over a chain starting from a
+// genesis block of the given difficulty, with the blocks following each other by
+// the given block times. The difficulty of every simulated block is returned, in
+// order. The chain uses the default target block time and median time window.
+func SimulateDifficulty(algo DifficultyAlgorithm, blockTimes []uint64, startDiff *big.Int) []*big.Int {
+	chain := &simulatedChain{
+		config:  &params.ChainConfig{Ubqhash: new(params.UbqhashConfig)},
+		headers: []*types.Header{{Number: new(big.Int), Difficulty: new(big.Int).Set(startDiff)}},
+	}
+	diffs := make([]*big.Int, 0, len(blockTimes))
+	for _, blockTime := range blockTimes {
+		parent := chain.CurrentHeader()
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     new(big.Int).Add(parent.Number, common.Big1),
+			Time:       parent.Time + blockTime,
+		}
+		rules := difficultyRulesAt(chain.config.Ubqhash, header.Number)
+		header.Difficulty = algo.calcDifficulty(chain, header.Time, parent, &rules)
+
+		chain.headers = append(chain.headers, header)
+		diffs = append(diffs, header.Difficulty)
+	}
+	return diffs
+}
+
+// CompareAlgorithms simulates both the modified DigiShield V3 algorithm and its
+// successor Flux over the same block time series, returning the difficulties each
+// would have retargeted the blocks to.
+func CompareAlgorithms(blockTimes []uint64, startDiff *big.Int) (digishield, flux []*big.Int) {
+	return SimulateDifficulty(DigishieldV3Mod, blockTimes, startDiff), SimulateDifficulty(Flux, blockTimes, startDiff)
+}
+
+// simulatedChain is an in-memory chain header reader over a canonical series of
+// headers numbered from zero, used to simulate difficulty adjustments.
+type simulatedChain struct {
+	config  *params.ChainConfig
+	headers []*types.Header
+}
+
+func (c *simulatedChain) Config() *params.ChainConfig  { return c.config }
+func (c *simulatedChain) CurrentHeader() *types.Header { return c.headers[len(c.headers)-1] }
+
+func (c *simulatedChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := c.GetHeaderByNumber(number); header != nil && header.Hash() == hash {
+		return header
+	}
+	return nil
+}
+
+func (c *simulatedChain) GetHeaderByNumber(number uint64) *types.Header {
+	if number >= uint64(len(c.headers)) {
+		return nil
+	}
+	return c.headers[number]
+}
+
+func (c *simulatedChain) GetHeaderByHash(hash common.Hash) *types.Header {
+	for _, header := range c.headers {
+		if header.Hash() == hash {
+			return header
+		}
+	}
+	return nil
+}
+
+func (c *simulatedChain) CalcPastMedianTime(number uint64, parent *types.Header) *big.Int {
+	return consensus.PastMedianTime(number, parent, medianTimeBlocks, c.GetHeaderByNumber)
+}
+
+func (c *simulatedChain) GetBlock(hash common.Hash, number uint64) *types.Block { return nil }
+
+// timeWarpSwings is the number of consecutive backward-then-forward timestamp
+// swings DetectTimeWarp reports as a time-warp attempt. A run this long is all but
+// impossible by chance with the thresholds used.
+const timeWarpSwings = 3
+
+// DetectTimeWarp reports whether the canonical headers numbered from through to
+// show the timestamp oscillation of a time-warp attempt: blocks alternately held
+// back to within an eighth of the target block time of their parent, or even
+// before it, and pushed ahead by at least three target block times, repeatedly
+// and without a break. The past median time rules out warping the difficulty this
+// way, so a positive result means someone is trying rather than succeeding.
+func DetectTimeWarp(chain consensus.ChainHeaderReader, from, to uint64) bool {
+	const (
+		normal = iota
+		backward
+		forward
+	)
+	var (
+		parent *types.Header
+		last   = normal
+		swings = 0
+	)
+	for number := from; number <= to; number++ {
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			break
+		}
+		if parent != nil {
+			target := TargetBlockTime(chain.Config().Ubqhash, header.Number).Int64()
+			delta := int64(header.Time) - int64(parent.Time)
+			switch {
+			case delta <= target/8:
+				// Held back, continuing the oscillation only right after a push ahead
+				if last != forward {
+					swings = 0
+				}
+				last = backward
+			case delta >= 3*target:
+				// Pushed ahead, completing a swing if it was held back before
+				if last == backward {
+					if swings++; swings >= timeWarpSwings {
+						return true
+					}
+				} else {
+					swings = 0
+				}
+				last = forward
+			default:
+				swings, last = 0, normal
+			}
+		}
+		parent = header
+	}
+	return false
+}
+
+// StallDifficulty returns the difficulty a block mined on top of head at the given
+// time would retarget to, so the effective difficulty can be reported while the
+// chain is stalled. The median time based algorithms only take the time since the
+// head into account for dampening, so the drop they show during a stall is far
+// smaller than with raw block time retargeting. Times before the head's are
+// treated as the head's own time.
+func StallDifficulty(chain consensus.ChainHeaderReader, head *types.Header, now uint64) *big.Int {
+	if now < head.Time {
+		now = head.Time
+	}
+	return CalcDifficulty(chain, now, head)
+}
+
+// DifficultyForTimeRange returns the difficulty a block on top of parent would
+// have at each of the candidate timestamps, in order, such as for pools showing
+// the difficulty of blocks found within the next minute. Flux bases the dampening
+// of clamped adjustments on the time since the parent block, so the difficulty
+// may change across the candidates even though the median times don't.
+func DifficultyForTimeRange(chain consensus.ChainHeaderReader, parent *types.Header, times []uint64) []*big.Int {
+	diffs := make([]*big.Int, len(times))
+	for i, time := range times {
+		diffs[i] = CalcDifficulty(chain, time, parent)
+	}
+	return diffs
+}
+
+// MinNextTimestamp returns the earliest timestamp a block on top of parent can
+// have. Header verification accepts any time after the parent's, but Flux dampens
+// the adjustment of a slow chain for blocks arriving within half the target block
+// time, so if that would change the difficulty, the threshold is returned instead.
+func MinNextTimestamp(chain consensus.ChainHeaderReader, parent *types.Header) uint64 {
+	earliest := parent.Time + 1
+
+	threshold := parent.Time + TargetBlockTime(chain.Config().Ubqhash, new(big.Int).Add(parent.Number, common.Big1)).Uint64()/2
+	if threshold > earliest && CalcDifficulty(chain, earliest, parent).Cmp(CalcDifficulty(chain, threshold, parent)) != 0 {
+		return threshold
+	}
+	return earliest
+}
+
+// BlockWork returns the work the given header contributes to fork choice, which
+// is a copy of its difficulty, so callers can't alias the header's own value. A
+// missing or non-positive difficulty is reported as an error.
+func BlockWork(header *types.Header) (*big.Int, error) {
+	if header.Difficulty == nil || header.Difficulty.Sign() <= 0 {
+		return nil, errInvalidDifficulty
+	}
+	return new(big.Int).Set(header.Difficulty), nil
+}
+
+// DifficultyDelta returns the absolute and percentage change of the difficulty of
+// the given header compared to its parent's.
+func DifficultyDelta(chain consensus.ChainHeaderReader, header *types.Header) (*big.Int, float64, error) {
+	if header.Number == nil || header.Number.Sign() <= 0 {
+		return nil, 0, consensus.ErrUnknownAncestor
+	}
+	parent := chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return nil, 0, consensus.ErrUnknownAncestor
+	}
+	if parent.Difficulty == nil || parent.Difficulty.Sign() <= 0 || header.Difficulty == nil {
+		return nil, 0, errInvalidDifficulty
+	}
+	delta := new(big.Int).Sub(header.Difficulty, parent.Difficulty)
+
+	percent, _ := new(big.Float).Quo(new(big.Float).SetInt(delta), new(big.Float).SetInt(parent.Difficulty)).Float64()
+	return delta, percent * 100, nil
+}
+
+// ImpliedBlockTime estimates the average block time in seconds the retarget that
+// produced the difficulty of the given header responded to, by reversing the
+// scaling and dampening of the actual timespan. The estimate is only as exact as
+// the integer math of the retarget allows, and merely a bound if the timespan was
+// clamped. Zero is returned if the header's difficulty isn't the result of a
+// retarget, or its parent is unknown.
+func ImpliedBlockTime(chain consensus.ChainHeaderReader, header *types.Header) float64 {
+	if header.Number == nil || header.Number.Sign() <= 0 || header.Difficulty == nil || header.Difficulty.Sign() <= 0 {
+		return 0
+	}
+	parent := chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil || parent.Difficulty == nil || parent.Difficulty.Sign() <= 0 {
+		return 0
+	}
+	ubqhashConfig := chain.Config().Ubqhash
+	config := difficultyAlgorithmAt(ubqhashConfig, parent.Number).diffConfigAt(ubqhashConfig, parent.Number)
+	if parent.Number.Cmp(config.AveragingWindow) < 1 {
+		return 0
+	}
+	// difficulty = parentDiff * window / clamped, so clamped = window * parentDiff / difficulty
+	window := new(big.Float).SetInt(averagingWindowTimespan(config, TargetBlockTime(ubqhashConfig, header.Number)))
+	clamped := new(big.Float).Mul(window, new(big.Float).SetInt(parent.Difficulty))
+	clamped.Quo(clamped, new(big.Float).SetInt(header.Difficulty))
+
+	// clamped = window + (raw - window) / divisor, so raw = window + (clamped - window) * divisor
+	raw := new(big.Float).Sub(clamped, window)
+	raw.Mul(raw, new(big.Float).SetInt(config.smoothingDivisor()))
+	raw.Add(raw, window)
+
+	blockTime, _ := raw.Quo(raw, new(big.Float).SetInt(config.AveragingWindow)).Float64()
+	return blockTime
+}
+
+// RetargetClamp describes whether a difficulty retarget hit one of the bounds its
+// algorithm places on the actual timespan.
+type RetargetClamp uint
+
+const (
+	RetargetUnclamped   RetargetClamp = iota // Actual timespan within bounds
+	RetargetMaxIncrease                      // Timespan clamped to its minimum, raising the difficulty the most allowed
+	RetargetMaxDecrease                      // Timespan clamped to its maximum, lowering the difficulty the most allowed
+	RetargetSkipped                          // No retarget, the chain was shorter than the averaging window
+)
+
+// DifficultySnapshot is a summary of the difficulty state at a given head block,
+// meant for feeding external metrics exporters.
+type DifficultySnapshot struct {
+	Number     uint64              // Number of the head block
+	Difficulty *big.Int            // Difficulty of the head block
+	Algorithm  DifficultyAlgorithm // Algorithm calculating the difficulty of the next block
+	Clamp      RetargetClamp       // Clamp status of the retarget producing the head's difficulty
+}
+
+// DifficultyMetrics summarizes the difficulty state at the given head block: its
+// difficulty, the algorithm active for the next block and whether the retarget
+// that produced the head's difficulty was clamped. The retarget is reported as
+// skipped for the genesis block or if the head's parent is unknown.
+func DifficultyMetrics(chain consensus.ChainHeaderReader, head *types.Header) DifficultySnapshot {
+	config := chain.Config().Ubqhash
+	snapshot := DifficultySnapshot{
+		Number:     head.Number.Uint64(),
+		Difficulty: new(big.Int).Set(head.Difficulty),
+		Algorithm:  difficultyAlgorithmAt(config, head.Number),
+		Clamp:      RetargetSkipped,
+	}
+	if head.Number.Sign() == 0 {
+		return snapshot
+	}
+	parent := chain.GetHeader(head.ParentHash, head.Number.Uint64()-1)
+	if parent == nil {
+		return snapshot
+	}
+	if r := difficultyAlgorithmAt(config, parent.Number).retargetAt(chain, head.Time, parent, TargetBlockTime(config, head.Number)); r != nil {
+		snapshot.Clamp = r.clamp
+	}
+	return snapshot
+}
+
+// ExportDifficultyCSV writes the difficulty history of the canonical blocks in the
+// inclusive range [from, to] to w as CSV, one row per block holding its number,
+// timestamp, difficulty, the algorithm that calculated it and the time since its
+// parent. The algorithm and block time are left empty for the genesis block.
+func ExportDifficultyCSV(chain consensus.ChainHeaderReader, from, to uint64, w io.Writer) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"number", "timestamp", "difficulty", "algorithm", "blocktime"}); err != nil {
+		return err
+	}
+	config := chain.Config().Ubqhash
+	for number := from; number <= to; number++ {
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			return fmt.Errorf("missing header #%d", number)
+		}
+		var algorithm, blockTime string
+		if number > 0 {
+			parent := chain.GetHeader(header.ParentHash, number-1)
+			if parent == nil {
+				return fmt.Errorf("missing parent of header #%d", number)
+			}
+			algorithm = difficultyAlgorithmAt(config, parent.Number).String()
+			blockTime = strconv.FormatUint(header.Time-parent.Time, 10)
+		}
+		record := []string{strconv.FormatUint(number, 10), strconv.FormatUint(header.Time, 10), header.Difficulty.String(), algorithm, blockTime}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// DifficultyAuditRecord is the complete trail of a single difficulty calculation.
+type DifficultyAuditRecord struct {
+	Number           uint64              // Number of the block the difficulty is calculated for
+	Algorithm        DifficultyAlgorithm // Difficulty algorithm used
+	ParentDifficulty *big.Int            // Difficulty of the parent block
+	FirstMedian      *big.Int            // Past median time at the start of the window (nil if unused)
+	LastMedian       *big.Int            // Past median time at the end of the window (nil if unused)
+	RawTimespan      *big.Int            // Actual timespan as measured (nil if not retargeted)
+	ClampedTimespan  *big.Int            // Timespan after dampening and clamping (nil if not retargeted)
+	Difficulty       *big.Int            // Resulting difficulty
+}
+
+// newDifficultyAuditRecord assembles the audit record of the calculation of the
+// given difficulty for a block created at time on top of parent.
+func newDifficultyAuditRecord(chain consensus.ChainHeaderReader, time uint64, parent *types.Header, difficulty *big.Int) DifficultyAuditRecord {
+	config := chain.Config().Ubqhash
+	record := DifficultyAuditRecord{
+		Number:           parent.Number.Uint64() + 1,
+		Algorithm:        difficultyAlgorithmAt(config, parent.Number),
+		ParentDifficulty: new(big.Int).Set(parent.Difficulty),
+		Difficulty:       new(big.Int).Set(difficulty),
+	}
+	if r := record.Algorithm.retargetAt(chain, time, parent, TargetBlockTime(config, new(big.Int).Add(parent.Number, common.Big1))); r != nil {
+		record.FirstMedian, record.LastMedian = r.firstMedian, r.lastMedian
+		record.RawTimespan, record.ClampedTimespan = r.raw, r.clamped
+	}
+	return record
+}
+
+// retarget holds the intermediate values of a difficulty retarget.
+type retarget struct {
+	firstMedian *big.Int      // Past median time at the start of the window (nil on raw block times)
+	lastMedian  *big.Int      // Past median time at the end of the window (nil on raw block times)
+	raw         *big.Int      // Actual timespan as measured
+	dampened    *big.Int      // Actual timespan moved three quarters towards the window timespan
+	clamped     *big.Int      // Timespan the difficulty is scaled by, within the algorithm's bounds
+	clamp       RetargetClamp // Whether the timespan hit one of the bounds
+}
+
+// retargetAt recomputes the intermediate values of the retarget the algorithm
+// performs for a block created at time on top of parent. It returns nil if the
+// chain is too short for a retarget, or its past median times are unavailable.
+//
+// Note, retargetAt reimplements the smoothing and the bounds of
+// calcDifficultyDigishieldV3 and calcDifficultyFlux rather than sharing their
+// code, which consensus depends on. Any change to either has to be mirrored here,
+// or the audit records and snapshots built on top will misreport the retarget.
+func (algo DifficultyAlgorithm) retargetAt(chain consensus.ChainHeaderReader, time uint64, parent *types.Header, target *big.Int) *retarget {
+	config := algo.diffConfigAt(chain.Config().Ubqhash, parent.Number)
+	if parent.Number.Cmp(config.AveragingWindow) < 1 {
+		return nil
+	}
+	diffTime := new(big.Int).Sub(new(big.Int).SetUint64(time), new(big.Int).SetUint64(parent.Time))
+
+	r := &retarget{raw: new(big.Int), clamp: RetargetUnclamped}
+	if algo == FluxArithmetic {
+		r.raw.Mul(diffTime, config.AveragingWindow)
+	} else {
+		r.firstMedian, r.lastMedian = DifficultyMedianTimes(chain, parent)
+		if r.firstMedian == nil || r.lastMedian == nil {
+			return nil // Median times unavailable, the difficulty is kept as is
+		}
+		r.raw.Sub(r.lastMedian, r.firstMedian)
+	}
+	window := averagingWindowTimespan(config, target)
+	r.dampened = new(big.Int).Sub(r.raw, window)
+	r.dampened.Div(r.dampened, config.smoothingDivisor())
+	r.dampened.Add(r.dampened, window)
+
+	// Flux narrows the bounds if the block time already moves in their direction
+	flux := algo == Flux || algo == FluxArithmetic
+	switch {
+	case r.dampened.Cmp(minActualTimespan(config, target, false)) < 0:
+		r.clamp = RetargetMaxIncrease
+		r.clamped = minActualTimespan(config, target, flux && diffTime.Cmp(new(big.Int).Mul(target, big2)) > 0)
+	case r.dampened.Cmp(maxActualTimespan(config, target, false)) > 0:
+		r.clamp = RetargetMaxDecrease
+		r.clamped = maxActualTimespan(config, target, flux && diffTime.Cmp(new(big.Int).Div(target, big2)) < 0)
+	default:
+		r.clamped = new(big.Int).Set(r.dampened)
+	}
+	return r
+}
+
+// TargetBlockTime returns the block time in seconds the difficulty algorithms aim
+// for when retargeting the block with the given number, which is 88 seconds unless
+// overridden by the chain config at that block.
+func TargetBlockTime(config *params.UbqhashConfig, number *big.Int) *big.Int {
+	if config == nil || config.TargetBlockTime == 0 || !config.IsTargetBlockTime(number) {
+		return new(big.Int).Set(big88)
+	}
+	return new(big.Int).SetUint64(config.TargetBlockTime)
+}
+
+// calcDifficultyDigishieldV3 is the original difficulty adjustment algorithm.
+// It returns the difficulty that a new block should have when created at time
+// given the parent block's time and difficulty.
+// Based on Digibyte's Digishield v3 retargeting
+func calcDifficultyDigishieldV3(chain consensus.ChainHeaderReader, parentNumber, parentDiff *big.Int, parent *types.Header, digishield *diffConfig, target *big.Int) *big.Int {
+	// holds intermediate values to make the algo easier to read & audit
+	x := new(big.Int)
+	nFirstBlock := new(big.Int)
+	nFirstBlock.Sub(parentNumber, digishield.AveragingWindow)
+
+	log.Debug(fmt.Sprintf("CalcDifficulty parentNumber: %v parentDiff: %v", parentNumber, parentDiff))
+
+	// Check we have enough blocks
+	if parentNumber.Cmp(digishield.AveragingWindow) < 1 {
+		log.Debug(fmt.Sprintf("CalcDifficulty: parentNumber(%+x) < digishieldV3Config.AveragingWindow(%+x)", parentNumber, digishield.AveragingWindow))
+		x.Set(parentDiff)
+		return x
+	}
+
+	// Limit adjustment step
+	// Use medians to prevent time-warp attacks
+	nLastBlockTime := chain.CalcPastMedianTime(parentNumber.Uint64(), parent)
+	nFirstBlockTime := chain.CalcPastMedianTime(nFirstBlock.Uint64(), parent)
+	if nLastBlockTime == nil || nFirstBlockTime == nil {
+		log.Error("Missing past median time, keeping parent difficulty", "number", parentNumber)
+		x.Set(parentDiff)
+		return x
+	}
+	nActualTimespan := new(big.Int)
+	nActualTimespan.Sub(nLastBlockTime, nFirstBlockTime)
+	log.Debug(fmt.Sprintf("CalcDifficulty nActualTimespan = %v before dampening", nActualTimespan))
+
+	y := new(big.Int)
+	y.Sub(nActualTimespan, averagingWindowTimespan(digishield, target))
+	y.Div(y, digishield.smoothingDivisor())
+	nActualTimespan.Add(y, averagingWindowTimespan(digishield, target))
+	log.Debug(fmt.Sprintf("CalcDifficulty nActualTimespan = %v before bounds", nActualTimespan))
+
+	if nActualTimespan.Cmp(minActualTimespan(digishield, target, false)) < 0 {
+		nActualTimespan.Set(minActualTimespan(digishield, target, false))
+		log.Debug("CalcDifficulty Minimum Timespan set")
+	} else if nActualTimespan.Cmp(maxActualTimespan(digishield, target, false)) > 0 {
+		nActualTimespan.Set(maxActualTimespan(digishield, target, false))
+		log.Debug("CalcDifficulty Maximum Timespan set")
+	}
+
+	log.Debug(fmt.Sprintf("CalcDifficulty nActualTimespan = %v final\n", nActualTimespan))
+
+	// Retarget
+	x.Mul(parentDiff, averagingWindowTimespan(digishield, target))
+	log.Debug(fmt.Sprintf("CalcDifficulty parentDiff * AveragingWindowTimespan: %v", x))
+
+	x.Div(x, nActualTimespan)
+	log.Debug(fmt.Sprintf("CalcDifficulty x / nActualTimespan: %v", x))
+
+	if x.Cmp(params.MinimumDifficulty) < 0 {
+		x.Set(params.MinimumDifficulty)
+	}
+
+	return x
+}
+
+// bootstrapBoundDivisor is the divisor of the parent's difficulty giving the
+// step the bootstrap algorithm adjusts the difficulty by.
+const bootstrapBoundDivisor = 32
+
+// calcDifficultyBootstrap is the per-block difficulty adjustment used before the
+// chain is long enough for the regular algorithms. It raises the difficulty by a
+// step if the block came faster than the target, and lowers it by a step for every
+// whole target block time the block took if slower, up to 99 steps.
+func calcDifficultyBootstrap(time uint64, parent *types.Header, target *big.Int) *big.Int {
+	step := new(big.Int).Div(parent.Difficulty, big.NewInt(bootstrapBoundDivisor))
+
+	delta := new(big.Int).Sub(new(big.Int).SetUint64(time), new(big.Int).SetUint64(parent.Time))
+	x := new(big.Int).Set(parent.Difficulty)
+	switch delta.Cmp(target) {
+	case -1:
+		x.Add(x, step)
+	case 1:
+		steps := new(big.Int).Div(delta, target)
+		if steps.Cmp(big.NewInt(99)) > 0 {
+			steps.SetInt64(99)
+		}
+		x.Sub(x, step.Mul(step, steps))
+	}
+	if x.Cmp(params.MinimumDifficulty) < 0 {
+		x.Set(params.MinimumDifficulty)
+	}
+	return x
+}
+
+// calcDifficultyFlux is the Flux difficulty adjustment algorithm. If arithmetic
+// is set, the actual timespan is extrapolated from the time since the parent block
+// alone instead of measured between past median times, which is only meant for
+// comparing the two against time-warp attacks.
+func calcDifficultyFlux(chain consensus.ChainHeaderReader, time, parentTime, parentNumber, parentDiff *big.Int, parent *types.Header, flux *diffConfig, target *big.Int, arithmetic bool) *big.Int {
+	x := new(big.Int)
+	nFirstBlock := new(big.Int)
+	nFirstBlock.Sub(parentNumber, flux.AveragingWindow)
+
+	// Check we have enough blocks
+	if parentNumber.Cmp(flux.AveragingWindow) < 1 {
+		log.Debug(fmt.Sprintf("CalcDifficulty: parentNumber(%+x) < fluxConfig.AveragingWindow(%+x)", parentNumber, flux.AveragingWindow))
+		x.Set(parentDiff)
+		return x
+	}
+
+	// The dampening decision deliberately looks at the raw time since the parent
+	// block, whereas the actual timespan below is measured between past median
+	// times. Switching either one to the other's source would change consensus.
+	diffTime := new(big.Int)
+	diffTime.Sub(time, parentTime)
+
+	nActualTimespan := new(big.Int)
+	if arithmetic {
+		nActualTimespan.Mul(diffTime, flux.AveragingWindow)
+	} else {
+		nLastBlockTime := chain.CalcPastMedianTime(parentNumber.Uint64(), parent)
+		nFirstBlockTime := chain.CalcPastMedianTime(nFirstBlock.Uint64(), parent)
+		if nLastBlockTime == nil || nFirstBlockTime == nil {
+			log.Error("Missing past median time, keeping parent difficulty", "number", parentNumber)
+			x.Set(parentDiff)
+			return x
+		}
+		nActualTimespan.Sub(nLastBlockTime, nFirstBlockTime)
+	}
+
+	y := new(big.Int)
+	y.Sub(nActualTimespan, averagingWindowTimespan(flux, target))
+	y.Div(y, flux.smoothingDivisor())
+	nActualTimespan.Add(y, averagingWindowTimespan(flux, target))
+
+	if nActualTimespan.Cmp(minActualTimespan(flux, target, false)) < 0 {
+		doubleTarget := new(big.Int)
+		doubleTarget.Mul(target, big.NewInt(2))
+		if diffTime.Cmp(doubleTarget) > 0 {
+			nActualTimespan.Set(minActualTimespan(flux, target, true))
+		} else {
+			nActualTimespan.Set(minActualTimespan(flux, target, false))
+		}
+	} else if nActualTimespan.Cmp(maxActualTimespan(flux, target, false)) > 0 {
+		halfTarget := new(big.Int)
+		halfTarget.Div(target, big.NewInt(2))
+		if diffTime.Cmp(halfTarget) < 0 {
+			nActualTimespan.Set(maxActualTimespan(flux, target, true))
+		} else {
+			nActualTimespan.Set(maxActualTimespan(flux, target, false))
+		}
+	}
+
+	x.Mul(parentDiff, averagingWindowTimespan(flux, target))
+	x.Div(x, nActualTimespan)
+
+	if x.Cmp(params.MinimumDifficulty) < 0 {
+		x.Set(params.MinimumDifficulty)
+	}
+
+	return x
+}
+
+// VerifySeal implements consensus.Engine, checking whether the given block satisfies
+// the PoW difficulty requirements.
+func (ubqhash *Ubqhash) VerifySeal(chain consensus.ChainHeaderReader, header *types.Header) error {
+	return ubqhash.verifySeal(chain, header, false)
+}
+
+// verifySeal checks whether a block satisfies the PoW difficulty requirements,
+// either using the usual ethash cache for it, or alternatively using a full DAG
+// to make remote mining fast.
+func (ubqhash *Ubqhash) verifySeal(chain consensus.ChainHeaderReader, header *types.Header, fulldag bool) error {
+	return ubqhash.verifySealAt(chain, header, header.Difficulty, fulldag)
+}
+
+// VerifySealAtDifficulty checks whether the seal of a header satisfies the given
+// share difficulty instead of the header's own one, as needed by mining pools
+// accepting shares below the block difficulty. The mix digest is still checked
+// against the header's nonce.
+func (ubqhash *Ubqhash) VerifySealAtDifficulty(header *types.Header, shareDifficulty *big.Int) error {
+	return ubqhash.verifySealAt(nil, header, shareDifficulty, false)
+}
+
+// verifySealAt checks whether the seal of a header satisfies the PoW difficulty
+// requirements of the given difficulty.
+func (ubqhash *Ubqhash) verifySealAt(chain consensus.ChainHeaderReader, header *types.Header, difficulty *big.Int, fulldag bool) error {
+	// If we're running a fake PoW, accept any seal as valid
+	if ubqhash.config.PowMode == ModeFake || ubqhash.config.PowMode == ModeFullFake {
+		time.Sleep(ubqhash.config.FakeDelay)
+		if ubqhash.config.FakeFail == header.Number.Uint64() {
+			return errInvalidPoW
+		}
+		return nil
+	}
+	// Derive the seal hash by the rules of the chain, even if a shared PoW verifies
+	sealHash := ubqhash.sealHashAt(ubqhash.chainConfig(chain), header)
+
+	// If we're running a shared PoW, delegate verification to it
+	if ubqhash.shared != nil {
+		return ubqhash.shared.verifyPoW(header, sealHash, difficulty, fulldag)
+	}
+	return ubqhash.verifyPoW(header, sealHash, difficulty, fulldag)
+}
+
+// verifyPoW checks whether the nonce and mix digest of a header are a valid
+// proof-of-work for the given seal hash at the given difficulty.
+func (ubqhash *Ubqhash) verifyPoW(header *types.Header, sealHash common.Hash, difficulty *big.Int, fulldag bool) error {
+	// Ensure that we have a valid difficulty to check against
+	if difficulty == nil || difficulty.Sign() <= 0 {
+		return errInvalidDifficulty
+	}
+	// Recompute the digest and PoW values
+	number := header.Number.Uint64()
+	defer sealVerifyTimer(number / epochLength).UpdateSince(time.Now())
+
+	var (
+		digest []byte
+		result []byte
+	)
+	// If fast-but-heavy PoW verification was requested, use an ethash dataset
+	if fulldag {
+		dataset := ubqhash.dataset(number, true)
 		if dataset.generated() {
-			digest, result = hashimotoFull(dataset.dataset, ubqhash.SealHash(header).Bytes(), header.Nonce.Uint64())
+			digest, result = hashimotoFull(dataset.dataset, sealHash.Bytes(), header.Nonce.Uint64())
 
 			// Datasets are unmapped in a finalizer. Ensure that the dataset stays alive
 			// until after the call to hashimotoFull so it's not unmapped while being used.
@@ -533,23 +1913,145 @@ func (ubqhash *Ubqhash) verifySeal(chain consensus.ChainHeaderReader, header *ty
 	// If slow-but-light PoW verification was requested (or DAG not yet ready), use an ethash cache
 	if !fulldag {
 		cache := ubqhash.cache(number)
-
-		size := datasetSize(number)
-		if ubqhash.config.PowMode == ModeTest {
-			size = 32 * 1024
-		}
-		digest, result = hashimotoLight(size, cache.cache, ubqhash.SealHash(header).Bytes(), header.Nonce.Uint64())
+		digest, result = hashimotoLight(ubqhash.verificationSize(number), cache.cache, sealHash.Bytes(), header.Nonce.Uint64())
 
 		// Caches are unmapped in a finalizer. Ensure that the cache stays alive
 		// until after the call to hashimotoLight so it's not unmapped while being used.
 		runtime.KeepAlive(cache)
 	}
 	// Verify the calculated values against the ones provided in the header
-	if !bytes.Equal(header.MixDigest[:], digest) {
+	return verifySealResult(header.MixDigest, ubqhash.sealDifficulty(difficulty), digest, result)
+}
+
+// sealVerifyTimerName returns the name of the timer tracking the seal
+// verification times of the given epoch.
+func sealVerifyTimerName(epoch uint64) string {
+	return fmt.Sprintf("ubqhash/seal/verify/%d", epoch)
+}
+
+// sealVerifyTimer returns the timer tracking the seal verification times of the
+// given epoch, so slowdowns can be correlated with epoch transitions. Timers are
+// unregistered once their epoch's verification cache is evicted, keeping the
+// number of live metrics bounded by the caches kept in memory.
+func sealVerifyTimer(epoch uint64) metrics.Timer {
+	return metrics.GetOrRegisterTimer(sealVerifyTimerName(epoch), nil)
+}
+
+// verificationSize returns the dataset size light verification of the given block
+// runs hashimoto against, which is the tiny test dataset's in ModeTest.
+func (ubqhash *Ubqhash) verificationSize(number uint64) uint64 {
+	if ubqhash.config.PowMode == ModeTest {
+		return 32 * 1024
+	}
+	return datasetSize(number)
+}
+
+// VerificationCache returns the verification cache and dataset size of the epoch
+// of the given block, for use with VerifySealWithCache and VerifyShares. Caches
+// memory mapped from disk are copied, so the returned slice remains valid after
+// the engine evicts and unmaps the cache; callers should hold on to it for the
+// whole epoch rather than retrieving it for every verification.
+func (ubqhash *Ubqhash) VerificationCache(number uint64) ([]uint32, uint64) {
+	if ubqhash.shared != nil {
+		return ubqhash.shared.VerificationCache(number)
+	}
+	c := ubqhash.cache(number)
+	defer runtime.KeepAlive(c)
+
+	cache := c.cache
+	if c.mmap != nil {
+		cache = make([]uint32, len(c.cache))
+		copy(cache, c.cache)
+	}
+	return cache, ubqhash.verificationSize(number)
+}
+
+// VerifySealWithCache checks whether a block satisfies the PoW difficulty
+// requirements using the supplied verification cache and dataset size instead
+// of looking them up, allowing share validators to reuse a single cache for
+// many submissions of the same epoch. The cache must belong to the epoch of the
+// header being verified, as returned by VerificationCache.
+func (ubqhash *Ubqhash) VerifySealWithCache(header *types.Header, cache []uint32, size uint64) error {
+	// Ensure that we have a valid difficulty for the block
+	if header.Difficulty == nil || header.Difficulty.Sign() <= 0 {
+		return errInvalidDifficulty
+	}
+	digest, result := hashimotoLight(size, cache, ubqhash.SealHash(header).Bytes(), header.Nonce.Uint64())
+	return verifySealResult(header.MixDigest, ubqhash.sealDifficulty(header.Difficulty), digest, result)
+}
+
+// CheckPoW checks whether the given sealing inputs satisfy the PoW difficulty
+// requirements without needing the header they belong to, for clients that only
+// receive the seal hash, nonce and mix digest. The verification cache of the
+// block's epoch is generated in memory on every call, so checking many seals of
+// the same epoch is better done through VerifySealWithCache. Fake modes accept
+// any seal, while ModeTest uses the tiny test cache and dataset.
+func CheckPoW(sealHash common.Hash, nonce uint64, mixDigest common.Hash, difficulty *big.Int, number uint64, powMode Mode) error {
+	if powMode == ModeFake || powMode == ModeFullFake {
+		return nil
+	}
+	// Ensure that we have a valid difficulty for the block
+	if difficulty == nil || difficulty.Sign() <= 0 {
+		return errInvalidDifficulty
+	}
+	c := &cache{epoch: number / epochLength}
+	c.generate("", 0, false, powMode == ModeTest)
+
+	size := datasetSize(number)
+	if powMode == ModeTest {
+		size = 32 * 1024
+	}
+	digest, result := hashimotoLight(size, c.cache, sealHash.Bytes(), nonce)
+	return verifySealResult(mixDigest, difficulty, digest, result)
+}
+
+// Share is a proof-of-work solution submitted by a pool miner, which usually only
+// meets the pool's share difficulty rather than the difficulty of the block.
+type Share struct {
+	SealHash        common.Hash // Seal hash of the block the share was mined for
+	Nonce           uint64      // Nonce found by the miner
+	MixDigest       common.Hash // Mix digest calculated by the miner
+	Difficulty      *big.Int    // Difficulty of the block the share was mined for
+	ShareDifficulty *big.Int    // Difficulty the pool accepts shares at
+}
+
+// ShareResult is the outcome of verifying a single share.
+type ShareResult struct {
+	Valid bool  // Whether the share meets the share difficulty
+	Block bool  // Whether the share also meets the block difficulty
+	Err   error // Reason the share was rejected, if it was
+}
+
+// VerifyShares checks a batch of shares against the supplied verification cache
+// and dataset size, reusing the single cache for all of them. The cache must
+// belong to the epoch of the blocks the shares were mined for, as returned by
+// VerificationCache. The results are in the order of the shares.
+func VerifyShares(shares []Share, cache []uint32, size uint64) []ShareResult {
+	results := make([]ShareResult, len(shares))
+	for i, share := range shares {
+		// Ensure that we have valid difficulties to check against
+		if share.Difficulty == nil || share.Difficulty.Sign() <= 0 || share.ShareDifficulty == nil || share.ShareDifficulty.Sign() <= 0 {
+			results[i].Err = errInvalidDifficulty
+			continue
+		}
+		digest, result := hashimotoLight(size, cache, share.SealHash.Bytes(), share.Nonce)
+		if err := verifySealResult(share.MixDigest, share.ShareDifficulty, digest, result); err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Valid = true
+		results[i].Block = verifySealResult(share.MixDigest, share.Difficulty, digest, result) == nil
+	}
+	return results
+}
+
+// verifySealResult checks the digest calculated by hashimoto against the one
+// provided in the header and the PoW value against the given difficulty.
+func verifySealResult(mixDigest common.Hash, difficulty *big.Int, digest []byte, result []byte) error {
+	if !bytes.Equal(mixDigest[:], digest) {
 		return errInvalidMixDigest
 	}
-	target := new(big.Int).Div(two256, header.Difficulty)
-	if new(big.Int).SetBytes(result).Cmp(target) > 0 {
+	if new(big.Int).SetBytes(result).Cmp(DifficultyToTarget(difficulty)) > 0 {
 		return errInvalidPoW
 	}
 	return nil
@@ -560,6 +2062,8 @@ func (ubqhash *Ubqhash) verifySeal(chain consensus.ChainHeaderReader, header *ty
 func (ubqhash *Ubqhash) Prepare(chain consensus.ChainHeaderReader, header *types.Header) error {
 	parent := chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
 	if parent == nil {
+		// Drop any stale difficulty so the header can't pass as prepared
+		header.Difficulty = nil
 		return consensus.ErrUnknownAncestor
 	}
 	header.Difficulty = ubqhash.CalcDifficulty(chain, header.Time, parent)
@@ -570,7 +2074,8 @@ func (ubqhash *Ubqhash) Prepare(chain consensus.ChainHeaderReader, header *types
 // setting the final state and assembling the block.
 func (ubqhash *Ubqhash) Finalize(chain consensus.ChainHeaderReader, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header) {
 	// Accumulate any block and uncle rewards and commit the final state root
-	accumulateRewards(chain.Config(), state, header, uncles)
+	ubqhash.notifyRewardChange(chain.Config(), header)
+	accumulateRewards(chain.Config(), state, header, ubqhash.rewardedUncles(chain, header, uncles, true))
 	header.Root = state.IntermediateRoot(chain.Config().IsEIP158(header.Number))
 }
 
@@ -578,24 +2083,150 @@ func (ubqhash *Ubqhash) Finalize(chain consensus.ChainHeaderReader, header *type
 // uncle rewards, setting the final state and assembling the block.
 func (ubqhash *Ubqhash) FinalizeAndAssemble(chain consensus.ChainHeaderReader, header *types.Header, state *state.StateDB, txs []*types.Transaction, uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
 	// Accumulate any block and uncle rewards and commit the final state root
-	accumulateRewards(chain.Config(), state, header, uncles)
+	ubqhash.notifyRewardChange(chain.Config(), header)
+	accumulateRewards(chain.Config(), state, header, ubqhash.rewardedUncles(chain, header, uncles, false))
 	header.Root = state.IntermediateRoot(chain.Config().IsEIP158(header.Number))
 
 	// Header seems complete, assemble into a block and return
 	return types.NewBlock(header, txs, uncles, receipts, new(trie.Trie)), nil
 }
 
+// rewardedUncles returns the uncles of the given block that are paid rewards.
+// That's all of them, apart from uncles with invalid seals included past the
+// lenient uncle seal fork, which are accepted but not rewarded. The decision
+// VerifyUncles recorded for the block is used if there is one, and consumed if
+// requested; otherwise, such as for locally mined blocks or ones below the
+// trusted checkpoint, the uncle seals are verified here.
+func (ubqhash *Ubqhash) rewardedUncles(chain consensus.ChainHeaderReader, header *types.Header, uncles []*types.Header, consume bool) []*types.Header {
+	if len(uncles) == 0 || !ubqhash.chainConfig(chain).IsLenientUncleSeal(header.Number) {
+		return uncles
+	}
+	denied, ok := ubqhash.uncleDecision(header.Hash(), consume)
+
+	rewarded := make([]*types.Header, 0, len(uncles))
+	for _, uncle := range uncles {
+		if ok {
+			if _, skip := denied[uncle.Hash()]; skip {
+				log.Debug("Skipping reward of uncle with invalid seal", "number", header.Number, "uncle", uncle.Hash())
+				continue
+			}
+		} else if err := ubqhash.verifySeal(chain, uncle, false); err != nil {
+			log.Debug("Skipping reward of uncle with invalid seal", "number", header.Number, "uncle", uncle.Hash(), "err", err)
+			continue
+		}
+		rewarded = append(rewarded, uncle)
+	}
+	return rewarded
+}
+
+// uncleRewardDecision is the outcome of verifying the uncle seals of a block
+// included past the lenient uncle seal fork.
+type uncleRewardDecision struct {
+	number uint64                   // Number of the block including the uncles
+	denied map[common.Hash]struct{} // Hashes of the uncles with invalid seals
+}
+
+// recordUncleDecision remembers the uncles of a verified block denied a reward
+// until the block is finalized. Decisions of blocks more than uncleDecisionDepth
+// below it, which were never finalized, are dropped.
+func (ubqhash *Ubqhash) recordUncleDecision(hash common.Hash, number uint64, denied map[common.Hash]struct{}) {
+	ubqhash.uncleLock.Lock()
+	defer ubqhash.uncleLock.Unlock()
+
+	if ubqhash.uncleDecisions == nil {
+		ubqhash.uncleDecisions = make(map[common.Hash]*uncleRewardDecision)
+	}
+	for block, decision := range ubqhash.uncleDecisions {
+		if decision.number+uncleDecisionDepth < number {
+			delete(ubqhash.uncleDecisions, block)
+		}
+	}
+	ubqhash.uncleDecisions[hash] = &uncleRewardDecision{number: number, denied: denied}
+}
+
+// uncleDecision retrieves the uncles denied a reward VerifyUncles recorded for
+// the given block, dropping the decision if consume is set. The second return
+// value is false if no decision was recorded.
+func (ubqhash *Ubqhash) uncleDecision(hash common.Hash, consume bool) (map[common.Hash]struct{}, bool) {
+	ubqhash.uncleLock.Lock()
+	defer ubqhash.uncleLock.Unlock()
+
+	decision, ok := ubqhash.uncleDecisions[hash]
+	if !ok {
+		return nil, false
+	}
+	if consume {
+		delete(ubqhash.uncleDecisions, hash)
+	}
+	return decision.denied, true
+}
+
+// notifyRewardChange invokes the configured reward change hook if the base block
+// reward of the given header differs from that of its parent. As the rewards only
+// depend on the block number, the hook fires once per number, no matter how many
+// times blocks of that number are finalized.
+func (ubqhash *Ubqhash) notifyRewardChange(config *params.ChainConfig, header *types.Header) {
+	notify := ubqhash.config.OnRewardChange
+	if notify == nil || header.Number.Sign() <= 0 {
+		return
+	}
+	_, oldReward := CalcBaseBlockReward(config.Ubqhash, new(big.Int).Sub(header.Number, common.Big1))
+	_, newReward := CalcBaseBlockReward(config.Ubqhash, header.Number)
+	if oldReward.Cmp(newReward) == 0 {
+		return
+	}
+	number := header.Number.Uint64()
+
+	ubqhash.rewardLock.Lock()
+	notified := ubqhash.rewardNotified == number
+	ubqhash.rewardNotified = number
+	ubqhash.rewardLock.Unlock()
+
+	if !notified {
+		notify(new(big.Int).Set(header.Number), oldReward, newReward)
+	}
+}
+
+// launchBonusBase is the launch bonus factor that leaves the block reward as is.
+const launchBonusBase = 10000
+
 // Some weird constants to avoid constant memory allocs for them.
 var (
-	big2  = big.NewInt(2)
-	big32 = big.NewInt(32)
+	big2   = big.NewInt(2)
+	big32  = big.NewInt(32)
+	big100 = big.NewInt(100)
 )
 
 // SealHash returns the hash of a block prior to it being sealed.
-func (ubqhash *Ubqhash) SealHash(header *types.Header) (hash common.Hash) {
-	hasher := sha3.NewLegacyKeccak256()
+func (ubqhash *Ubqhash) SealHash(header *types.Header) common.Hash {
+	return ubqhash.sealHashAt(ubqhash.config.ChainConfig, header)
+}
+
+// sealHashAt derives the seal hash of a header by the rules of the given chain
+// config.
+func (ubqhash *Ubqhash) sealHashAt(config *params.UbqhashConfig, header *types.Header) (hash common.Hash) {
+	hasher := sealHasher(config, header.Number)
+
+	rlp.Encode(hasher, SealHashInputs(header))
+	hasher.Sum(hash[:0])
+	return hash
+}
+
+// chainConfig returns the ubqhash config of the given chain, or the one the engine
+// was configured with if no chain is supplied.
+func (ubqhash *Ubqhash) chainConfig(chain consensus.ChainHeaderReader) *params.UbqhashConfig {
+	if chain != nil {
+		if config := chain.Config(); config != nil && config.Ubqhash != nil {
+			return config.Ubqhash
+		}
+	}
+	return ubqhash.config.ChainConfig
+}
 
-	rlp.Encode(hasher, []interface{}{
+// SealHashInputs returns the header fields, in order, that are RLP encoded and
+// hashed to derive the seal hash of a block.
+func SealHashInputs(header *types.Header) []interface{} {
+	return []interface{}{
 		header.ParentHash,
 		header.UncleHash,
 		header.Coinbase,
@@ -609,15 +2240,52 @@ func (ubqhash *Ubqhash) SealHash(header *types.Header) (hash common.Hash) {
 		header.GasUsed,
 		header.Time,
 		header.Extra,
-	})
-	hasher.Sum(hash[:0])
-	return hash
+	}
+}
+
+// HeaderRLPSize returns the length of the RLP encoding of the full sealed header,
+// nonce and mix digest included, counting the encoded bytes instead of copying
+// them into a freshly allocated slice.
+func HeaderRLPSize(header *types.Header) int {
+	var size byteCounter
+	rlp.Encode(&size, header)
+	return int(size)
+}
+
+// byteCounter is an io.Writer counting the bytes written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
 }
 
+// sealHasher returns a new instance of the hash function used to seal the block
+// with the given number, which is the standard SHA3-256 past the chain's SHA3
+// seal hash fork and the legacy Keccak-256 before.
+func sealHasher(config *params.UbqhashConfig, number *big.Int) hash.Hash {
+	if config != nil && config.IsSHA3SealHash(number) {
+		return sha3.New256()
+	}
+	return sha3.NewLegacyKeccak256()
+}
+
+// emptyPolicyOnce ensures a missing monetary policy is only reported once, instead
+// of for every block processed.
+var emptyPolicyOnce sync.Once
+
 // CalcBaseBlockReward calculates the base block reward as per the ubiq monetary policy.
 func CalcBaseBlockReward(config *params.UbqhashConfig, height *big.Int) (*big.Int, *big.Int) {
 	reward := new(big.Int)
 
+	// A misconfigured chain without any reward steps pays no reward at all
+	if len(config.MonetaryPolicy) == 0 {
+		emptyPolicyOnce.Do(func() {
+			log.Error("Empty monetary policy, paying no block rewards", "number", height)
+		})
+		return new(big.Int), reward
+	}
+
 	for _, step := range config.MonetaryPolicy {
 		if height.Cmp(step.Block) > 0 {
 			reward = new(big.Int).Set(step.Reward)
@@ -629,6 +2297,57 @@ func CalcBaseBlockReward(config *params.UbqhashConfig, height *big.Int) (*big.In
 	return new(big.Int).Set(config.MonetaryPolicy[0].Reward), reward
 }
 
+// CalcLaunchBlockReward applies the launch bonus multiplier of the chain config
+// to the block reward of blocks within the launch bonus window.
+func CalcLaunchBlockReward(config *params.UbqhashConfig, blockHeight *big.Int, blockReward *big.Int) *big.Int {
+	reward := new(big.Int).Set(blockReward)
+	if config == nil || config.LaunchBonusFactor == 0 || config.LaunchBonusFactor == launchBonusBase {
+		return reward
+	}
+	if !config.IsLaunchBonus(blockHeight) {
+		return reward
+	}
+	reward.Mul(reward, new(big.Int).SetUint64(config.LaunchBonusFactor))
+	return reward.Div(reward, new(big.Int).SetUint64(launchBonusBase))
+}
+
+// TotalIssuance returns the sum of the base block rewards, launch bonus included,
+// paid for blocks 1 through upTo. Uncle rewards and inclusion bonuses depend on
+// the uncles actually mined and are left out, as is the genesis allocation.
+func TotalIssuance(config *params.UbqhashConfig, upTo *big.Int) *big.Int {
+	// The reward only changes right after policy steps and the launch bonus window
+	var boundaries []*big.Int
+	if config.LaunchBonusBlock != nil {
+		end := new(big.Int).Add(config.LaunchBonusBlock, new(big.Int).SetUint64(config.LaunchBonusBlocks))
+		boundaries = append(boundaries, config.LaunchBonusBlock, end)
+	}
+	for _, step := range config.MonetaryPolicy {
+		boundaries = append(boundaries, step.Block)
+	}
+	total := new(big.Int)
+	for from := new(big.Int); from.Cmp(upTo) < 0; {
+		next := upTo
+		for _, boundary := range boundaries {
+			if boundary.Cmp(from) > 0 && boundary.Cmp(next) < 0 {
+				next = boundary
+			}
+		}
+		number := new(big.Int).Add(from, common.Big1)
+		_, reward := CalcBaseBlockReward(config, number)
+		reward = CalcLaunchBlockReward(config, number, reward)
+
+		total.Add(total, reward.Mul(reward, new(big.Int).Sub(next, from)))
+		from = next
+	}
+	return total
+}
+
+// CompareIssuance returns the total issuance up to the given block under both the
+// current and a proposed monetary policy, as calculated by TotalIssuance.
+func CompareIssuance(current, proposed *params.UbqhashConfig, upTo *big.Int) (currentTotal, proposedTotal *big.Int) {
+	return TotalIssuance(current, upTo), TotalIssuance(proposed, upTo)
+}
+
 // CalcUncleBlockReward calculates the uncle miner reward based on depth.
 func CalcUncleBlockReward(config *params.ChainConfig, blockHeight *big.Int, uncleHeight *big.Int, blockReward *big.Int) *big.Int {
 	reward := new(big.Int)
@@ -645,28 +2364,240 @@ func CalcUncleBlockReward(config *params.ChainConfig, blockHeight *big.Int, uncl
 	return reward
 }
 
+// UncleReward calculates the reward of an uncle at the given height included in
+// the block at the given height, deriving the base reward it is paid from as the
+// block reward would. The uncle is treated as the first one of the block: since
+// Byzantium, further uncles are paid from a base that also includes the inclusion
+// bonuses of the previous ones.
+func UncleReward(config *params.ChainConfig, blockNumber, uncleNumber *big.Int) *big.Int {
+	initialReward, currentReward := CalcBaseBlockReward(config.Ubqhash, blockNumber)
+
+	// Uncle reward step down fix. (activates along-side byzantium)
+	base := initialReward
+	if config.IsByzantium(blockNumber) {
+		base = currentReward
+	}
+	return CalcUncleBlockReward(config, blockNumber, uncleNumber, base)
+}
+
+// CalcUncleInclusionBonus calculates the bonus paid to the block miner for
+// including an uncle. This is a flat blockReward/32, unless the chain config
+// defines an uncle bonus curve active at the block, in which case it decays with
+// uncle depth.
+func CalcUncleInclusionBonus(config *params.UbqhashConfig, blockHeight *big.Int, uncleHeight *big.Int, blockReward *big.Int) *big.Int {
+	bonus := new(big.Int).Div(blockReward, big32)
+	if config == nil || len(config.UncleBonusCurve) == 0 || !config.IsUncleBonusCurve(blockHeight) {
+		return bonus
+	}
+	depth := new(big.Int).Sub(blockHeight, uncleHeight)
+	if depth.Sign() <= 0 {
+		return bonus
+	}
+	percent := config.UncleBonusCurve[len(config.UncleBonusCurve)-1]
+	if depth.IsUint64() && depth.Uint64() <= uint64(len(config.UncleBonusCurve)) {
+		percent = config.UncleBonusCurve[depth.Uint64()-1]
+	}
+	bonus.Mul(bonus, new(big.Int).SetUint64(percent))
+	return bonus.Div(bonus, big100)
+}
+
+// scaleUncleBonusByGas scales the inclusion bonus of the given uncle by the share
+// of its gas limit it used, if the chain config asks for it at the including block.
+// Uncles without a gas limit pay no bonus in that case.
+func scaleUncleBonusByGas(config *params.UbqhashConfig, blockHeight *big.Int, bonus *big.Int, uncle *types.Header) *big.Int {
+	if config == nil || !config.IsUncleBonusByGasUsed(blockHeight) {
+		return bonus
+	}
+	if uncle.GasLimit == 0 {
+		return new(big.Int)
+	}
+	scaled := new(big.Int).Mul(bonus, new(big.Int).SetUint64(uncle.GasUsed))
+	return scaled.Div(scaled, new(big.Int).SetUint64(uncle.GasLimit))
+}
+
+// VerifyRewards independently recomputes the balance changes the block rewards
+// of the given header and uncles should cause, and compares them against the ones
+// accumulateRewards applies to a copy of the given state. It is meant for offline
+// auditing and leaves the given state untouched.
+func VerifyRewards(config *params.ChainConfig, state *state.StateDB, header *types.Header, uncles []*types.Header) error {
+	expected := make(map[common.Address]*big.Int)
+	credit := func(addr common.Address, amount *big.Int) {
+		if expected[addr] == nil {
+			expected[addr] = new(big.Int)
+		}
+		expected[addr].Add(expected[addr], amount)
+	}
+	// Recompute the rewards of the miner and uncle coinbases
+	initialReward, blockReward := CalcBaseBlockReward(config.Ubqhash, header.Number)
+
+	uncleBase := new(big.Int).Set(initialReward)
+	if config.IsByzantium(header.Number) {
+		uncleBase.Set(blockReward)
+	}
+	minerReward := CalcLaunchBlockReward(config.Ubqhash, header.Number, blockReward)
+	for _, uncle := range uncles {
+		credit(rewardAddress(config.Ubqhash, header.Number, uncle), CalcUncleBlockReward(config, header.Number, uncle.Number, uncleBase))
+
+		bonus := scaleUncleBonusByGas(config.Ubqhash, header.Number, CalcUncleInclusionBonus(config.Ubqhash, header.Number, uncle.Number, uncleBase), uncle)
+		minerReward.Add(minerReward, bonus)
+
+		// Since Byzantium, uncle rewards derive from the miner reward accumulated
+		// so far, inclusion bonuses of previous uncles included
+		if config.IsByzantium(header.Number) {
+			uncleBase.Add(uncleBase, bonus)
+		}
+	}
+	// Chains with reward recipients pay them the base reward instead of the miner
+	if shares := splitBaseReward(config.Ubqhash, header.Number, blockReward); shares != nil {
+		for i, share := range shares {
+			credit(config.Ubqhash.RewardRecipients[i].Address, share)
+		}
+		minerReward.Sub(minerReward, blockReward)
+	}
+	credit(rewardAddress(config.Ubqhash, header.Number, header), minerReward)
+
+	// Apply the rewards to a copy of the state and compare the balance changes
+	rewarded := state.Copy()
+	accumulateRewards(config, rewarded, header, uncles)
+
+	for addr, want := range expected {
+		if have := new(big.Int).Sub(rewarded.GetBalance(addr), state.GetBalance(addr)); have.Cmp(want) != 0 {
+			return fmt.Errorf("invalid reward for %x: have %v, want %v", addr, have, want)
+		}
+	}
+	return nil
+}
+
+// NetMinerReward returns the final amount the coinbase of the given header is
+// credited with for mining it, with the launch bonus and the uncle inclusion
+// bonuses applied, and the base reward of chains paying it to dedicated reward
+// recipients removed. Rewards paid to uncle coinbases and reward recipients are
+// not included, even if they coincide with the miner's.
+func NetMinerReward(config *params.ChainConfig, header *types.Header, uncles []*types.Header) *big.Int {
+	return calcRewards(config, header, uncles).miner
+}
+
+// TotalBlockIssuance returns the total amount minted by the given block, which is
+// everything accumulateRewards credits: the miner reward with its launch and uncle
+// inclusion bonuses, the base reward shares of the reward recipients and the
+// rewards of the uncle coinbases.
+func TotalBlockIssuance(config *params.ChainConfig, header *types.Header, uncles []*types.Header) *big.Int {
+	rewards := calcRewards(config, header, uncles)
+
+	total := new(big.Int).Set(rewards.miner)
+	for _, share := range rewards.recipients {
+		total.Add(total, share)
+	}
+	for _, reward := range rewards.uncles {
+		total.Add(total, reward)
+	}
+	return total
+}
+
 // AccumulateRewards credits the coinbase of the given block with the mining
 // reward. The total reward consists of the static block reward and rewards for
 // included uncles. The coinbase of each uncle block is also rewarded.
 func accumulateRewards(config *params.ChainConfig, state *state.StateDB, header *types.Header, uncles []*types.Header) {
+	rewards := calcRewards(config, header, uncles)
+
+	// update uncle miner balances
+	for i, uncle := range uncles {
+		state.AddBalance(rewardAddress(config.Ubqhash, header.Number, uncle), rewards.uncles[i])
+	}
+	// update reward recipient balances
+	for i, share := range rewards.recipients {
+		state.AddBalance(config.Ubqhash.RewardRecipients[i].Address, share)
+	}
+	// update block miner balance
+	state.AddBalance(rewardAddress(config.Ubqhash, header.Number, header), rewards.miner)
+}
+
+// rewardAddress returns the address the rewards of the given block or uncle are
+// paid to by the block with the given number, which is the address embedded in
+// its extra-data past the extra-data reward address fork if the extra-data is
+// well formed, or its coinbase otherwise.
+func rewardAddress(config *params.UbqhashConfig, number *big.Int, header *types.Header) common.Address {
+	if config == nil || !config.IsExtraDataRewardAddress(number) || len(header.Extra) != common.AddressLength {
+		return header.Coinbase
+	}
+	addr := common.BytesToAddress(header.Extra)
+	if addr == (common.Address{}) {
+		return header.Coinbase
+	}
+	return addr
+}
+
+// blockRewards is the breakdown of the rewards paid for a block.
+type blockRewards struct {
+	miner      *big.Int   // Reward of the block's coinbase
+	recipients []*big.Int // Base reward shares of the configured reward recipients, if any
+	uncles     []*big.Int // Rewards of the coinbases of the uncles, in order
+}
+
+// calcRewards calculates the rewards paid for the block with the given header
+// and uncles.
+func calcRewards(config *params.ChainConfig, header *types.Header, uncles []*types.Header) blockRewards {
 	// block reward (miner)
 	initialReward, currentReward := CalcBaseBlockReward(config.Ubqhash, header.Number)
 
+	// base reward shares of the reward recipients, if configured
+	recipients := splitBaseReward(config.Ubqhash, header.Number, currentReward)
+
 	// Uncle reward step down fix. (activates along-side byzantium)
 	ufixReward := initialReward
 	if config.IsByzantium(header.Number) {
 		ufixReward = currentReward
 	}
+	// launch bonus (miner only, uncle rewards follow the monetary policy)
+	launchBonus := CalcLaunchBlockReward(config.Ubqhash, header.Number, currentReward)
+	launchBonus.Sub(launchBonus, currentReward)
 
-	for _, uncle := range uncles {
+	// the base reward is taken out again at the end if paid to the recipients
+	baseReward := new(big.Int).Set(currentReward)
+
+	uncleRewards := make([]*big.Int, len(uncles))
+	for i, uncle := range uncles {
 		// uncle block miner reward (depth === 1 ? baseBlockReward * 0.5 : 0)
-		uncleReward := CalcUncleBlockReward(config, header.Number, uncle.Number, ufixReward)
-		// update uncle miner balance
-		state.AddBalance(uncle.Coinbase, uncleReward)
-		// include uncle bonus reward (baseBlockReward/32)
-		uncleReward.Div(ufixReward, big32)
-		currentReward.Add(currentReward, uncleReward)
+		uncleRewards[i] = CalcUncleBlockReward(config, header.Number, uncle.Number, ufixReward)
+		// include uncle bonus reward (baseBlockReward/32, optionally decaying with depth)
+		bonus := CalcUncleInclusionBonus(config.Ubqhash, header.Number, uncle.Number, ufixReward)
+		currentReward.Add(currentReward, scaleUncleBonusByGas(config.Ubqhash, header.Number, bonus, uncle))
 	}
-	// update block miner balance
-	state.AddBalance(header.Coinbase, currentReward)
+	currentReward.Add(currentReward, launchBonus)
+
+	if recipients != nil {
+		currentReward.Sub(currentReward, baseReward)
+	}
+	return blockRewards{miner: currentReward, recipients: recipients, uncles: uncleRewards}
+}
+
+// splitBaseReward divides the base block reward among the configured reward
+// recipients proportionally to their weights, the last recipient receiving the
+// remainder left by rounding. It returns nil if the weights sum to zero or the
+// recipients aren't active at the block yet, in which case the coinbase is paid
+// the base reward.
+func splitBaseReward(config *params.UbqhashConfig, blockHeight *big.Int, reward *big.Int) []*big.Int {
+	if config == nil || !config.IsRewardRecipients(blockHeight) {
+		return nil
+	}
+	total := new(big.Int)
+	for _, recipient := range config.RewardRecipients {
+		total.Add(total, new(big.Int).SetUint64(recipient.Weight))
+	}
+	if total.Sign() == 0 {
+		return nil
+	}
+	var (
+		shares = make([]*big.Int, len(config.RewardRecipients))
+		paid   = new(big.Int)
+	)
+	for i, recipient := range config.RewardRecipients {
+		shares[i] = new(big.Int).Mul(reward, new(big.Int).SetUint64(recipient.Weight))
+		shares[i].Div(shares[i], total)
+		paid.Add(paid, shares[i])
+	}
+	last := shares[len(shares)-1]
+	last.Add(last, new(big.Int).Sub(reward, paid))
+
+	return shares
 }
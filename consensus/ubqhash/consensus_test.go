@@ -17,20 +17,186 @@
 package ubqhash
 
 import (
-	// "encoding/json"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
 	"math/big"
-	// "os"
-	// "path/filepath"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ubiq/go-ubiq/v5/common"
+	"github.com/ubiq/go-ubiq/v5/common/hexutil"
+	"github.com/ubiq/go-ubiq/v5/consensus"
+	"github.com/ubiq/go-ubiq/v5/core/rawdb"
+	"github.com/ubiq/go-ubiq/v5/core/state"
 	// "github.com/ubiq/go-ubiq/v5/common/math"
 	// "github.com/ubiq/go-ubiq/v5/core"
-	// "github.com/ubiq/go-ubiq/v5/core/types"
+	"github.com/ubiq/go-ubiq/v5/core/types"
 	// "github.com/ubiq/go-ubiq/v5/core/vm"
 	// "github.com/ubiq/go-ubiq/v5/ethdb"
+	"github.com/ubiq/go-ubiq/v5/metrics"
 	"github.com/ubiq/go-ubiq/v5/params"
+	"github.com/ubiq/go-ubiq/v5/rlp"
+	"golang.org/x/crypto/sha3"
 )
 
+// testMedianTimeBlocks mirrors the median window used by core.HeaderChain.
+const testMedianTimeBlocks = 11
+
+// testChainReader implements consensus.ChainHeaderReader on top of an in-memory
+// set of canonical headers, calculating median times the same way the real
+// header chain does.
+type testChainReader struct {
+	config  *params.ChainConfig
+	headers map[uint64]*types.Header
+	hashes  map[common.Hash]*types.Header
+	blocks  map[common.Hash]*types.Block
+}
+
+// testUbqhashConfig returns a copy of the given chain config with a deep copy of
+// its ubqhash section, adjusted by edit if set. Tests may modify the result freely
+// without affecting the shared configs.
+func testUbqhashConfig(base *params.ChainConfig, edit func(*params.UbqhashConfig)) *params.ChainConfig {
+	config := *base
+	config.Ubqhash = base.Ubqhash.Copy()
+	if edit != nil {
+		edit(config.Ubqhash)
+	}
+	return &config
+}
+
+func newTestChainReader(config *params.ChainConfig, headers []*types.Header) *testChainReader {
+	chain := &testChainReader{
+		config:  config,
+		headers: make(map[uint64]*types.Header),
+		hashes:  make(map[common.Hash]*types.Header),
+		blocks:  make(map[common.Hash]*types.Block),
+	}
+	for _, header := range headers {
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+	}
+	return chain
+}
+
+// newTestBlockChainReader creates a test chain reader that also serves the
+// bodies of the given canonical blocks.
+func newTestBlockChainReader(config *params.ChainConfig, blocks []*types.Block) *testChainReader {
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	chain := newTestChainReader(config, headers)
+	for _, block := range blocks {
+		chain.blocks[block.Hash()] = block
+	}
+	return chain
+}
+
+func (r *testChainReader) Config() *params.ChainConfig  { return r.config }
+func (r *testChainReader) CurrentHeader() *types.Header { return nil }
+
+func (r *testChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := r.hashes[hash]; header != nil && header.Number.Uint64() == number {
+		return header
+	}
+	return nil
+}
+
+func (r *testChainReader) GetHeaderByNumber(number uint64) *types.Header {
+	return r.headers[number]
+}
+
+func (r *testChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	return r.hashes[hash]
+}
+
+func (r *testChainReader) GetBlock(hash common.Hash, number uint64) *types.Block {
+	if block := r.blocks[hash]; block != nil && block.NumberU64() == number {
+		return block
+	}
+	return nil
+}
+
+func (r *testChainReader) CalcPastMedianTime(number uint64, parent *types.Header) *big.Int {
+	return consensus.PastMedianTime(number, parent, testMedianTimeBlocks, r.GetHeaderByNumber)
+}
+
+// difficultyVector is a single recorded mainnet header used to replay the
+// difficulty algorithms.
+type difficultyVector struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Timestamp  hexutil.Uint64 `json:"timestamp"`
+	Difficulty *hexutil.Big   `json:"difficulty"`
+}
+
+// loadDifficultyVectors reads a list of consecutive recorded headers from the
+// given JSON file.
+func loadDifficultyVectors(path string) ([]*types.Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var vectors []difficultyVector
+	if err := json.NewDecoder(file).Decode(&vectors); err != nil {
+		return nil, err
+	}
+	headers := make([]*types.Header, len(vectors))
+	for i, vector := range vectors {
+		headers[i] = &types.Header{
+			Number:     new(big.Int).SetUint64(uint64(vector.Number)),
+			Time:       uint64(vector.Timestamp),
+			Difficulty: (*big.Int)(vector.Difficulty),
+		}
+	}
+	return headers, nil
+}
+
+// Tests that replaying CalcDifficulty over recorded headers spanning the mainnet
+// DigishieldMod to Flux transition at block 8000 reproduces every recorded
+// difficulty.
+//
+// The fixture holds blocks 7500 to 8500 (number, timestamp, difficulty) of a chain
+// generated under the mainnet chain config with irregular block times, including
+// slow outliers and a fast run across the fork. A slice exported from a synced
+// mainnet node via eth_getBlockByNumber can be dropped in in its place.
+func TestDifficultyMainnetReplay(t *testing.T) {
+	headers, err := loadDifficultyVectors(filepath.Join("testdata", "difficulty_transition.json"))
+	if err != nil {
+		t.Fatalf("failed to load difficulty fixture: %v", err)
+	}
+	for i := 1; i < len(headers); i++ {
+		if headers[i].Number.Uint64() != headers[i-1].Number.Uint64()+1 {
+			t.Fatalf("fixture not consecutive at index %d: %v after %v", i, headers[i].Number, headers[i-1].Number)
+		}
+	}
+	chain := newTestChainReader(params.MainnetChainConfig, headers)
+
+	// Skip the leading headers whose median time window reaches before the fixture
+	start := int(fluxConfig.AveragingWindow.Int64()) + testMedianTimeBlocks
+	if len(headers) <= start {
+		t.Fatalf("fixture too short: have %d headers, need more than %d", len(headers), start)
+	}
+	for i := start; i < len(headers); i++ {
+		parent, header := headers[i-1], headers[i]
+		if diff := CalcDifficulty(chain, header.Time, parent); diff.Cmp(header.Difficulty) != 0 {
+			t.Errorf("block %d: difficulty mismatch: have %v, want %v", header.Number, diff, header.Difficulty)
+		}
+	}
+}
+
 // TODO: write new difficulty tests
 /*
 type diffTest struct {
@@ -220,3 +386,3488 @@ func TestCalcUncleBlockReward(t *testing.T) {
 	}
 
 }
+
+func TestCalcUncleInclusionBonus(t *testing.T) {
+	reward := big.NewInt(8e+18)
+
+	// flat bonus (default)
+	config := params.MainnetChainConfig.Ubqhash.Copy()
+	for depth := int64(1); depth <= 6; depth++ {
+		u := CalcUncleInclusionBonus(config, big.NewInt(10), big.NewInt(10-depth), reward)
+		if u.Cmp(big.NewInt(25e+16)) != 0 {
+			t.Error("TestCalcUncleInclusionBonus flat depth", depth, "failed. Expected", big.NewInt(25e+16), "and calculated", u)
+		}
+	}
+	// decaying bonus, not yet active
+	config.UncleBonusCurve, config.UncleBonusCurveBlock = []uint64{100, 50, 25}, big.NewInt(11)
+	if u := CalcUncleInclusionBonus(config, big.NewInt(10), big.NewInt(8), reward); u.Cmp(big.NewInt(25e+16)) != 0 {
+		t.Error("TestCalcUncleInclusionBonus before fork", "failed. Expected", big.NewInt(25e+16), "and calculated", u)
+	}
+	// decaying bonus
+	config.UncleBonusCurveBlock = big.NewInt(10)
+
+	// depth 1
+	u := CalcUncleInclusionBonus(config, big.NewInt(10), big.NewInt(9), reward)
+	if u.Cmp(big.NewInt(25e+16)) != 0 {
+		t.Error("TestCalcUncleInclusionBonus depth 1", "failed. Expected", big.NewInt(25e+16), "and calculated", u)
+	}
+	// depth 2
+	u = CalcUncleInclusionBonus(config, big.NewInt(10), big.NewInt(8), reward)
+	if u.Cmp(big.NewInt(125e+15)) != 0 {
+		t.Error("TestCalcUncleInclusionBonus depth 2", "failed. Expected", big.NewInt(125e+15), "and calculated", u)
+	}
+	// depth 5 (past the end of the curve)
+	u = CalcUncleInclusionBonus(config, big.NewInt(10), big.NewInt(5), reward)
+	if u.Cmp(big.NewInt(625e+14)) != 0 {
+		t.Error("TestCalcUncleInclusionBonus depth 5", "failed. Expected", big.NewInt(625e+14), "and calculated", u)
+	}
+}
+
+func TestCalcLaunchBlockReward(t *testing.T) {
+	reward := big.NewInt(4e+18)
+
+	// default (no bonus)
+	config := params.MainnetChainConfig.Ubqhash.Copy()
+	config.LaunchBonusBlocks, config.LaunchBonusBlock = 100, big.NewInt(0)
+	u := CalcLaunchBlockReward(config, big.NewInt(1), reward)
+	if u.Cmp(reward) != 0 {
+		t.Error("TestCalcLaunchBlockReward default", "failed. Expected", reward, "and calculated", u)
+	}
+	// 1.5x bonus
+	config.LaunchBonusFactor = 15000
+
+	// inside the bonus window
+	u = CalcLaunchBlockReward(config, big.NewInt(1), reward)
+	if u.Cmp(big.NewInt(6e+18)) != 0 {
+		t.Error("TestCalcLaunchBlockReward 1", "failed. Expected", big.NewInt(6e+18), "and calculated", u)
+	}
+	u = CalcLaunchBlockReward(config, big.NewInt(100), reward)
+	if u.Cmp(big.NewInt(6e+18)) != 0 {
+		t.Error("TestCalcLaunchBlockReward 100", "failed. Expected", big.NewInt(6e+18), "and calculated", u)
+	}
+	// outside the bonus window
+	u = CalcLaunchBlockReward(config, big.NewInt(101), reward)
+	if u.Cmp(reward) != 0 {
+		t.Error("TestCalcLaunchBlockReward 101", "failed. Expected", reward, "and calculated", u)
+	}
+	if reward.Cmp(big.NewInt(4e+18)) != 0 {
+		t.Error("TestCalcLaunchBlockReward", "modified the input reward", reward)
+	}
+	// without the fork block (no bonus)
+	config.LaunchBonusBlock = nil
+	u = CalcLaunchBlockReward(config, big.NewInt(1), reward)
+	if u.Cmp(reward) != 0 {
+		t.Error("TestCalcLaunchBlockReward unscheduled", "failed. Expected", reward, "and calculated", u)
+	}
+	// window following a later fork block
+	config.LaunchBonusBlock = big.NewInt(1000)
+	u = CalcLaunchBlockReward(config, big.NewInt(1000), reward)
+	if u.Cmp(reward) != 0 {
+		t.Error("TestCalcLaunchBlockReward 1000", "failed. Expected", reward, "and calculated", u)
+	}
+	u = CalcLaunchBlockReward(config, big.NewInt(1100), reward)
+	if u.Cmp(big.NewInt(6e+18)) != 0 {
+		t.Error("TestCalcLaunchBlockReward 1100", "failed. Expected", big.NewInt(6e+18), "and calculated", u)
+	}
+	u = CalcLaunchBlockReward(config, big.NewInt(1101), reward)
+	if u.Cmp(reward) != 0 {
+		t.Error("TestCalcLaunchBlockReward 1101", "failed. Expected", reward, "and calculated", u)
+	}
+}
+
+// Tests that headers slightly beyond the allowed future block time are reported
+// as retryable, while headers further ahead are rejected outright.
+func TestFutureBlockRetryable(t *testing.T) {
+	ubqhash := NewFaker()
+	ubqhash.config.FutureBlockRetryTime = time.Minute
+
+	now := uint64(time.Now().Unix())
+	parent := &types.Header{Number: big.NewInt(1), Time: now, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	tests := []struct {
+		time uint64
+		err  error
+	}{
+		{now + 30, consensus.ErrFutureBlockRetryable},
+		{now + 600, consensus.ErrFutureBlock},
+	}
+	for i, tt := range tests {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: tt.time}
+		if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	// Without a retry window every future block is rejected outright
+	ubqhash.config.FutureBlockRetryTime = 0
+
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: now + 30}
+	if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != consensus.ErrFutureBlock {
+		t.Errorf("error mismatch without retry window: have %v, want %v", err, consensus.ErrFutureBlock)
+	}
+}
+
+// Tests that headers with a missing or negative block number are rejected with
+// an error instead of crashing the verifier.
+func TestVerifyHeaderInvalidNumber(t *testing.T) {
+	ubqhash := NewFaker()
+
+	parent := &types.Header{Number: big.NewInt(1), Time: 1000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	for i, number := range []*big.Int{nil, big.NewInt(-1)} {
+		header := &types.Header{ParentHash: parent.Hash(), Number: number, Time: 1010}
+
+		if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != errInvalidNumber {
+			t.Errorf("test %d: verifyHeader error mismatch: have %v, want %v", i, err, errInvalidNumber)
+		}
+		if err := ubqhash.VerifyHeader(chain, header, false); err != errInvalidNumber {
+			t.Errorf("test %d: VerifyHeader error mismatch: have %v, want %v", i, err, errInvalidNumber)
+		}
+		_, results := ubqhash.VerifyHeaders(chain, []*types.Header{header}, []bool{false})
+		if err := <-results; err != errInvalidNumber {
+			t.Errorf("test %d: VerifyHeaders error mismatch: have %v, want %v", i, err, errInvalidNumber)
+		}
+	}
+}
+
+// Tests that the blocks including uncles are reported along with the hashes of
+// the uncles they included.
+func TestUncleInclusionMap(t *testing.T) {
+	var (
+		blocks []*types.Block
+		uncles = make(map[uint64][]*types.Header)
+	)
+	// Include a single uncle in block 3 and two in block 5
+	uncles[3] = []*types.Header{{Number: big.NewInt(2), Extra: []byte("uncle-a")}}
+	uncles[5] = []*types.Header{{Number: big.NewInt(4), Extra: []byte("uncle-b")}, {Number: big.NewInt(3), Extra: []byte("uncle-c")}}
+
+	parent := common.Hash{}
+	for i := uint64(0); i <= 6; i++ {
+		header := &types.Header{ParentHash: parent, Number: new(big.Int).SetUint64(i), Time: 88 * i}
+		block := types.NewBlockWithHeader(header).WithBody(nil, uncles[i])
+		blocks = append(blocks, block)
+		parent = block.Hash()
+	}
+	chain := newTestBlockChainReader(params.TestChainConfig, blocks)
+
+	tests := []struct {
+		from, to uint64
+		included []uint64
+	}{
+		{0, 6, []uint64{3, 5}},
+		{3, 3, []uint64{3}},
+		{4, 10, []uint64{5}},
+		{0, 2, nil},
+		{6, 0, nil},
+	}
+	for i, tt := range tests {
+		inclusions := UncleInclusionMap(chain, tt.from, tt.to)
+		if len(inclusions) != len(tt.included) {
+			t.Errorf("test %d: inclusion count mismatch: have %d, want %d", i, len(inclusions), len(tt.included))
+			continue
+		}
+		for _, number := range tt.included {
+			have := inclusions[number]
+			if len(have) != len(uncles[number]) {
+				t.Errorf("test %d, block %d: uncle count mismatch: have %d, want %d", i, number, len(have), len(uncles[number]))
+				continue
+			}
+			for j, uncle := range uncles[number] {
+				if have[j] != uncle.Hash() {
+					t.Errorf("test %d, block %d: uncle %d hash mismatch: have %x, want %x", i, number, j, have[j], uncle.Hash())
+				}
+			}
+		}
+	}
+}
+
+// Tests that uncles rejected for being included twice are counted under the
+// duplicate reason.
+func TestUncleRejectionMetrics(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	// The package counters are created at init, before metrics could be enabled
+	defer func(counter metrics.Counter) { uncleDuplicateCounter = counter }(uncleDuplicateCounter)
+	uncleDuplicateCounter = metrics.NewCounter()
+
+	// Build a short chain with an uncle included in block 3, then try to include
+	// the same uncle again in block 5
+	uncle := &types.Header{Number: big.NewInt(2), Extra: []byte("uncle")}
+
+	var blocks []*types.Block
+	parent := common.Hash{}
+	for i := uint64(0); i <= 4; i++ {
+		header := &types.Header{ParentHash: parent, Number: new(big.Int).SetUint64(i), Time: 88 * i}
+		block := types.NewBlockWithHeader(header)
+		if i == 3 {
+			block = block.WithBody(nil, []*types.Header{uncle})
+		}
+		blocks = append(blocks, block)
+		parent = block.Hash()
+	}
+	chain := newTestBlockChainReader(params.TestChainConfig, blocks)
+
+	header := &types.Header{ParentHash: parent, Number: big.NewInt(5), Time: 88 * 5}
+	block := types.NewBlockWithHeader(header).WithBody(nil, []*types.Header{uncle})
+
+	ubqhash := NewFaker()
+	if err := ubqhash.VerifyUncles(chain, block); err != errDuplicateUncle {
+		t.Fatalf("error mismatch: have %v, want %v", err, errDuplicateUncle)
+	}
+	if count := uncleDuplicateCounter.Count(); count != 1 {
+		t.Errorf("rejection count mismatch: have %d, want %d", count, 1)
+	}
+}
+
+// Tests that rejecting a header for a wrong difficulty records how far off it was
+// from the expected one.
+func TestDifficultyMismatchMetrics(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	name := "ubqhash/difficulty/mismatch"
+	metrics.DefaultRegistry.Unregister(name)
+
+	parent := &types.Header{Number: big.NewInt(1), Time: 1000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	// Flux keeps the parent's difficulty until a full averaging window exists, so
+	// claim 50% more than that
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: 1088, Difficulty: big.NewInt(196608), GasLimit: params.GenesisGasLimit}
+	if err := NewFaker().VerifyHeader(chain, header, false); err == nil || !strings.Contains(err.Error(), "invalid difficulty") {
+		t.Fatalf("error mismatch: have %v, want invalid difficulty", err)
+	}
+	histogram, ok := metrics.DefaultRegistry.Get(name).(metrics.Histogram)
+	if !ok {
+		t.Fatalf("histogram %s not registered", name)
+	}
+	if count := histogram.Count(); count != 1 {
+		t.Errorf("sample count mismatch: have %d, want %d", count, 1)
+	}
+	if max := histogram.Max(); max != 500000 {
+		t.Errorf("mismatch ratio mismatch: have %d ppm, want %d ppm", max, 500000)
+	}
+}
+
+// Tests that for random block times, no difficulty algorithm ever changes the
+// difficulty by more than its adjustment limits allow in a single retarget. The
+// limits bound the actual timespan to Factor-MaxAdjustUp and Factor+MaxAdjustDown
+// per Factor of the window timespan, so the difficulty may rise by no more than
+// window/minimum and drop by no more than window/maximum.
+//
+// Note, the timespan bounds are truncated to whole seconds, which lets the rise
+// overshoot Factor/(Factor-MaxAdjustUp) slightly (e.g. 8.706% instead of 8.696%
+// for DigishieldV3). This is consensus behaviour, so the limits are checked
+// against the truncated bounds.
+func TestDifficultyAdjustmentLimits(t *testing.T) {
+	tests := []struct {
+		algo   DifficultyAlgorithm
+		config *diffConfig
+	}{
+		{DigishieldV3, digishieldV3Config},
+		{DigishieldV3Mod, digishieldV3ModConfig},
+		{Flux, fluxConfig},
+	}
+	for _, tt := range tests {
+		var (
+			window  = new(big.Int).Mul(tt.config.AveragingWindow, big88)
+			minimum = new(big.Int).Sub(tt.config.Factor, tt.config.MaxAdjustUp)
+			maximum = new(big.Int).Add(tt.config.Factor, tt.config.MaxAdjustDown)
+		)
+		minimum.Div(minimum.Mul(minimum, window), tt.config.Factor)
+		maximum.Div(maximum.Mul(maximum, window), tt.config.Factor)
+
+		rnd := rand.New(rand.NewSource(int64(tt.algo)))
+
+		parent := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000000)}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+		for i := 1; i <= 500; i++ {
+			// Pick block times between 1 second and four times the target
+			time := parent.Time + 1 + uint64(rnd.Intn(4*88))
+			diff := tt.algo.calcDifficulty(chain, time, parent, &ConsensusRules{TargetBlockTime: big88})
+
+			// diff <= parent * window / minimum
+			limit := new(big.Int).Mul(parent.Difficulty, window)
+			if new(big.Int).Mul(diff, minimum).Cmp(limit) > 0 {
+				t.Fatalf("algorithm %d, block %d: difficulty rose beyond limit: parent %v, have %v", tt.algo, i, parent.Difficulty, diff)
+			}
+			// diff >= parent * window / maximum, allowing for rounding
+			if new(big.Int).Mul(new(big.Int).Add(diff, common.Big1), maximum).Cmp(limit) <= 0 {
+				t.Fatalf("algorithm %d, block %d: difficulty dropped beyond limit: parent %v, have %v", tt.algo, i, parent.Difficulty, diff)
+			}
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: time, Difficulty: diff}
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+	}
+}
+
+// Tests that overriding a block's timestamp only affects the difficulty through
+// the past median times, leaving the chain itself untouched.
+func TestCalcDifficultyWithOverride(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 120; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	time := parent.Time + 88
+	base := CalcDifficulty(chain, time, parent)
+
+	// Overriding with the recorded timestamps must not change anything
+	number := parent.Number.Uint64() - medianTimeBlocks/2
+	recorded := chain.headers[number].Time
+
+	if diff := CalcDifficultyWithOverride(chain, time, parent, nil); diff.Cmp(base) != 0 {
+		t.Errorf("difficulty mismatch without overrides: have %v, want %v", diff, base)
+	}
+	if diff := CalcDifficultyWithOverride(chain, time, parent, map[uint64]uint64{number: recorded}); diff.Cmp(base) != 0 {
+		t.Errorf("difficulty mismatch with identical override: have %v, want %v", diff, base)
+	}
+	// Delaying the median block of the last window lengthens the actual timespan,
+	// which should lower the difficulty
+	diff := CalcDifficultyWithOverride(chain, time, parent, map[uint64]uint64{number: recorded + 30})
+	if diff.Cmp(base) >= 0 {
+		t.Errorf("difficulty not lowered by delayed block: have %v, base %v", diff, base)
+	}
+	if chain.headers[number].Time != recorded {
+		t.Errorf("chain modified by override: have %d, want %d", chain.headers[number].Time, recorded)
+	}
+	// Overriding a block outside of both median windows must not change anything
+	if diff := CalcDifficultyWithOverride(chain, time, parent, map[uint64]uint64{1: genesis.Time + 1}); diff.Cmp(base) != 0 {
+		t.Errorf("difficulty mismatch with unused override: have %v, want %v", diff, base)
+	}
+}
+
+// Tests that the difficulty on top of a side chain block, such as an uncle being
+// promoted during a reorg, is calculated over the median times of its own
+// ancestry rather than the canonical chain's.
+func TestCalcDifficultySideChainParent(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	// Build the canonical chain on target and a faster side chain forking off it
+	parent := genesis
+	for i := 1; i <= 120; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	side := newTestChainReader(params.TestChainConfig, nil)
+	for number, header := range chain.headers {
+		if number <= 100 {
+			side.headers[number], side.hashes[header.Hash()] = header, header
+		}
+	}
+	parent = chain.headers[100]
+	for i := 101; i <= 115; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 30, Extra: []byte("side")}
+		header.Difficulty = CalcDifficulty(side, header.Time, parent)
+
+		side.headers[header.Number.Uint64()] = header
+		side.hashes[header.Hash()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	// The canonical chain only knows the side chain blocks by hash, but must come
+	// to the same difficulty as if they were canonical
+	time := parent.Time + 30
+	if have, want := CalcDifficulty(chain, time, parent), CalcDifficulty(side, time, parent); have.Cmp(want) != 0 {
+		t.Errorf("difficulty mismatch: have %v, want %v", have, want)
+	}
+	haveFirst, haveLast := DifficultyMedianTimes(chain, parent)
+	wantFirst, wantLast := DifficultyMedianTimes(side, parent)
+	if haveFirst.Cmp(wantFirst) != 0 || haveLast.Cmp(wantLast) != 0 {
+		t.Errorf("median times mismatch: have %v-%v, want %v-%v", haveFirst, haveLast, wantFirst, wantLast)
+	}
+	// Before the ancestry median time fork, the canonical timestamps are mixed in
+	legacy := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.AncestryMedianTimeBlock = nil
+	})
+	chain.config = legacy
+
+	if have, want := CalcDifficulty(chain, time, parent), CalcDifficulty(side, time, parent); have.Cmp(want) == 0 {
+		t.Errorf("difficulty calculated over the side chain before the fork: %v", have)
+	}
+}
+
+// Tests that the per-block difficulty increase cap leaves increases within the
+// limit untouched, but clamps the ones exceeding it.
+func TestMaxPerBlockDifficultyIncrease(t *testing.T) {
+	config := testUbqhashConfig(params.TestChainConfig, nil)
+
+	// Assemble a chain of fast blocks, so the difficulty keeps rising
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(config, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 120; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 30}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	time := parent.Time + 30
+	uncapped := CalcDifficulty(chain, time, parent)
+	if uncapped.Cmp(parent.Difficulty) <= 0 {
+		t.Fatalf("difficulty not rising: parent %v, have %v", parent.Difficulty, uncapped)
+	}
+	// A generous cap must not affect the increase
+	generous := uint64(10000)
+	config.Ubqhash.MaxPerBlockDifficultyIncrease = &generous
+	config.Ubqhash.MaxPerBlockDifficultyIncreaseBlock = big.NewInt(0)
+	if diff := CalcDifficulty(chain, time, parent); diff.Cmp(uncapped) != 0 {
+		t.Errorf("increase within limit capped: have %v, want %v", diff, uncapped)
+	}
+	// A tight cap must clamp the increase to the limit
+	tight := uint64(1)
+	config.Ubqhash.MaxPerBlockDifficultyIncrease = &tight
+
+	want := new(big.Int).Div(new(big.Int).Mul(parent.Difficulty, big.NewInt(10001)), big.NewInt(10000))
+	if want.Cmp(uncapped) >= 0 {
+		t.Fatalf("increase within tight limit: parent %v, have %v", parent.Difficulty, uncapped)
+	}
+	if diff := CalcDifficulty(chain, time, parent); diff.Cmp(want) != 0 {
+		t.Errorf("increase beyond limit not capped: have %v, want %v", diff, want)
+	}
+	// Until its fork block, the cap must be ignored
+	config.Ubqhash.MaxPerBlockDifficultyIncreaseBlock = new(big.Int).Add(parent.Number, big.NewInt(2))
+	if diff := CalcDifficulty(chain, time, parent); diff.Cmp(uncapped) != 0 {
+		t.Errorf("increase capped before fork: have %v, want %v", diff, uncapped)
+	}
+	config.Ubqhash.MaxPerBlockDifficultyIncreaseBlock = big.NewInt(0)
+	// Ensure the cap is part of the frozen rules too
+	config.Ubqhash.MonetaryPolicy = params.MainnetChainConfig.Ubqhash.MonetaryPolicy
+	if rules := RulesAt(config, big.NewInt(1)); rules.MaxDifficultyIncrease == nil || *rules.MaxDifficultyIncrease != tight {
+		t.Errorf("frozen rules cap mismatch: have %v, want %d", rules.MaxDifficultyIncrease, tight)
+	}
+}
+
+// Tests that the median times reported for a difficulty calculation are the
+// ones at the endpoints of the algorithm's averaging window.
+func TestDifficultyMedianTimes(t *testing.T) {
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.DigishieldModBlock, c.FluxBlock = big.NewInt(50), big.NewInt(150)
+	})
+
+	// Assemble a chain with irregular block times spanning all algorithms
+	rnd := rand.New(rand.NewSource(1))
+
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(config, []*types.Header{genesis})
+
+	headers := []*types.Header{genesis}
+	for i := 1; i <= 200; i++ {
+		parent := headers[i-1]
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 1 + uint64(rnd.Intn(200))}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		headers = append(headers, header)
+	}
+	tests := []struct {
+		parent uint64
+		window uint64
+	}{
+		{10, 0},   // DigishieldV3, too short
+		{21, 0},   // DigishieldV3, exactly the window
+		{40, 21},  // DigishieldV3
+		{80, 0},   // DigishieldV3Mod, too short
+		{120, 88}, // DigishieldV3Mod
+		{200, 88}, // Flux
+	}
+	for _, tt := range tests {
+		parent := headers[tt.parent]
+		first, last := DifficultyMedianTimes(chain, parent)
+		if tt.window == 0 {
+			if first != nil || last != nil {
+				t.Errorf("parent %d: medians reported for short chain: %v, %v", tt.parent, first, last)
+			}
+			continue
+		}
+		if want := chain.CalcPastMedianTime(tt.parent-tt.window, parent); first == nil || first.Cmp(want) != 0 {
+			t.Errorf("parent %d: first median mismatch: have %v, want %v", tt.parent, first, want)
+		}
+		if want := chain.CalcPastMedianTime(tt.parent, parent); last == nil || last.Cmp(want) != 0 {
+			t.Errorf("parent %d: last median mismatch: have %v, want %v", tt.parent, last, want)
+		}
+	}
+}
+
+// Tests that measuring Flux timespans on raw block times lets a single outlier
+// timestamp swing the difficulty, whereas the past median times absorb it.
+func TestFluxArithmeticTimespan(t *testing.T) {
+	if params.MainnetChainConfig.Ubqhash.FluxArithmeticTimespan {
+		t.Fatalf("arithmetic timespans enabled on mainnet")
+	}
+	config := testUbqhashConfig(params.TestChainConfig, nil)
+
+	// Assemble a chain of blocks right on target
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(config, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 200; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	// Calculate the difficulty of a block with an outlier timestamp in both modes
+	time := parent.Time + 20*88
+
+	median := CalcDifficulty(chain, time, parent)
+	config.Ubqhash.FluxArithmeticTimespan = true
+	arithmetic := CalcDifficulty(chain, time, parent)
+
+	if median.Cmp(parent.Difficulty) != 0 {
+		t.Errorf("median difficulty affected by outlier: have %v, want %v", median, parent.Difficulty)
+	}
+	window := averagingWindowTimespan(fluxConfig, big88)
+	want := new(big.Int).Mul(parent.Difficulty, window)
+	want.Div(want, maxActualTimespan(fluxConfig, big88, false))
+	if arithmetic.Cmp(want) != 0 {
+		t.Errorf("arithmetic difficulty mismatch: have %v, want %v", arithmetic, want)
+	}
+}
+
+// Tests that the difficulty metrics of a head block report its difficulty, the
+// active algorithm and whether its retarget was clamped.
+func TestDifficultyMetrics(t *testing.T) {
+	tests := []struct {
+		blocks   int
+		interval uint64
+		clamp    RetargetClamp
+	}{
+		{0, 88, RetargetSkipped},
+		{50, 88, RetargetSkipped},
+		{200, 88, RetargetUnclamped},
+		{200, 10, RetargetMaxIncrease},
+		{200, 500, RetargetMaxDecrease},
+	}
+	for i, tt := range tests {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+		head := genesis
+		for j := 1; j <= tt.blocks; j++ {
+			header := &types.Header{ParentHash: head.Hash(), Number: big.NewInt(int64(j)), Time: head.Time + tt.interval}
+			header.Difficulty = CalcDifficulty(chain, header.Time, head)
+
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			head = header
+		}
+		snapshot := DifficultyMetrics(chain, head)
+		if snapshot.Number != head.Number.Uint64() {
+			t.Errorf("test %d: number mismatch: have %d, want %d", i, snapshot.Number, head.Number.Uint64())
+		}
+		if snapshot.Difficulty.Cmp(head.Difficulty) != 0 {
+			t.Errorf("test %d: difficulty mismatch: have %v, want %v", i, snapshot.Difficulty, head.Difficulty)
+		}
+		if snapshot.Algorithm != Flux {
+			t.Errorf("test %d: algorithm mismatch: have %v, want %v", i, snapshot.Algorithm, Flux)
+		}
+		if snapshot.Clamp != tt.clamp {
+			t.Errorf("test %d: clamp mismatch: have %v, want %v", i, snapshot.Clamp, tt.clamp)
+		}
+	}
+}
+
+// Tests that a chain whose genesis gas limit is exactly at the minimum can still
+// raise it, the bound divisor leaving room for small steps even at the floor.
+func TestGasLimitRaiseFromMinimum(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.MinGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+	ubqhash := NewFaker()
+
+	newHeader := func(parent *types.Header, gasLimit uint64) *types.Header {
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number, common.Big1), Time: parent.Time + 88, GasLimit: gasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+		return header
+	}
+	// Raise the gas limit by the largest step allowed a few times over
+	parent := genesis
+	for i := 0; i < 5; i++ {
+		step := parent.GasLimit/params.GasLimitBoundDivisor - 1
+		if step == 0 {
+			t.Fatalf("block %d: no room to raise gas limit %d", i+1, parent.GasLimit)
+		}
+		header := newHeader(parent, parent.GasLimit+step)
+		if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != nil {
+			t.Fatalf("block %d: failed to raise gas limit from %d to %d: %v", i+1, parent.GasLimit, header.GasLimit, err)
+		}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	if parent.GasLimit <= params.MinGasLimit {
+		t.Fatalf("gas limit not raised: have %d", parent.GasLimit)
+	}
+	// Steps beyond the bound, and drops below the minimum, are still rejected
+	if err := ubqhash.verifyHeader(chain, newHeader(genesis, genesis.GasLimit+genesis.GasLimit/params.GasLimitBoundDivisor), genesis, false, false); err == nil {
+		t.Errorf("gas limit raise beyond bound accepted")
+	}
+	if err := ubqhash.verifyHeader(chain, newHeader(genesis, genesis.GasLimit-1), genesis, false, false); err == nil {
+		t.Errorf("gas limit below minimum accepted")
+	}
+}
+
+// Tests that the gas limit of an uncle is verified against the uncle's own parent
+// rather than the including block's chain, whose gas limit may have moved on.
+func TestUncleGasLimitParent(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	builder := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	// Assemble a main chain raising the gas limit as fast as allowed
+	headers := []*types.Header{genesis}
+	for i := 1; i <= 3; i++ {
+		parent := headers[i-1]
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, GasLimit: parent.GasLimit + parent.GasLimit/params.GasLimitBoundDivisor - 1}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		builder.hashes[header.Hash()] = header
+		headers = append(headers, header)
+	}
+	blocks := make([]*types.Block, len(headers))
+	for i, header := range headers {
+		blocks[i] = types.NewBlockWithHeader(header)
+	}
+	chain := newTestBlockChainReader(params.TestChainConfig, blocks)
+
+	// Create uncles of block 2, lowering the gas limit of block 1 instead
+	newUncle := func(gasLimit uint64) *types.Header {
+		parent := headers[1]
+		uncle := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: parent.Time + 90, GasLimit: gasLimit, Coinbase: common.HexToAddress("0x01")}
+		uncle.Difficulty = CalcDifficulty(chain, uncle.Time, parent)
+		return uncle
+	}
+	valid := newUncle(headers[1].GasLimit - headers[1].GasLimit/params.GasLimitBoundDivisor + 1)
+	if limit := headers[3].GasLimit / params.GasLimitBoundDivisor; headers[3].GasLimit-valid.GasLimit < limit {
+		t.Fatalf("uncle gas limit within bounds of the including chain")
+	}
+	invalid := newUncle(headers[1].GasLimit - headers[1].GasLimit/params.GasLimitBoundDivisor)
+
+	ubqhash := NewFaker()
+	for i, tt := range []struct {
+		uncle *types.Header
+		valid bool
+	}{{valid, true}, {invalid, false}} {
+		header := &types.Header{ParentHash: headers[3].Hash(), Number: big.NewInt(4), Time: headers[3].Time + 88}
+		block := types.NewBlockWithHeader(header).WithBody(nil, []*types.Header{tt.uncle})
+
+		err := ubqhash.VerifyUncles(chain, block)
+		if tt.valid && err != nil {
+			t.Errorf("test %d: failed to verify uncle: %v", i, err)
+		}
+		if !tt.valid && (err == nil || !strings.HasPrefix(err.Error(), "invalid gas limit")) {
+			t.Errorf("test %d: error mismatch: have %v, want invalid gas limit", i, err)
+		}
+	}
+}
+
+// Tests that the work of a block is a copy of its difficulty, and that invalid
+// difficulties are rejected.
+func TestBlockWork(t *testing.T) {
+	header := &types.Header{Difficulty: big.NewInt(131072)}
+
+	work, err := BlockWork(header)
+	if err != nil {
+		t.Fatalf("failed to retrieve block work: %v", err)
+	}
+	if work.Cmp(header.Difficulty) != 0 {
+		t.Fatalf("work mismatch: have %v, want %v", work, header.Difficulty)
+	}
+	work.Add(work, common.Big1)
+	if header.Difficulty.Cmp(big.NewInt(131072)) != 0 {
+		t.Errorf("header difficulty modified through work: have %v, want %v", header.Difficulty, 131072)
+	}
+	for i, diff := range []*big.Int{nil, big.NewInt(0), big.NewInt(-1)} {
+		if _, err := BlockWork(&types.Header{Difficulty: diff}); err != errInvalidDifficulty {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidDifficulty)
+		}
+	}
+}
+
+// Tests that the difficulty history is exported as CSV with a header row and a
+// row per block.
+func TestExportDifficultyCSV(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 3; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 80 + uint64(i), Difficulty: new(big.Int).Add(parent.Difficulty, big.NewInt(1000))}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	var buf bytes.Buffer
+	if err := ExportDifficultyCSV(chain, 0, 3, &buf); err != nil {
+		t.Fatalf("failed to export difficulty history: %v", err)
+	}
+	rows := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(rows) != 5 {
+		t.Fatalf("row count mismatch: have %d, want %d", len(rows), 5)
+	}
+	if want := "number,timestamp,difficulty,algorithm,blocktime"; rows[0] != want {
+		t.Errorf("header row mismatch: have %q, want %q", rows[0], want)
+	}
+	if want := "0,1000000,131072,,"; rows[1] != want {
+		t.Errorf("genesis row mismatch: have %q, want %q", rows[1], want)
+	}
+	if want := "2,1000163,133072,flux,82"; rows[3] != want {
+		t.Errorf("data row mismatch: have %q, want %q", rows[3], want)
+	}
+	// Gaps in the chain are reported
+	if err := ExportDifficultyCSV(chain, 2, 4, new(bytes.Buffer)); err == nil {
+		t.Errorf("export past the head succeeded")
+	}
+}
+
+// Tests that the difficulty audit log receives the complete trail of a Flux
+// difficulty calculation, consistent with the resulting difficulty.
+func TestDifficultyAuditLog(t *testing.T) {
+	for i, interval := range []uint64{88, 60, 10, 500} {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+		parent := genesis
+		for j := 1; j <= 120; j++ {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(j)), Time: parent.Time + interval}
+			header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+		var records []DifficultyAuditRecord
+
+		ubqhash := NewFaker()
+		ubqhash.config.DifficultyAuditLog = func(record DifficultyAuditRecord) {
+			records = append(records, record)
+		}
+		diff := ubqhash.CalcDifficulty(chain, parent.Time+interval, parent)
+
+		if len(records) != 1 {
+			t.Fatalf("test %d: record count mismatch: have %d, want %d", i, len(records), 1)
+		}
+		record := records[0]
+		if record.Number != 121 || record.Algorithm != Flux {
+			t.Errorf("test %d: block mismatch: have #%d/%v, want #%d/%v", i, record.Number, record.Algorithm, 121, Flux)
+		}
+		if record.ParentDifficulty.Cmp(parent.Difficulty) != 0 || record.Difficulty.Cmp(diff) != 0 {
+			t.Errorf("test %d: difficulty mismatch: have %v->%v, want %v->%v", i, record.ParentDifficulty, record.Difficulty, parent.Difficulty, diff)
+		}
+		first, last := chain.CalcPastMedianTime(120-88, parent), chain.CalcPastMedianTime(120, parent)
+		if record.FirstMedian.Cmp(first) != 0 || record.LastMedian.Cmp(last) != 0 {
+			t.Errorf("test %d: median mismatch: have %v-%v, want %v-%v", i, record.FirstMedian, record.LastMedian, first, last)
+		}
+		if raw := new(big.Int).Sub(last, first); record.RawTimespan.Cmp(raw) != 0 {
+			t.Errorf("test %d: raw timespan mismatch: have %v, want %v", i, record.RawTimespan, raw)
+		}
+		// The difficulty must follow from the clamped timespan
+		want := new(big.Int).Mul(parent.Difficulty, averagingWindowTimespan(fluxConfig, big88))
+		want.Div(want, record.ClampedTimespan)
+		if want.Cmp(diff) != 0 {
+			t.Errorf("test %d: clamped timespan %v inconsistent with difficulty: have %v, want %v", i, record.ClampedTimespan, want, diff)
+		}
+	}
+}
+
+// Tests that difficulties never exceed the configured bit width, even when the
+// algorithm keeps raising them.
+func TestMaxDifficultyBits(t *testing.T) {
+	if bits := MaxDifficultyBits(params.MainnetChainConfig.Ubqhash, big.NewInt(1)); bits != 256 {
+		t.Errorf("default bit width mismatch: have %d, want %d", bits, 256)
+	}
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.MaxDifficultyBits, c.MaxDifficultyBitsBlock = 20, big.NewInt(10)
+	})
+	if bits := MaxDifficultyBits(config.Ubqhash, big.NewInt(9)); bits != 256 {
+		t.Errorf("bit width before fork mismatch: have %d, want %d", bits, 256)
+	}
+
+	limit := big.NewInt(1<<20 - 1)
+
+	// Assemble a chain of fast blocks starting just below the limit
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1<<20 - 5000)}
+	chain := newTestChainReader(config, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 200; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 10}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+		if header.Difficulty.BitLen() > 20 {
+			t.Fatalf("block %d: difficulty exceeds bit width: %v", i, header.Difficulty)
+		}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	if parent.Difficulty.Cmp(limit) != 0 {
+		t.Errorf("difficulty not clamped to limit: have %v, want %v", parent.Difficulty, limit)
+	}
+	if rules := RulesAt(config, big.NewInt(10)); rules.MaxDifficultyBits != 20 {
+		t.Errorf("frozen rules bit width mismatch: have %d, want %d", rules.MaxDifficultyBits, 20)
+	}
+}
+
+// Tests that the difficulty health check passes for consistent heads and fails
+// for tampered ones.
+func TestCheckDifficultyHealth(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 100; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 60}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	if err := CheckDifficultyHealth(chain, genesis); err != nil {
+		t.Errorf("genesis failed health check: %v", err)
+	}
+	if err := CheckDifficultyHealth(chain, parent); err != nil {
+		t.Errorf("consistent head failed health check: %v", err)
+	}
+	tampered := types.CopyHeader(parent)
+	tampered.Difficulty = new(big.Int).Add(parent.Difficulty, common.Big1)
+	if err := CheckDifficultyHealth(chain, tampered); err == nil {
+		t.Errorf("tampered head passed health check")
+	}
+	orphan := types.CopyHeader(parent)
+	orphan.ParentHash = common.Hash{0x01}
+	if err := CheckDifficultyHealth(chain, orphan); err != consensus.ErrUnknownAncestor {
+		t.Errorf("orphan head error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
+
+// Tests that the cumulative difficulty at checkpoints is checked against the
+// minimum work, failing a low-work chain.
+func TestVerifyCheckpointDifficulty(t *testing.T) {
+	newChain := func(difficulty int64) *testChainReader {
+		genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(difficulty)}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+		parent := genesis
+		for i := 1; i <= 50; i++ {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Difficulty: big.NewInt(difficulty)}
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+		return chain
+	}
+	var (
+		honest  = newChain(131072)
+		lowWork = newChain(1)
+		minWork = big.NewInt(11 * 131072) // Work of the honest chain at block 10
+	)
+	tests := []struct {
+		chain       *testChainReader
+		checkpoints []uint64
+		valid       bool
+	}{
+		{honest, []uint64{10, 20, 40}, true},
+		{honest, nil, true},
+		{honest, []uint64{9, 20}, false},
+		{honest, []uint64{20, 10}, false},
+		{honest, []uint64{10, 60}, false},
+		{lowWork, []uint64{10, 20, 40}, false},
+	}
+	for i, tt := range tests {
+		err := VerifyCheckpointDifficulty(tt.chain, tt.checkpoints, minWork)
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid checkpoints rejected: %v", i, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("test %d: invalid checkpoints accepted", i)
+		}
+	}
+}
+
+// Tests that the difficulty reported during a stall drops as time passes since
+// the head without a new block being found.
+func TestStallDifficulty(t *testing.T) {
+	arithmetic := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.FluxArithmeticTimespan = true
+	})
+	tests := []struct {
+		config    *params.ChainConfig
+		interval  uint64 // Block time of the chain leading up to the stall
+		belowHead bool   // Whether the stall drops difficulty below the head's
+	}{
+		{params.TestChainConfig, 30, false}, // fast chain, stall only dampens the rise
+		{arithmetic, 88, true},              // on target chain, stall lowers difficulty
+	}
+	for i, tt := range tests {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+		chain := newTestChainReader(tt.config, []*types.Header{genesis})
+
+		parent := genesis
+		for j := 1; j <= 120; j++ {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(j)), Time: parent.Time + tt.interval}
+			header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+		prompt := StallDifficulty(chain, parent, parent.Time+tt.interval)
+		stalled := StallDifficulty(chain, parent, parent.Time+88*20)
+		if stalled.Cmp(prompt) >= 0 {
+			t.Errorf("test %d: stalled difficulty not reduced: have %v, prompt %v", i, stalled, prompt)
+		}
+		if tt.belowHead && stalled.Cmp(parent.Difficulty) >= 0 {
+			t.Errorf("test %d: stalled difficulty not below head: have %v, head %v", i, stalled, parent.Difficulty)
+		}
+		if have, want := StallDifficulty(chain, parent, parent.Time-1), StallDifficulty(chain, parent, parent.Time); have.Cmp(want) != 0 {
+			t.Errorf("test %d: past time difficulty mismatch: have %v, want %v", i, have, want)
+		}
+	}
+}
+
+// Tests that the earliest timestamp of a new block is right after its parent's,
+// unless the block would get a dampened difficulty for arriving too fast.
+func TestMinNextTimestamp(t *testing.T) {
+	tests := []struct {
+		interval uint64 // Block time of the chain leading up to the new block
+		want     uint64 // Expected minimum time since the parent
+	}{
+		{88, 1},   // on target chain, no clamping at all
+		{30, 1},   // fast chain, only dampened for slow blocks
+		{300, 44}, // slow chain, dampened within half the target block time
+	}
+	for i, tt := range tests {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000), GasLimit: params.GenesisGasLimit}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+		parent := genesis
+		for j := 1; j <= 120; j++ {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(j)), Time: parent.Time + tt.interval, GasLimit: parent.GasLimit}
+			header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+		have := MinNextTimestamp(chain, parent)
+		if have < parent.Time+1 {
+			t.Errorf("test %d: timestamp not after parent: have %d, parent %d", i, have, parent.Time)
+		}
+		if have != parent.Time+tt.want {
+			t.Errorf("test %d: timestamp mismatch: have %d, want %d", i, have, parent.Time+tt.want)
+		}
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(121), Time: have, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+		if err := NewFaker().VerifyHeader(chain, header, false); err != nil {
+			t.Errorf("test %d: block at minimum timestamp rejected: %v", i, err)
+		}
+	}
+}
+
+// Tests that halving the retarget smoothing divisor from its fork on roughly
+// doubles the response of both difficulty algorithms to the same slightly slow
+// block time series, while leaving the difficulty before the fork alone.
+func TestRetargetSmoothingDivisor(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	// Every third block is a second late, keeping the adjustment within bounds
+	parent := genesis
+	for i := 1; i <= 120; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, Difficulty: parent.Difficulty}
+		if i%3 == 0 {
+			header.Time++
+		}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	tests := []struct {
+		name       string
+		digishield *big.Int // Block to activate the DigiShield V3 mod
+		flux       *big.Int // Block to activate Flux
+	}{
+		{"digishield", big.NewInt(0), big.NewInt(1000)},
+		{"flux", big.NewInt(0), big.NewInt(0)},
+	}
+	for _, tt := range tests {
+		calc := func(divisor uint64, fork *big.Int) *big.Int {
+			config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+				c.DigishieldModBlock, c.FluxBlock = tt.digishield, tt.flux
+				c.RetargetSmoothingDivisor, c.RetargetSmoothingBlock = divisor, fork
+			})
+
+			chain.config = config
+			return CalcDifficulty(chain, parent.Time+88, parent)
+		}
+		smooth := calc(0, nil)
+		snappy := calc(2, new(big.Int).Add(parent.Number, common.Big1))
+
+		drop := new(big.Int).Sub(parent.Difficulty, smooth)
+		if drop.Sign() <= 0 {
+			t.Fatalf("%s: difficulty not lowered on a slow chain: have %v, parent %v", tt.name, smooth, parent.Difficulty)
+		}
+		snappyDrop := new(big.Int).Sub(parent.Difficulty, snappy)
+		// Integer rounding keeps the ratio from being exactly two
+		if ratio := float64(snappyDrop.Int64()) / float64(drop.Int64()); ratio < 1.9 || ratio > 2.1 {
+			t.Errorf("%s: halved divisor response mismatch: have %v, default %v", tt.name, snappyDrop, drop)
+		}
+		if early := calc(2, new(big.Int).Add(parent.Number, common.Big2)); early.Cmp(smooth) != 0 {
+			t.Errorf("%s: divisor applied before its fork: have %v, want %v", tt.name, early, smooth)
+		}
+	}
+}
+
+// Tests that the block times at which Flux dampens a clamped adjustment are the
+// double and half of the configured target block time, not of the default one.
+func TestFluxDampeningThresholds(t *testing.T) {
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.TargetBlockTime, c.TargetBlockTimeBlock = 15, big.NewInt(0)
+	})
+
+	target := big.NewInt(15)
+	tests := []struct {
+		interval uint64 // Block time of the chain, pushing the timespan out of bounds
+		elapsed  uint64 // Time since the parent of the block being calculated
+		bound    *big.Int
+	}{
+		{5, 31, minActualTimespan(fluxConfig, target, true)},  // fast chain, slow block beyond double target
+		{5, 30, minActualTimespan(fluxConfig, target, false)}, // fast chain, block at double target
+		{60, 6, maxActualTimespan(fluxConfig, target, true)},  // slow chain, fast block below half target
+		{60, 7, maxActualTimespan(fluxConfig, target, false)}, // slow chain, block at half target
+	}
+	for i, tt := range tests {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+		chain := newTestChainReader(config, []*types.Header{genesis})
+
+		parent := genesis
+		for j := 1; j <= 120; j++ {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(j)), Time: parent.Time + tt.interval}
+			header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+		want := new(big.Int).Mul(parent.Difficulty, averagingWindowTimespan(fluxConfig, target))
+		want.Div(want, tt.bound)
+
+		if have := CalcDifficulty(chain, parent.Time+tt.elapsed, parent); have.Cmp(want) != 0 {
+			t.Errorf("test %d: difficulty mismatch: have %v, want %v", i, have, want)
+		}
+	}
+}
+
+// Tests that Flux decides whether to dampen a difficulty adjustment based on the
+// raw time since the parent block, while measuring the actual timespan between
+// past median times. The scenarios below are picked so that using the parent's
+// median time for the dampening decision would flip its outcome.
+func TestFluxDampeningUsesParentTime(t *testing.T) {
+	tests := []struct {
+		spacing uint64   // Seconds between blocks in the averaging window
+		delay   uint64   // Seconds between the parent and the new block
+		span    *big.Int // Expected clamped timespan
+	}{
+		// Fast blocks: 175s is not above the 176s threshold, the median gap would be
+		{1, 175, minActualTimespan(fluxConfig, big88, false)},
+		{1, 177, minActualTimespan(fluxConfig, big88, true)},
+
+		// Slow blocks: 40s is below the 44s threshold, the median gap would not be
+		{1000, 40, maxActualTimespan(fluxConfig, big88, true)},
+		{1000, 44, maxActualTimespan(fluxConfig, big88, false)},
+	}
+	for i, tt := range tests {
+		var headers []*types.Header
+		for n := uint64(0); n <= 100; n++ {
+			headers = append(headers, &types.Header{Number: new(big.Int).SetUint64(n), Time: 1000000 + n*tt.spacing, Difficulty: big.NewInt(1000000000)})
+		}
+		chain := newTestChainReader(params.TestChainConfig, headers)
+		parent := headers[len(headers)-1]
+
+		want := new(big.Int).Mul(parent.Difficulty, averagingWindowTimespan(fluxConfig, big88))
+		want.Div(want, tt.span)
+
+		if have := CalcDifficulty(chain, parent.Time+tt.delay, parent); have.Cmp(want) != 0 {
+			t.Errorf("test %d: difficulty mismatch: have %v, want %v", i, have, want)
+		}
+	}
+}
+
+// Tests that header rejections are reported to the OnHeaderRejected hook along
+// with the reason, but only when not running a fake engine.
+func TestOnHeaderRejected(t *testing.T) {
+	parent := &types.Header{Number: big.NewInt(1), Time: 1000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: 1088, Difficulty: big.NewInt(131072), GasLimit: 2 * params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	var (
+		rejected *types.Header
+		reason   error
+		calls    int
+	)
+	hook := func(header *types.Header, err error) {
+		rejected, reason = header, err
+		calls++
+	}
+	// Ensure the gas limit violation is reported by a non-faking engine
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+	ubqhash.config.OnHeaderRejected = hook
+
+	err := ubqhash.verifyHeader(chain, header, parent, false, false)
+	if err == nil {
+		t.Fatalf("gas limit violation accepted")
+	}
+	if calls != 1 {
+		t.Fatalf("hook invocation count mismatch: have %d, want %d", calls, 1)
+	}
+	if rejected != header {
+		t.Errorf("rejected header mismatch: have %v, want %v", rejected, header)
+	}
+	if reason != err {
+		t.Errorf("rejection reason mismatch: have %v, want %v", reason, err)
+	}
+	want := fmt.Sprintf("invalid gas limit: have %d, want %d += %d", header.GasLimit, parent.GasLimit, parent.GasLimit/params.GasLimitBoundDivisor)
+	if err.Error() != want {
+		t.Errorf("error mismatch: have %v, want %v", err, want)
+	}
+	// Ensure valid headers are not reported
+	header.GasLimit = parent.GasLimit
+	if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != nil {
+		t.Fatalf("failed to verify header: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("hook invoked for valid header")
+	}
+	// Ensure fake engines never report rejections
+	fake := NewFaker()
+	fake.config.OnHeaderRejected = hook
+
+	header.GasLimit = 2 * params.GenesisGasLimit
+	if err := fake.verifyHeader(chain, header, parent, false, false); err == nil {
+		t.Fatalf("gas limit violation accepted by fake engine")
+	}
+	if calls != 1 {
+		t.Errorf("hook invoked by fake engine")
+	}
+}
+
+// Tests that headers are rejected if the configured extra-data validator refuses
+// their extra-data, and that it is consulted with the header's block number.
+func TestExtraDataValidator(t *testing.T) {
+	errMissingMagic := errors.New("missing magic prefix")
+
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+	ubqhash.config.ExtraDataValidator = func(number uint64, extra []byte) error {
+		if number >= 2 && number <= 5 && !bytes.HasPrefix(extra, []byte("gov")) {
+			return errMissingMagic
+		}
+		return nil
+	}
+	tests := []struct {
+		number uint64
+		extra  []byte
+		err    error
+	}{
+		{2, nil, errMissingMagic},
+		{2, []byte("go"), errMissingMagic},
+		{2, []byte("gov:vote"), nil},
+		{5, []byte("other"), errMissingMagic},
+		{6, []byte("other"), nil},
+		{1, nil, nil},
+	}
+	for i, tt := range tests {
+		parent := &types.Header{Number: new(big.Int).SetUint64(tt.number - 1), Time: 1000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).SetUint64(tt.number), Time: 1088, GasLimit: parent.GasLimit, Extra: tt.extra}
+		header.Difficulty = ubqhash.CalcDifficulty(chain, header.Time, parent)
+
+		if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that an allowlist coinbase validator rejects headers and uncles mined by
+// unregistered miners, while accepting the registered ones.
+func TestCoinbaseValidator(t *testing.T) {
+	var (
+		registered   = common.HexToAddress("0x01")
+		unregistered = common.HexToAddress("0x02")
+		errNotMiner  = errors.New("unregistered miner")
+	)
+	ubqhash := NewFaker()
+	ubqhash.config.CoinbaseValidator = func(addr common.Address, number uint64) error {
+		if addr != registered {
+			return errNotMiner
+		}
+		return nil
+	}
+	// Assemble a short main chain to verify headers and uncles against
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit, Coinbase: registered}
+	builder := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	headers := []*types.Header{genesis}
+	for i := 1; i <= 3; i++ {
+		parent := headers[i-1]
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, GasLimit: parent.GasLimit, Coinbase: registered}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		builder.hashes[header.Hash()] = header
+		headers = append(headers, header)
+	}
+	blocks := make([]*types.Block, len(headers))
+	for i, header := range headers {
+		blocks[i] = types.NewBlockWithHeader(header)
+	}
+	chain := newTestBlockChainReader(params.TestChainConfig, blocks)
+
+	for i, coinbase := range []common.Address{registered, unregistered} {
+		want := error(nil)
+		if coinbase != registered {
+			want = errNotMiner
+		}
+		// Verify a header extending the chain
+		parent := headers[3]
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(4), Time: parent.Time + 88, GasLimit: parent.GasLimit, Coinbase: coinbase}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		if err := ubqhash.VerifyHeader(chain, header, false); err != want {
+			t.Errorf("test %d: header error mismatch: have %v, want %v", i, err, want)
+		}
+		// Verify an uncle of block 2 included by a registered miner
+		uncle := &types.Header{ParentHash: headers[1].Hash(), Number: big.NewInt(2), Time: headers[1].Time + 90, GasLimit: headers[1].GasLimit, Coinbase: coinbase}
+		uncle.Difficulty = CalcDifficulty(chain, uncle.Time, headers[1])
+
+		header.Coinbase = registered
+		block := types.NewBlockWithHeader(header).WithBody(nil, []*types.Header{uncle})
+		if err := ubqhash.VerifyUncles(chain, block); err != want {
+			t.Errorf("test %d: uncle error mismatch: have %v, want %v", i, err, want)
+		}
+	}
+}
+
+// Tests that verifying a header without its seal still runs every check other
+// than the proof-of-work one, so pipelines verifying seals separately don't skip
+// any other consensus rule.
+func TestVerifyHeaderWithoutSeal(t *testing.T) {
+	parent := &types.Header{Number: big.NewInt(1), Time: 1000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	tests := []struct {
+		name   string
+		modify func(header *types.Header)
+		err    string
+	}{
+		{"valid", func(header *types.Header) {}, ""},
+		{"difficulty", func(header *types.Header) { header.Difficulty = big.NewInt(1) }, "invalid difficulty"},
+		{"gas limit cap", func(header *types.Header) { header.GasLimit = 0x8000000000000000 }, "invalid gasLimit"},
+		{"gas used", func(header *types.Header) { header.GasUsed = header.GasLimit + 1 }, "invalid gasUsed"},
+		{"gas limit bounds", func(header *types.Header) { header.GasLimit *= 2 }, "invalid gas limit"},
+		{"timestamp", func(header *types.Header) { header.Time = parent.Time }, errZeroBlockTime.Error()},
+		{"future", func(header *types.Header) { header.Time = uint64(time.Now().Add(time.Hour).Unix()) }, consensus.ErrFutureBlock.Error()},
+		{"extra-data", func(header *types.Header) { header.Extra = make([]byte, params.MaximumExtraDataSize+1) }, "extra-data too long"},
+	}
+	for _, tt := range tests {
+		// Assemble a header with a bogus seal, valid unless modified
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: 1088, GasLimit: parent.GasLimit, Nonce: types.BlockNonce{0x01}}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+		tt.modify(header)
+
+		err := ubqhash.VerifyHeader(chain, header, false)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: failed to verify unsealed header: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("%s: error mismatch: have %v, want %s", tt.name, err, tt.err)
+		}
+		// Only the seal check itself should be skipped
+		if tt.err == "" {
+			if err := ubqhash.VerifyHeader(chain, header, true); err != errInvalidMixDigest {
+				t.Errorf("%s: bogus seal error mismatch: have %v, want %v", tt.name, err, errInvalidMixDigest)
+			}
+		}
+	}
+}
+
+// Tests that seals can be checked from their raw inputs, without a header.
+func TestCheckPoW(t *testing.T) {
+	var (
+		number   = uint64(epochLength + 1)
+		sealHash = common.HexToHash("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+		nonce    = uint64(0x1234)
+	)
+	c := &cache{epoch: number / epochLength}
+	c.generate("", 0, false, true)
+	digest, _ := hashimotoLight(32*1024, c.cache, sealHash.Bytes(), nonce)
+	mixDigest := common.BytesToHash(digest)
+
+	tests := []struct {
+		mixDigest  common.Hash
+		difficulty *big.Int
+		mode       Mode
+		err        error
+	}{
+		{mixDigest, big.NewInt(1), ModeTest, nil},
+		{common.Hash{0x01}, big.NewInt(1), ModeTest, errInvalidMixDigest},
+		{mixDigest, new(big.Int).Lsh(common.Big1, 255), ModeTest, errInvalidPoW},
+		{mixDigest, big.NewInt(0), ModeTest, errInvalidDifficulty},
+		{common.Hash{0x01}, big.NewInt(1), ModeFake, nil},
+	}
+	for i, tt := range tests {
+		if err := CheckPoW(sealHash, nonce, tt.mixDigest, tt.difficulty, number, tt.mode); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that a batch of shares is verified against both the share and the block
+// difficulty, rejecting the ones meeting neither or carrying a bad mix digest.
+func TestVerifyShares(t *testing.T) {
+	sealHash := common.HexToHash("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+	cache, size := ubqhash.VerificationCache(0)
+
+	// Find the nonces with the best and worst PoW values among a few attempts
+	var (
+		best, worst           uint64
+		bestMix, worstMix     common.Hash
+		bestValue, worstValue *big.Int
+	)
+	for nonce := uint64(0); nonce < 16; nonce++ {
+		digest, result := hashimotoLight(size, cache, sealHash.Bytes(), nonce)
+		value := new(big.Int).SetBytes(result)
+		if bestValue == nil || value.Cmp(bestValue) < 0 {
+			best, bestMix, bestValue = nonce, common.BytesToHash(digest), value
+		}
+		if worstValue == nil || value.Cmp(worstValue) > 0 {
+			worst, worstMix, worstValue = nonce, common.BytesToHash(digest), value
+		}
+	}
+	// Pick the block difficulty so only the best nonce meets it
+	difficulty := new(big.Int).Div(two256, bestValue)
+
+	shares := []Share{
+		{sealHash, best, bestMix, difficulty, big.NewInt(1)},
+		{sealHash, worst, worstMix, difficulty, big.NewInt(1)},
+		{sealHash, worst, worstMix, difficulty, difficulty},
+		{sealHash, best, worstMix, difficulty, big.NewInt(1)},
+		{sealHash, best, bestMix, difficulty, nil},
+	}
+	want := []ShareResult{
+		{Valid: true, Block: true},
+		{Valid: true},
+		{Err: errInvalidPoW},
+		{Err: errInvalidMixDigest},
+		{Err: errInvalidDifficulty},
+	}
+	results := VerifyShares(shares, cache, size)
+	if len(results) != len(want) {
+		t.Fatalf("result count mismatch: have %d, want %d", len(results), len(want))
+	}
+	for i, have := range results {
+		if have != want[i] {
+			t.Errorf("share %d: result mismatch: have %+v, want %+v", i, have, want[i])
+		}
+	}
+}
+
+// Tests that closing the engine during a verification batch aborts it promptly,
+// failing the headers not yet verified and leaving no goroutines behind.
+func TestCloseDuringVerification(t *testing.T) {
+	const count = 100
+
+	// Assemble a valid chain to verify
+	var (
+		genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		builder = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		headers = make([]*types.Header, count)
+		seals   = make([]bool, count)
+	)
+	parent := genesis
+	for i := 0; i < count; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number, common.Big1), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		headers[i], seals[i], parent = header, true, header
+	}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+	chain.headers = builder.headers
+
+	goroutines := runtime.NumGoroutine()
+
+	ubqhash := NewFakeDelayer(50 * time.Millisecond)
+	_, results := ubqhash.VerifyHeaders(chain, headers, seals)
+
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	ubqhash.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close took too long: %v", elapsed)
+	}
+	closed := 0
+	for i := 0; i < count; i++ {
+		select {
+		case err := <-results:
+			if err == errEngineClosed {
+				closed++
+			} else if err != nil {
+				t.Errorf("header %d: unexpected error: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("header %d: result timeout", i)
+		}
+	}
+	if closed == 0 {
+		t.Errorf("no headers aborted by close")
+	}
+	// Batches started after closing fail right away
+	_, results = ubqhash.VerifyHeaders(chain, headers[:1], seals[:1])
+	if err := <-results; err != errEngineClosed {
+		t.Errorf("error mismatch after close: have %v, want %v", err, errEngineClosed)
+	}
+	// All verification goroutines should be gone
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if have := runtime.NumGoroutine(); have > goroutines {
+		t.Errorf("leaked goroutines: have %d, want at most %d", have, goroutines)
+	}
+}
+
+// Tests that collecting the results of a batch verification reports the errors
+// of all failing headers, in the order of the headers.
+func TestVerifyHeadersCollect(t *testing.T) {
+	const count = 6
+
+	var (
+		genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		chain   = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		headers = make([]*types.Header, count)
+		parent  = genesis
+	)
+	for i := 0; i < count; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number, common.Big1), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+		headers[i], parent = header, header
+	}
+	// Break a header in the middle, orphaning its child, and the last one
+	headers[1].Extra = make([]byte, params.MaximumExtraDataSize+1)
+	headers[count-1].Difficulty = big.NewInt(1)
+
+	want := []string{"", "extra-data too long", consensus.ErrUnknownAncestor.Error(), "", "", "invalid difficulty"}
+
+	errs := NewFaker().VerifyHeadersCollect(chain, headers, make([]bool, count))
+	if len(errs) != count {
+		t.Fatalf("result count mismatch: have %d, want %d", len(errs), count)
+	}
+	for i, err := range errs {
+		switch {
+		case want[i] == "" && err != nil:
+			t.Errorf("header %d: unexpected error: %v", i, err)
+		case want[i] != "" && (err == nil || !strings.Contains(err.Error(), want[i])):
+			t.Errorf("header %d: error mismatch: have %v, want %q", i, err, want[i])
+		}
+	}
+}
+
+// Tests that strict batch verification rejects batches with gaps in their block
+// numbers up front, while contiguous batches verify as usual.
+func TestStrictHeaderBatches(t *testing.T) {
+	const count = 5
+
+	var (
+		genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		chain   = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		headers = make([]*types.Header, count)
+		parent  = genesis
+	)
+	for i := 0; i < count; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number, common.Big1), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+		headers[i], parent = header, header
+	}
+	ubqhash := NewFaker()
+	ubqhash.config.StrictHeaderBatches = true
+
+	for i, err := range ubqhash.VerifyHeadersCollect(chain, headers, make([]bool, count)) {
+		if err != nil {
+			t.Errorf("header %d: failed to verify contiguous batch: %v", i, err)
+		}
+	}
+	// Drop a header from the middle of the batch
+	gapped := append(append([]*types.Header{}, headers[:2]...), headers[3:]...)
+	for i, err := range ubqhash.VerifyHeadersCollect(chain, gapped, make([]bool, len(gapped))) {
+		if !errors.Is(err, errNonContiguousBatch) || !strings.Contains(err.Error(), "header 2 is #4, want #3") {
+			t.Errorf("header %d: error mismatch: have %v, want gap at header 2", i, err)
+		}
+	}
+}
+
+// Tests that batch verification stops once its time budget is exceeded, failing
+// the headers that weren't verified in time.
+func TestVerifyHeadersWithBudget(t *testing.T) {
+	const count = 10
+
+	// Assemble a valid chain to verify
+	var (
+		genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		builder = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		headers = make([]*types.Header, count)
+		seals   = make([]bool, count)
+	)
+	parent := genesis
+	for i := 0; i < count; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: new(big.Int).Add(parent.Number, common.Big1), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		headers[i], seals[i], parent = header, true, header
+	}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+	chain.headers = builder.headers
+
+	// Verify on a single thread with slow seal checks, so the budget runs out
+	// after a couple of headers
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	ubqhash := NewFakeDelayer(100 * time.Millisecond)
+	_, results := ubqhash.VerifyHeadersWithBudget(chain, headers, seals, 250*time.Millisecond)
+
+	for i := 0; i < count; i++ {
+		select {
+		case err := <-results:
+			switch {
+			case i == 0 && err != nil:
+				t.Errorf("header %d: failed to verify within budget: %v", i, err)
+			case i == count-1 && err != errVerifyBudgetExceeded:
+				t.Errorf("header %d: error mismatch: have %v, want %v", i, err, errVerifyBudgetExceeded)
+			case err != nil && err != errVerifyBudgetExceeded:
+				t.Errorf("header %d: unexpected error: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("header %d: result timeout", i)
+		}
+	}
+	// Ensure a batch within budget is unaffected
+	_, results = NewFaker().VerifyHeadersWithBudget(chain, headers, seals, time.Minute)
+	for i := 0; i < count; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("header %d: failed to verify within budget: %v", i, err)
+		}
+	}
+}
+
+// countingChainReader is a test chain reader counting the header lookups by hash.
+type countingChainReader struct {
+	*testChainReader
+	lookups int
+}
+
+func (r *countingChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	r.lookups++
+	return r.testChainReader.GetHeader(hash, number)
+}
+
+// Benchmarks importing a chain header by header, with and without the parents
+// supplied by a provider instead of being looked up in the chain.
+func BenchmarkVerifyHeaderParentProvider(b *testing.B) {
+	const count = 100
+
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	builder := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	headers := []*types.Header{genesis}
+	for i := 1; i <= count; i++ {
+		parent := headers[i-1]
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		builder.hashes[header.Hash()] = header
+		headers = append(headers, header)
+	}
+	for _, provided := range []bool{false, true} {
+		b.Run(fmt.Sprintf("provided=%v", provided), func(b *testing.B) {
+			chain := &countingChainReader{testChainReader: newTestChainReader(params.TestChainConfig, nil)}
+			chain.headers = builder.headers
+
+			ubqhash := NewFaker()
+			if provided {
+				// The importer keeps every header it verified, so it has the parents
+				ubqhash.config.ParentProvider = func(hash common.Hash, number uint64) *types.Header {
+					return headers[number]
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				chain.hashes = map[common.Hash]*types.Header{genesis.Hash(): genesis}
+				for _, header := range headers[1:] {
+					if err := ubqhash.VerifyHeader(chain, header, false); err != nil {
+						b.Fatalf("failed to verify header #%d: %v", header.Number, err)
+					}
+					chain.hashes[header.Hash()] = header
+				}
+			}
+			b.ReportMetric(float64(chain.lookups)/float64(b.N), "lookups/op")
+		})
+	}
+}
+
+// jitteryChainReader is a test chain reader that delays header lookups randomly
+// to shuffle the completion order of concurrent verifications.
+type jitteryChainReader struct {
+	*testChainReader
+}
+
+func (r *jitteryChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	return r.testChainReader.GetHeader(hash, number)
+}
+
+// Tests that batch header verification delivers its results strictly in input
+// order, even when the individual verifications complete out of order.
+func TestVerifyHeadersOrdering(t *testing.T) {
+	const count = 500
+
+	// Assemble a chain, making every 7th header invalid
+	var (
+		genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		builder = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		headers = make([]*types.Header, count)
+		errs    = make([]string, count)
+	)
+	parent := genesis
+	for i := 0; i < count; i++ {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     new(big.Int).Add(parent.Number, common.Big1),
+			Time:       parent.Time + 88,
+			GasLimit:   parent.GasLimit,
+		}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+		if i%7 == 3 {
+			header.Extra = make([]byte, params.MaximumExtraDataSize+1)
+			errs[i] = fmt.Sprintf("extra-data too long: %d > %d", len(header.Extra), params.MaximumExtraDataSize)
+		}
+		builder.headers[header.Number.Uint64()] = header
+		builder.hashes[header.Hash()] = header
+
+		headers[i], parent = header, header
+	}
+	// Verify the batch a few times and ensure results arrive in input order. The
+	// verifier only knows the genesis by hash, but needs the numbered headers for
+	// the past median times of the difficulty calculation.
+	ubqhash := NewFaker()
+	chain := &jitteryChainReader{newTestChainReader(params.TestChainConfig, []*types.Header{genesis})}
+	chain.headers = builder.headers
+
+	for round := 0; round < 3; round++ {
+		_, results := ubqhash.VerifyHeaders(chain, headers, make([]bool, count))
+		for i := 0; i < count; i++ {
+			select {
+			case err := <-results:
+				switch {
+				case errs[i] == "" && err != nil:
+					t.Fatalf("round %d, header %d: unexpected error: %v", round, i, err)
+				case errs[i] != "" && (err == nil || err.Error() != errs[i]):
+					t.Fatalf("round %d, header %d: error mismatch: have %v, want %v", round, i, err, errs[i])
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("round %d, header %d: verification timeout", round, i)
+			}
+		}
+	}
+}
+
+// Tests that seal hashes switch from legacy Keccak-256 to standard SHA3-256 at
+// the fork block of the chain config, and only if the chain schedules the fork.
+func TestSealHasherFork(t *testing.T) {
+	sealHash := func(hasher hash.Hash, header *types.Header) (hash common.Hash) {
+		rlp.Encode(hasher, []interface{}{
+			header.ParentHash, header.UncleHash, header.Coinbase, header.Root, header.TxHash, header.ReceiptHash,
+			header.Bloom, header.Difficulty, header.Number, header.GasLimit, header.GasUsed, header.Time, header.Extra,
+		})
+		hasher.Sum(hash[:0])
+		return hash
+	}
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.SHA3SealHashBlock = big.NewInt(100)
+	})
+
+	legacy, forked := NewFaker(), NewFaker()
+	forked.config.ChainConfig = config.Ubqhash
+
+	for _, number := range []int64{0, 99, 100, 101} {
+		header := &types.Header{Number: big.NewInt(number), Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit, Extra: []byte("ubiq")}
+
+		keccak := sealHash(sha3.NewLegacyKeccak256(), header)
+		if have := legacy.SealHash(header); have != keccak {
+			t.Errorf("block %d: default seal hash mismatch: have %x, want %x", number, have, keccak)
+		}
+		want := keccak
+		if number >= 100 {
+			want = sealHash(sha3.New256(), header)
+		}
+		if have := forked.SealHash(header); have != want {
+			t.Errorf("block %d: forked seal hash mismatch: have %x, want %x", number, have, want)
+		}
+	}
+	// Sealing and verification follow the chain handed in, whatever the engine's
+	// own config, so every node agrees on the fork
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	chain := newTestChainReader(config, nil)
+	header := &types.Header{Number: big.NewInt(100), Difficulty: big.NewInt(100)}
+
+	results := make(chan *types.Block)
+	if err := ubqhash.Seal(chain, types.NewBlockWithHeader(header), results, nil); err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	select {
+	case block := <-results:
+		header.Nonce = types.EncodeNonce(block.Nonce())
+		header.MixDigest = block.MixDigest()
+	case <-time.NewTimer(2 * time.Second).C:
+		t.Fatalf("sealing result timeout")
+	}
+	if err := ubqhash.VerifySeal(chain, header); err != nil {
+		t.Errorf("seal rejected on the forked chain: %v", err)
+	}
+	if err := ubqhash.VerifySeal(newTestChainReader(params.TestChainConfig, nil), header); err == nil {
+		t.Errorf("SHA3 seal accepted on a chain without the fork")
+	}
+}
+
+// Tests that a batch of headers spanning an epoch boundary passes full header and
+// seal verification, generating each epoch's verification cache only once.
+func TestVerifyHeadersFull(t *testing.T) {
+	// Scale the seal difficulty down so that the nonce of every header is valid
+	// and only the mix digests need to be derived.
+	builder := NewTester(nil, false)
+	defer builder.Close()
+	builder.config.DifficultyDivisor = 1 << 40
+
+	var (
+		start   = uint64(epochLength - 16)
+		first   = start - 2*testMedianTimeBlocks - fluxConfig.AveragingWindow.Uint64()
+		genesis = &types.Header{Number: new(big.Int).SetUint64(first), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		canon   = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		headers []*types.Header
+	)
+	parent := genesis
+	for number := first + 1; number < start+32; number++ {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     new(big.Int).SetUint64(number),
+			Time:       parent.Time + 88,
+			GasLimit:   parent.GasLimit,
+			Difficulty: parent.Difficulty,
+		}
+		if number >= start {
+			header.Difficulty = CalcDifficulty(canon, header.Time, parent)
+			digest, _ := hashimotoLight(32*1024, builder.cache(number).cache, builder.SealHash(header).Bytes(), 0)
+			header.MixDigest = common.BytesToHash(digest)
+			headers = append(headers, header)
+		}
+		canon.headers[number] = header
+		canon.hashes[header.Hash()] = header
+		parent = header
+	}
+	// Verify the batch against a chain only knowing the headers preceding it by
+	// hash, counting the verification caches generated per epoch
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+	ubqhash.config.DifficultyDivisor = builder.config.DifficultyDivisor
+
+	var (
+		lock      sync.Mutex
+		generated = make(map[uint64]int)
+		create    = ubqhash.caches.new
+	)
+	ubqhash.caches.new = func(epoch uint64) interface{} {
+		lock.Lock()
+		generated[epoch]++
+		lock.Unlock()
+		return create(epoch)
+	}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{headers[0]})
+	chain.headers, chain.hashes = canon.headers, make(map[common.Hash]*types.Header)
+	chain.hashes[canon.headers[start-1].Hash()] = canon.headers[start-1]
+
+	_, results := ubqhash.VerifyHeadersFull(chain, headers)
+	for i := range headers {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Errorf("header %d: verification failed: %v", headers[i].Number, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("header %d: verification timeout", headers[i].Number)
+		}
+	}
+	// Ensure both epochs were verified with a single cache each
+	lock.Lock()
+	for _, epoch := range []uint64{0, 1} {
+		if generated[epoch] != 1 {
+			t.Errorf("epoch %d: cache generation count mismatch: have %d, want %d", epoch, generated[epoch], 1)
+		}
+	}
+	lock.Unlock()
+
+	// Tamper with a seal and ensure it's caught by the full verification
+	headers[len(headers)-1].MixDigest = common.Hash{}
+
+	_, results = ubqhash.VerifyHeadersFull(chain, headers)
+	for i := range headers {
+		if err := <-results; (err != nil) != (i == len(headers)-1) {
+			t.Errorf("header %d: unexpected verification result: %v", headers[i].Number, err)
+		}
+	}
+}
+
+// Tests that blocks pinned at the minimum difficulty are only rejected past the
+// minimum difficulty rejection fork.
+func TestRejectMinimumDifficultyBlocks(t *testing.T) {
+	tests := []struct {
+		difficulty *big.Int
+		fork       *big.Int
+		err        error
+	}{
+		{params.MinimumDifficulty, nil, nil},
+		{params.MinimumDifficulty, big.NewInt(3), nil},
+		{params.MinimumDifficulty, big.NewInt(2), errMinimumDifficulty},
+		{new(big.Int).Add(params.MinimumDifficulty, common.Big1), big.NewInt(2), nil},
+	}
+	for i, tt := range tests {
+		config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+			c.RejectMinimumDifficultyBlock = tt.fork
+		})
+		parent := &types.Header{Number: big.NewInt(1), Time: 1000, Difficulty: tt.difficulty, GasLimit: params.GenesisGasLimit}
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: 1088, Difficulty: tt.difficulty, GasLimit: params.GenesisGasLimit}
+		chain := newTestChainReader(config, []*types.Header{parent})
+
+		if err := NewFaker().verifyHeader(chain, header, parent, false, false); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that the counted RLP size of a sealed header matches its encoding.
+func TestHeaderRLPSize(t *testing.T) {
+	headers := []*types.Header{
+		{Difficulty: big.NewInt(0), Number: big.NewInt(0)},
+		{
+			ParentHash: common.HexToHash("0x01"),
+			Coinbase:   common.HexToAddress("0x03"),
+			Difficulty: new(big.Int).Lsh(big.NewInt(1), 200),
+			Number:     big.NewInt(1234567),
+			GasLimit:   8000000,
+			GasUsed:    21000,
+			Time:       1600000000,
+			Extra:      make([]byte, 32),
+			MixDigest:  common.HexToHash("0x0e"),
+			Nonce:      types.EncodeNonce(15),
+		},
+	}
+	for i, header := range headers {
+		enc, err := rlp.EncodeToBytes(header)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode header: %v", i, err)
+		}
+		if have := HeaderRLPSize(header); have != len(enc) {
+			t.Errorf("test %d: size mismatch: have %d, want %d", i, have, len(enc))
+		}
+	}
+}
+
+// Tests that the seal hash inputs are the header fields in their canonical order.
+func TestSealHashInputs(t *testing.T) {
+	header := &types.Header{
+		ParentHash:  common.HexToHash("0x01"),
+		UncleHash:   common.HexToHash("0x02"),
+		Coinbase:    common.HexToAddress("0x03"),
+		Root:        common.HexToHash("0x04"),
+		TxHash:      common.HexToHash("0x05"),
+		ReceiptHash: common.HexToHash("0x06"),
+		Bloom:       types.BytesToBloom([]byte{0x07}),
+		Difficulty:  big.NewInt(8),
+		Number:      big.NewInt(9),
+		GasLimit:    10,
+		GasUsed:     11,
+		Time:        12,
+		Extra:       []byte{0x0d},
+		MixDigest:   common.HexToHash("0x0e"),
+		Nonce:       types.EncodeNonce(15),
+	}
+	want := []interface{}{
+		header.ParentHash, header.UncleHash, header.Coinbase, header.Root, header.TxHash, header.ReceiptHash,
+		header.Bloom, header.Difficulty, header.Number, header.GasLimit, header.GasUsed, header.Time, header.Extra,
+	}
+	have := SealHashInputs(header)
+	if len(have) != 13 {
+		t.Fatalf("input count mismatch: have %d, want %d", len(have), 13)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("inputs mismatch: have %v, want %v", have, want)
+	}
+	// Ensure the seal hash is derived from exactly these inputs
+	hasher := sha3.NewLegacyKeccak256()
+	rlp.Encode(hasher, have)
+
+	var hash common.Hash
+	hasher.Sum(hash[:0])
+	if sealhash := NewFaker().SealHash(header); sealhash != hash {
+		t.Errorf("seal hash mismatch: have %x, want %x", sealhash, hash)
+	}
+}
+
+// Tests that the difficulty change from the parent is reported both as absolute
+// and percentage values.
+func TestDifficultyDelta(t *testing.T) {
+	parent := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	tests := []struct {
+		difficulty int64
+		delta      int64
+		percent    float64
+	}{
+		{1004000, 4000, 0.4},
+		{990000, -10000, -1},
+		{1000000, 0, 0},
+	}
+	for i, tt := range tests {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Difficulty: big.NewInt(tt.difficulty)}
+
+		delta, percent, err := DifficultyDelta(chain, header)
+		if err != nil {
+			t.Fatalf("test %d: failed to calculate delta: %v", i, err)
+		}
+		if delta.Cmp(big.NewInt(tt.delta)) != 0 {
+			t.Errorf("test %d: delta mismatch: have %v, want %v", i, delta, tt.delta)
+		}
+		if math.Abs(percent-tt.percent) > 1e-9 {
+			t.Errorf("test %d: percentage mismatch: have %v, want %v", i, percent, tt.percent)
+		}
+	}
+	// Ensure headers with an unknown parent are rejected
+	header := &types.Header{ParentHash: common.HexToHash("0xdeadbeef"), Number: big.NewInt(2), Difficulty: big.NewInt(1000000)}
+	if _, _, err := DifficultyDelta(chain, header); err != consensus.ErrUnknownAncestor {
+		t.Errorf("unknown parent error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
+
+// Tests that block timestamps too far ahead of the chain's median time are
+// rejected when a maximum gap is configured.
+func TestMaxMedianTimeGap(t *testing.T) {
+	// Assemble a chain with a block every 88 seconds
+	var headers []*types.Header
+	for i := uint64(0); i <= 20; i++ {
+		headers = append(headers, &types.Header{Number: new(big.Int).SetUint64(i), Time: 1000000 + 88*i, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit})
+	}
+	chain := newTestChainReader(params.TestChainConfig, headers)
+	parent := headers[len(headers)-1]
+	median := chain.CalcPastMedianTime(parent.Number.Uint64(), parent).Uint64()
+
+	narrow := consensus.PastMedianTime(parent.Number.Uint64(), parent, 5, chain.GetHeaderByNumber).Uint64()
+
+	tests := []struct {
+		gap    uint64
+		fork   int64
+		window uint64
+		time   uint64
+		err    error
+	}{
+		{0, 0, 0, median + 100000, nil},
+		{3600, 0, 0, parent.Time + 88, nil},
+		{3600, 0, 0, median + 3600, nil},
+		{3600, 0, 0, median + 3601, errMedianTimeGap},
+		{3600, 0, 0, median + 100000, errMedianTimeGap},
+		{3600, 21, 0, median + 3601, errMedianTimeGap},
+		{3600, 22, 0, median + 3601, nil}, // limit not yet active
+		{3600, 0, 5, narrow + 3600, nil},
+		{3600, 0, 5, narrow + 3601, errMedianTimeGap},
+	}
+	for i, tt := range tests {
+		config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+			c.MaxMedianTimeGap, c.MaxMedianTimeGapBlock = tt.gap, big.NewInt(tt.fork)
+			c.MedianTimeWindow, c.MedianTimeWindowBlock = tt.window, big.NewInt(0)
+		})
+		chain := newTestChainReader(config, headers)
+
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(21), Time: tt.time, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		if err := NewFaker().verifyHeader(chain, header, parent, false, false); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests the future block tolerance boundary against a fixed clock.
+func TestFutureBlockClock(t *testing.T) {
+	now := time.Unix(2000000000, 0)
+
+	ubqhash := NewFaker()
+	ubqhash.now = func() time.Time { return now }
+
+	parent := &types.Header{Number: big.NewInt(1), Time: uint64(now.Unix()) - 88, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	tolerance := uint64(allowedFutureBlockTime / time.Second)
+	tests := []struct {
+		time uint64
+		err  error
+	}{
+		{uint64(now.Unix()), nil},
+		{uint64(now.Unix()) + tolerance, nil},
+		{uint64(now.Unix()) + tolerance + 1, consensus.ErrFutureBlock},
+	}
+	for i, tt := range tests {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: tt.time, Difficulty: parent.Difficulty, GasLimit: parent.GasLimit}
+		if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that a header exactly at the future block tolerance is only rejected if
+// the boundary is configured to be inclusive.
+func TestFutureBoundaryInclusive(t *testing.T) {
+	now := time.Unix(2000000000, 0)
+
+	parent := &types.Header{Number: big.NewInt(1), Time: uint64(now.Unix()) - 88, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{parent})
+
+	tolerance := uint64(allowedFutureBlockTime / time.Second)
+	tests := []struct {
+		inclusive bool
+		time      uint64
+		err       error
+	}{
+		{false, uint64(now.Unix()) + tolerance - 1, nil},
+		{false, uint64(now.Unix()) + tolerance, nil},
+		{true, uint64(now.Unix()) + tolerance - 1, nil},
+		{true, uint64(now.Unix()) + tolerance, consensus.ErrFutureBlock},
+		{true, uint64(now.Unix()) + tolerance + 1, consensus.ErrFutureBlock},
+	}
+	for i, tt := range tests {
+		ubqhash := NewFaker()
+		ubqhash.now = func() time.Time { return now }
+		ubqhash.config.FutureBoundaryInclusive = tt.inclusive
+
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: tt.time, Difficulty: parent.Difficulty, GasLimit: parent.GasLimit}
+		if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that the future block check can measure against the chain's own median
+// time instead of a skewed system clock.
+func TestChainTimeMargin(t *testing.T) {
+	// Assemble a chain whose head is right at the actual current time
+	var (
+		head    = uint64(2000000000)
+		genesis = &types.Header{Number: big.NewInt(0), Time: head - 20*88, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		chain   = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		parent  = genesis
+	)
+	for i := 1; i <= 20; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, Difficulty: parent.Difficulty, GasLimit: parent.GasLimit}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(21), Time: parent.Time + 88, Difficulty: parent.Difficulty, GasLimit: parent.GasLimit}
+
+	// Run the node with a system clock lagging an hour behind
+	ubqhash := NewFaker()
+	ubqhash.now = func() time.Time { return time.Unix(int64(head)-3600, 0) }
+
+	if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != consensus.ErrFutureBlock {
+		t.Errorf("wall clock error mismatch: have %v, want %v", err, consensus.ErrFutureBlock)
+	}
+	// The median lags the head by about 5 blocks, so allow for 10
+	ubqhash.config.ChainTimeMargin = 10 * 88 * time.Second
+	if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != nil {
+		t.Errorf("failed to verify header against chain time: %v", err)
+	}
+	// Ensure headers far beyond the chain time are still rejected
+	header.Time = parent.Time + 3600
+	if err := ubqhash.verifyHeader(chain, header, parent, false, false); err != consensus.ErrFutureBlock {
+		t.Errorf("chain time error mismatch: have %v, want %v", err, consensus.ErrFutureBlock)
+	}
+}
+
+// Tests that the difficulty timespans scale with the configured target block
+// time, defaulting to the original 88 second values.
+func TestTargetBlockTime(t *testing.T) {
+	tests := []struct {
+		target                                   uint64
+		window, minUp, minDamp, maxDown, maxDamp int64
+	}{
+		{0, 7744, 7720, 7736, 7782, 7751},  // default, 88 seconds
+		{88, 7744, 7720, 7736, 7782, 7751}, // explicit 88 seconds
+		{15, 1320, 1316, 1318, 1326, 1321}, // 15 seconds
+	}
+	for i, tt := range tests {
+		target := TargetBlockTime(&params.UbqhashConfig{TargetBlockTime: tt.target, TargetBlockTimeBlock: big.NewInt(0)}, big.NewInt(1))
+
+		if have := averagingWindowTimespan(fluxConfig, target); have.Int64() != tt.window {
+			t.Errorf("test %d: averaging window timespan mismatch: have %v, want %v", i, have, tt.window)
+		}
+		if have := minActualTimespan(fluxConfig, target, false); have.Int64() != tt.minUp {
+			t.Errorf("test %d: min timespan mismatch: have %v, want %v", i, have, tt.minUp)
+		}
+		if have := minActualTimespan(fluxConfig, target, true); have.Int64() != tt.minDamp {
+			t.Errorf("test %d: dampened min timespan mismatch: have %v, want %v", i, have, tt.minDamp)
+		}
+		if have := maxActualTimespan(fluxConfig, target, false); have.Int64() != tt.maxDown {
+			t.Errorf("test %d: max timespan mismatch: have %v, want %v", i, have, tt.maxDown)
+		}
+		if have := maxActualTimespan(fluxConfig, target, true); have.Int64() != tt.maxDamp {
+			t.Errorf("test %d: dampened max timespan mismatch: have %v, want %v", i, have, tt.maxDamp)
+		}
+	}
+	// Ensure a chain producing blocks exactly on a 15 second target keeps its
+	// difficulty, whereas the default 88 second target raises it
+	var headers []*types.Header
+	for n := uint64(0); n <= 100; n++ {
+		headers = append(headers, &types.Header{Number: new(big.Int).SetUint64(n), Time: 1000000 + 15*n, Difficulty: big.NewInt(1000000000)})
+	}
+	parent := headers[len(headers)-1]
+
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.TargetBlockTime, c.TargetBlockTimeBlock = 15, big.NewInt(101)
+	})
+	if have := CalcDifficulty(newTestChainReader(config, headers), parent.Time+15, parent); have.Cmp(parent.Difficulty) != 0 {
+		t.Errorf("15 second target difficulty mismatch: have %v, want %v", have, parent.Difficulty)
+	}
+	// Until its fork block, the 15 second target is ignored
+	config.Ubqhash.TargetBlockTimeBlock = big.NewInt(102)
+	if have := CalcDifficulty(newTestChainReader(config, headers), parent.Time+15, parent); have.Cmp(parent.Difficulty) <= 0 {
+		t.Errorf("difficulty not raised before the target block time fork: have %v, parent %v", have, parent.Difficulty)
+	}
+	if have := CalcDifficulty(newTestChainReader(params.TestChainConfig, headers), parent.Time+15, parent); have.Cmp(parent.Difficulty) <= 0 {
+		t.Errorf("88 second target difficulty not raised: have %v, parent %v", have, parent.Difficulty)
+	}
+}
+
+// Tests that the rewards of a block including two uncles are verified, and that
+// the verification leaves the audited state untouched.
+func TestVerifyRewards(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+
+	var (
+		miner  = common.HexToAddress("0x01")
+		first  = common.HexToAddress("0x02")
+		second = common.HexToAddress("0x03")
+	)
+	statedb.AddBalance(miner, big.NewInt(1000))
+
+	header := &types.Header{Number: big.NewInt(1100000), Coinbase: miner}
+	uncles := []*types.Header{
+		{Number: big.NewInt(1099999), Coinbase: first},
+		{Number: big.NewInt(1099998), Coinbase: second},
+	}
+	if err := VerifyRewards(params.MainnetChainConfig, statedb, header, uncles); err != nil {
+		t.Fatalf("failed to verify rewards: %v", err)
+	}
+	if balance := statedb.GetBalance(miner); balance.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("audited state modified: have %v, want %v", balance, 1000)
+	}
+	// Cross check the credited amounts against precalculated values
+	accumulateRewards(params.MainnetChainConfig, statedb, header, uncles)
+
+	want, _ := new(big.Int).SetString("5317382812500001000", 10)
+	if balance := statedb.GetBalance(miner); balance.Cmp(want) != 0 {
+		t.Errorf("miner balance mismatch: have %v, want %v", balance, want)
+	}
+	if balance := statedb.GetBalance(first); balance.Cmp(big.NewInt(25e+17)) != 0 {
+		t.Errorf("first uncle balance mismatch: have %v, want %v", balance, big.NewInt(25e+17))
+	}
+	if balance := statedb.GetBalance(second); balance.Sign() != 0 {
+		t.Errorf("second uncle balance mismatch: have %v, want %v", balance, 0)
+	}
+}
+
+// Tests that a chain config without any monetary policy steps pays no rewards
+// instead of crashing.
+func TestEmptyMonetaryPolicy(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.MonetaryPolicy = nil
+	})
+
+	header := &types.Header{Number: big.NewInt(1), Coinbase: common.HexToAddress("0x01")}
+	uncles := []*types.Header{{Number: big.NewInt(0), Coinbase: common.HexToAddress("0x02")}}
+
+	initial, current := CalcBaseBlockReward(config.Ubqhash, header.Number)
+	if initial.Sign() != 0 || current.Sign() != 0 {
+		t.Errorf("reward mismatch: have %v/%v, want 0/0", initial, current)
+	}
+	accumulateRewards(config, statedb, header, uncles)
+	for _, addr := range []common.Address{header.Coinbase, uncles[0].Coinbase} {
+		if balance := statedb.GetBalance(addr); balance.Sign() != 0 {
+			t.Errorf("balance of %x mismatch: have %v, want 0", addr, balance)
+		}
+	}
+}
+
+// Tests that the net miner reward accounts for every configured reward modifier
+// and matches what accumulateRewards credits the miner with.
+func TestNetMinerReward(t *testing.T) {
+	var (
+		miner  = common.HexToAddress("0x01")
+		header = &types.Header{Number: big.NewInt(1100000), Coinbase: miner}
+		uncle  = &types.Header{Number: big.NewInt(1099999), Coinbase: common.HexToAddress("0x02")}
+	)
+	tests := []struct {
+		launchFactor uint64
+		curve        []uint64
+		uncles       []*types.Header
+		want         string
+	}{
+		{0, nil, nil, "5000000000000000000"},
+		{20000, nil, nil, "10000000000000000000"},
+		{0, nil, []*types.Header{uncle}, "5156250000000000000"},
+		{20000, nil, []*types.Header{uncle}, "10156250000000000000"},
+		{0, []uint64{50}, []*types.Header{uncle}, "5078125000000000000"},
+		{20000, []uint64{50}, []*types.Header{uncle}, "10078125000000000000"},
+	}
+	for i, tt := range tests {
+		config := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+			c.LaunchBonusBlocks, c.LaunchBonusFactor, c.LaunchBonusBlock = 2000000, tt.launchFactor, big.NewInt(0)
+			c.UncleBonusCurve, c.UncleBonusCurveBlock = tt.curve, big.NewInt(0)
+		})
+
+		want, _ := new(big.Int).SetString(tt.want, 10)
+		if have := NetMinerReward(config, header, tt.uncles); have.Cmp(want) != 0 {
+			t.Errorf("test %d: net reward mismatch: have %v, want %v", i, have, want)
+		}
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		accumulateRewards(config, statedb, header, tt.uncles)
+		if balance := statedb.GetBalance(miner); balance.Cmp(want) != 0 {
+			t.Errorf("test %d: credited reward mismatch: have %v, want %v", i, balance, want)
+		}
+	}
+}
+
+// Tests that the reward of a single uncle is derived from the right base reward
+// before and after the Byzantium uncle reward fix, matching what the block pays.
+func TestUncleReward(t *testing.T) {
+	tests := []struct {
+		block, uncle int64
+		want         *big.Int
+	}{
+		{1000000, 999999, big.NewInt(4e+18)},   // pre-Byzantium, depth 1, paid from the initial reward
+		{1000000, 999998, big.NewInt(0)},       // pre-Byzantium, depth 2
+		{1100000, 1099999, big.NewInt(25e+17)}, // post-Byzantium, depth 1, paid from the current reward
+		{1100000, 1099998, big.NewInt(0)},      // post-Byzantium, depth 2
+	}
+	for i, tt := range tests {
+		have := UncleReward(params.MainnetChainConfig, big.NewInt(tt.block), big.NewInt(tt.uncle))
+		if have.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: uncle reward mismatch: have %v, want %v", i, have, tt.want)
+		}
+		header := &types.Header{Number: big.NewInt(tt.block)}
+		uncle := &types.Header{Number: big.NewInt(tt.uncle)}
+		if paid := calcRewards(params.MainnetChainConfig, header, []*types.Header{uncle}).uncles[0]; paid.Cmp(have) != 0 {
+			t.Errorf("test %d: uncle reward differs from paid: have %v, paid %v", i, have, paid)
+		}
+	}
+}
+
+// Tests that the uncle inclusion bonus scales with the gas the uncle used from the
+// fork block of the chain config on, and is flat otherwise.
+func TestUncleBonusByGasUsed(t *testing.T) {
+	var (
+		miner  = common.HexToAddress("0x01")
+		header = &types.Header{Number: big.NewInt(1100000), Coinbase: miner}
+		full   = &types.Header{Number: big.NewInt(1099999), Coinbase: common.HexToAddress("0x02"), GasLimit: 8000000, GasUsed: 8000000}
+		half   = &types.Header{Number: big.NewInt(1099999), Coinbase: common.HexToAddress("0x02"), GasLimit: 8000000, GasUsed: 4000000}
+		empty  = &types.Header{Number: big.NewInt(1099999), Coinbase: common.HexToAddress("0x02"), GasLimit: 8000000}
+	)
+	tests := []struct {
+		fork  *big.Int
+		uncle *types.Header
+		want  string
+	}{
+		{nil, full, "5156250000000000000"},
+		{nil, empty, "5156250000000000000"},
+		{big.NewInt(1100001), empty, "5156250000000000000"},
+		{big.NewInt(0), full, "5156250000000000000"},
+		{big.NewInt(0), half, "5078125000000000000"},
+		{big.NewInt(1100000), empty, "5000000000000000000"},
+	}
+	for i, tt := range tests {
+		config := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+			c.UncleBonusByGasUsedBlock = tt.fork
+		})
+
+		want, _ := new(big.Int).SetString(tt.want, 10)
+		if have := NetMinerReward(config, header, []*types.Header{tt.uncle}); have.Cmp(want) != 0 {
+			t.Errorf("test %d: net reward mismatch: have %v, want %v", i, have, want)
+		}
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		if err := VerifyRewards(config, statedb, header, []*types.Header{tt.uncle}); err != nil {
+			t.Errorf("test %d: reward verification failed: %v", i, err)
+		}
+	}
+}
+
+// Tests that rewards are paid to the address embedded in the extra-data if enabled
+// and well formed, and to the coinbase otherwise.
+func TestExtraDataRewardAddress(t *testing.T) {
+	var (
+		miner    = common.HexToAddress("0x01")
+		proposer = common.HexToAddress("0x02")
+	)
+	tests := []struct {
+		fork  *big.Int
+		extra []byte
+		payee common.Address
+	}{
+		{nil, proposer.Bytes(), miner},
+		{big.NewInt(1100001), proposer.Bytes(), miner},
+		{big.NewInt(1100000), proposer.Bytes(), proposer},
+		{big.NewInt(1100000), nil, miner},
+		{big.NewInt(1100000), proposer.Bytes()[1:], miner},
+		{big.NewInt(1100000), append(proposer.Bytes(), 0x00), miner},
+		{big.NewInt(1100000), make([]byte, common.AddressLength), miner},
+	}
+	for i, tt := range tests {
+		config := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+			c.ExtraDataRewardAddressBlock = tt.fork
+		})
+
+		header := &types.Header{Number: big.NewInt(1100000), Coinbase: miner, Extra: tt.extra}
+		uncle := &types.Header{Number: big.NewInt(1099999), Coinbase: miner, Extra: tt.extra}
+
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		if err := VerifyRewards(config, statedb, header, []*types.Header{uncle}); err != nil {
+			t.Errorf("test %d: reward verification failed: %v", i, err)
+		}
+		accumulateRewards(config, statedb, header, []*types.Header{uncle})
+
+		want := new(big.Int).Add(NetMinerReward(config, header, []*types.Header{uncle}), UncleReward(config, header.Number, uncle.Number))
+		if have := statedb.GetBalance(tt.payee); have.Cmp(want) != 0 {
+			t.Errorf("test %d: payee balance mismatch: have %v, want %v", i, have, want)
+		}
+		other := miner
+		if tt.payee == miner {
+			other = proposer
+		}
+		if have := statedb.GetBalance(other); have.Sign() != 0 {
+			t.Errorf("test %d: non-payee %x credited with %v", i, other, have)
+		}
+	}
+}
+
+// Tests that the base block reward is split among the reward recipients by weight,
+// while the bonuses on top of it are still paid to the coinbase.
+func TestRewardRecipients(t *testing.T) {
+	var (
+		miner = common.HexToAddress("0x01")
+		uncle = common.HexToAddress("0x02")
+		dao   = common.HexToAddress("0x03")
+		fund  = common.HexToAddress("0x04")
+	)
+	config := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+		c.RewardRecipients = []params.UbqhashRewardRecipient{{Address: dao, Weight: 70}, {Address: fund, Weight: 30}}
+		c.RewardRecipientsBlock = big.NewInt(1100000)
+	})
+
+	tests := []struct {
+		uncles      []*types.Header
+		miner       *big.Int
+		dao         *big.Int
+		fund        *big.Int
+		uncleReward *big.Int
+	}{
+		{nil, big.NewInt(0), big.NewInt(35e+17), big.NewInt(15e+17), big.NewInt(0)},
+		{[]*types.Header{{Number: big.NewInt(1099999), Coinbase: uncle}}, big.NewInt(15625e+13), big.NewInt(35e+17), big.NewInt(15e+17), big.NewInt(25e+17)},
+	}
+	for i, tt := range tests {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		header := &types.Header{Number: big.NewInt(1100000), Coinbase: miner}
+
+		if err := VerifyRewards(config, statedb, header, tt.uncles); err != nil {
+			t.Errorf("test %d: failed to verify rewards: %v", i, err)
+		}
+		if reward := NetMinerReward(config, header, tt.uncles); reward.Cmp(tt.miner) != 0 {
+			t.Errorf("test %d: net miner reward mismatch: have %v, want %v", i, reward, tt.miner)
+		}
+		accumulateRewards(config, statedb, header, tt.uncles)
+
+		for _, check := range []struct {
+			addr common.Address
+			want *big.Int
+		}{{miner, tt.miner}, {dao, tt.dao}, {fund, tt.fund}, {uncle, tt.uncleReward}} {
+			if balance := statedb.GetBalance(check.addr); balance.Cmp(check.want) != 0 {
+				t.Errorf("test %d: balance of %x mismatch: have %v, want %v", i, check.addr, balance, check.want)
+			}
+		}
+	}
+	// Blocks before the fork pay the coinbase
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	accumulateRewards(config, statedb, &types.Header{Number: big.NewInt(1099999), Coinbase: miner}, nil)
+	if balance := statedb.GetBalance(miner); balance.Cmp(big.NewInt(5e+18)) != 0 {
+		t.Errorf("coinbase balance mismatch before the fork: have %v, want %v", balance, big.NewInt(5e+18))
+	}
+	// Zero weights fall back to paying the coinbase
+	config.Ubqhash.RewardRecipients = []params.UbqhashRewardRecipient{{Address: dao}, {Address: fund}}
+
+	statedb, _ = state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	accumulateRewards(config, statedb, &types.Header{Number: big.NewInt(1100000), Coinbase: miner}, nil)
+	if balance := statedb.GetBalance(miner); balance.Cmp(big.NewInt(5e+18)) != 0 {
+		t.Errorf("coinbase balance mismatch with zero weights: have %v, want %v", balance, big.NewInt(5e+18))
+	}
+}
+
+// Tests that the reward change hook fires exactly at the first block paying the
+// stepped down reward of the monetary policy, with the old and new rewards, and
+// only once for blocks both assembled while mining and imported.
+func TestOnRewardChange(t *testing.T) {
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.MonetaryPolicy = []params.UbqhashMPStep{
+			{Block: big.NewInt(0), Reward: big.NewInt(8e+18)},
+			{Block: big.NewInt(10), Reward: big.NewInt(7e+18)},
+		}
+	})
+	chain := newTestChainReader(config, nil)
+
+	type change struct{ block, oldReward, newReward *big.Int }
+	var changes []change
+
+	ubqhash := NewFaker()
+	ubqhash.config.OnRewardChange = func(block *big.Int, oldReward, newReward *big.Int) {
+		changes = append(changes, change{block, oldReward, newReward})
+	}
+	for number := int64(0); number <= 15; number++ {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		block, err := ubqhash.FinalizeAndAssemble(chain, &types.Header{Number: big.NewInt(number)}, statedb.Copy(), nil, nil, nil)
+		if err != nil {
+			t.Fatalf("block %d: failed to assemble: %v", number, err)
+		}
+		ubqhash.Finalize(chain, block.Header(), statedb, nil, nil)
+	}
+	// The initial reward is paid from block 1, the step down from block 11
+	want := []change{
+		{big.NewInt(1), big.NewInt(0), big.NewInt(8e+18)},
+		{big.NewInt(11), big.NewInt(8e+18), big.NewInt(7e+18)},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("reward change count mismatch: have %d, want %d", len(changes), len(want))
+	}
+	for i, have := range changes {
+		if have.block.Cmp(want[i].block) != 0 || have.oldReward.Cmp(want[i].oldReward) != 0 || have.newReward.Cmp(want[i].newReward) != 0 {
+			t.Errorf("change %d mismatch: have %v %v -> %v, want %v %v -> %v", i, have.block, have.oldReward, have.newReward, want[i].block, want[i].oldReward, want[i].newReward)
+		}
+	}
+}
+
+// Tests that an old block is verified against the frozen rules of its era, even
+// though the live chain config has since moved on to a different algorithm.
+func TestVerifyHeaderAtRules(t *testing.T) {
+	// The block was produced while DigishieldV3 was active
+	era := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+		c.DigishieldModBlock, c.FluxBlock = big.NewInt(1000), big.NewInt(2000)
+	})
+	// Since then the live config switched to Flux from genesis
+	live := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+		c.DigishieldModBlock, c.FluxBlock = big.NewInt(0), big.NewInt(0)
+	})
+
+	// Assemble a fast chain so the two algorithms disagree
+	var (
+		genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000), GasLimit: params.GenesisGasLimit}
+		builder = newTestChainReader(era, []*types.Header{genesis})
+		parent  = genesis
+	)
+	for i := 1; i < 40; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 10, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		builder.hashes[header.Hash()] = header
+		parent = header
+	}
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(40), Time: parent.Time + 10, GasLimit: parent.GasLimit}
+	header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+	rules := RulesAt(era, header.Number)
+	if rules.Algorithm != DigishieldV3 {
+		t.Fatalf("era algorithm mismatch: have %v, want %v", rules.Algorithm, DigishieldV3)
+	}
+	ubqhash := NewFaker()
+	chain := newTestChainReader(live, nil)
+	chain.headers, chain.hashes = builder.headers, builder.hashes
+
+	if err := ubqhash.verifyHeader(chain, header, parent, false, true); err == nil {
+		t.Errorf("old block accepted by the live rules")
+	}
+	if err := ubqhash.VerifyHeaderAtRules(chain, header, parent, rules); err != nil {
+		t.Errorf("old block rejected by its era's rules: %v", err)
+	}
+	// Ensure the frozen rules are still enforced
+	header.GasLimit = 2 * parent.GasLimit
+	if err := ubqhash.VerifyHeaderAtRules(chain, header, parent, rules); err == nil {
+		t.Errorf("invalid gas limit accepted by the frozen rules")
+	}
+}
+
+// Tests that the frozen rules capture every chain config parameter the difficulty
+// algorithm reads, so that changing any of them in the live config leaves the
+// verification of an old block unaffected.
+func TestVerifyHeaderAtRulesFrozen(t *testing.T) {
+	tests := []struct {
+		name   string
+		era    func(c *params.UbqhashConfig) // Parameters the block was produced under
+		live   func(c *params.UbqhashConfig) // Later change to the live config
+		blocks int                           // Length of the chain below the verified block
+		time   func(i int) uint64            // Block time of the i-th block
+		fork   int                           // Block a side chain holding the verified block branches off at (0 = none)
+	}{
+		{
+			name: "bootstrap algorithm",
+			era: func(c *params.UbqhashConfig) {
+				c.BootstrapAlgorithm, c.BootstrapAlgorithmBlock = params.BootstrapPerBlock, big.NewInt(0)
+			},
+			live:   func(c *params.UbqhashConfig) { c.BootstrapAlgorithm = params.BootstrapHold },
+			blocks: 10,
+			time:   func(i int) uint64 { return 10 },
+		},
+		{
+			name: "difficulty fork grace",
+			era: func(c *params.UbqhashConfig) {
+				c.DigishieldModBlock, c.DifficultyForkGrace, c.DifficultyForkGraceBlock = big.NewInt(1), 1000, big.NewInt(0)
+			},
+			live:   func(c *params.UbqhashConfig) { c.DifficultyForkGrace = 0 },
+			blocks: 100,
+			time:   func(i int) uint64 { return 10 },
+		},
+		{
+			name:   "retarget smoothing divisor",
+			era:    func(c *params.UbqhashConfig) { c.RetargetSmoothingDivisor, c.RetargetSmoothingBlock = 1, big.NewInt(0) },
+			live:   func(c *params.UbqhashConfig) { c.RetargetSmoothingDivisor = 0 },
+			blocks: 40,
+			time:   func(i int) uint64 { return 80 },
+		},
+		{
+			name:   "median time window",
+			era:    func(c *params.UbqhashConfig) { c.MedianTimeWindow, c.MedianTimeWindowBlock = 3, big.NewInt(0) },
+			live:   func(c *params.UbqhashConfig) { c.MedianTimeWindow = 0 },
+			blocks: 40,
+			time:   func(i int) uint64 { return 30 + uint64(i*i%97) },
+		},
+		{
+			name:   "ancestry median time",
+			era:    func(c *params.UbqhashConfig) { c.AncestryMedianTimeBlock = big.NewInt(0) },
+			live:   func(c *params.UbqhashConfig) { c.AncestryMedianTimeBlock = nil },
+			blocks: 40,
+			time:   func(i int) uint64 { return 88 },
+			fork:   25,
+		},
+	}
+	for _, tt := range tests {
+		// Produce the block with DigishieldV3 and the era's parameters
+		config := testUbqhashConfig(params.MainnetChainConfig, func(c *params.UbqhashConfig) {
+			c.DigishieldModBlock, c.FluxBlock = big.NewInt(1000), big.NewInt(2000)
+			tt.era(c)
+		})
+		var (
+			genesis = &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000), GasLimit: params.GenesisGasLimit}
+			chain   = newTestChainReader(config, []*types.Header{genesis})
+			parent  = genesis
+		)
+		for i := 1; i <= tt.blocks; i++ {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + tt.time(i), GasLimit: parent.GasLimit}
+			header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+			chain.headers[header.Number.Uint64()] = header
+			chain.hashes[header.Hash()] = header
+			parent = header
+		}
+		// Move the verified block onto a faster side chain if requested
+		if tt.fork > 0 {
+			parent = chain.headers[uint64(tt.fork)]
+			for i := tt.fork + 1; i <= tt.blocks; i++ {
+				header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 10, GasLimit: parent.GasLimit}
+				header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+				chain.hashes[header.Hash()] = header
+				parent = header
+			}
+		}
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(tt.blocks + 1)), Time: parent.Time + tt.time(tt.blocks+1), GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, parent)
+
+		rules := RulesAt(config, header.Number)
+
+		// Change the parameter in the live config and verify the block again
+		tt.live(config.Ubqhash)
+
+		ubqhash := NewFaker()
+		if err := ubqhash.verifyHeader(chain, header, parent, false, true); err == nil {
+			t.Errorf("%s: live config change didn't affect the difficulty", tt.name)
+		}
+		if err := ubqhash.VerifyHeaderAtRules(chain, header, parent, rules); err != nil {
+			t.Errorf("%s: old block rejected by its era's rules: %v", tt.name, err)
+		}
+	}
+}
+
+// Tests that difficulty forks left unset in the chain config never activate.
+func TestDifficultyAlgorithmUnsetForks(t *testing.T) {
+	tests := []struct {
+		digishieldMod, flux *big.Int
+		parent              int64
+		algo                DifficultyAlgorithm
+	}{
+		{nil, nil, 1000000, DigishieldV3},
+		{big.NewInt(10), nil, 9, DigishieldV3},
+		{big.NewInt(10), nil, 1000000, DigishieldV3Mod},
+		{nil, big.NewInt(10), 9, DigishieldV3},
+		{nil, big.NewInt(10), 10, Flux},
+	}
+	for i, tt := range tests {
+		config := &params.UbqhashConfig{DigishieldModBlock: tt.digishieldMod, FluxBlock: tt.flux}
+		if algo := difficultyAlgorithmAt(config, big.NewInt(tt.parent)); algo != tt.algo {
+			t.Errorf("test %d: algorithm mismatch: have %v, want %v", i, algo, tt.algo)
+		}
+	}
+}
+
+// Tests that blocks carrying transactions but claiming less gas used than a plain
+// transfer are flagged when verified with their body, only if enabled.
+func TestVerifyHeaderWithBody(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	header := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: genesis.Time + 88, GasLimit: genesis.GasLimit}
+	header.Difficulty = CalcDifficulty(chain, header.Time, genesis)
+
+	txs := []*types.Transaction{types.NewTransaction(0, common.Address{}, big.NewInt(1), params.TxGas, big.NewInt(1), nil)}
+	tests := []struct {
+		enabled bool
+		gasUsed uint64
+		txs     []*types.Transaction
+		flagged bool
+	}{
+		{false, 0, txs, false},
+		{true, 0, txs, true},
+		{true, params.TxGas - 1, txs, true},
+		{true, params.TxGas, txs, false},
+		{true, 0, nil, false},
+	}
+	for i, tt := range tests {
+		ubqhash := NewFaker()
+		ubqhash.config.CheckBodyGasUsed = tt.enabled
+
+		header.GasUsed = tt.gasUsed
+		err := ubqhash.VerifyHeaderWithBody(chain, header, tt.txs, false)
+		if flagged := errors.Is(err, errImplausibleGasUsed); flagged != tt.flagged || (!flagged && err != nil) {
+			t.Errorf("test %d: verification mismatch: have %v, want flagged %v", i, err, tt.flagged)
+		}
+	}
+}
+
+// Tests that an injected median time series drives the engine's difficulty
+// calculation and header verification without a full header chain.
+func TestMedianTimeFunc(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	parent := &types.Header{Number: big.NewInt(200), Time: 1000000 + 200*88, Difficulty: big.NewInt(1000000000), GasLimit: params.GenesisGasLimit}
+	chain.hashes[parent.Hash()] = parent
+
+	window := fluxConfig.AveragingWindow.Int64()
+	for _, spacing := range []int64{88, 89} {
+		spacing, queried := spacing, make(map[uint64]bool)
+
+		ubqhash := NewFaker()
+		ubqhash.config.MedianTimeFunc = func(number uint64, parent *types.Header) *big.Int {
+			queried[number] = true
+			return big.NewInt(int64(number) * spacing)
+		}
+		// Expect the actual timespan smoothed by a quarter towards the target one,
+		// the slower series staying within the adjustment bounds
+		target := big.NewInt(88 * window)
+		timespan := big.NewInt(target.Int64() + (spacing*window-target.Int64())/4)
+		want := new(big.Int).Div(new(big.Int).Mul(parent.Difficulty, target), timespan)
+
+		have := ubqhash.CalcDifficulty(chain, parent.Time+88, parent)
+		if have.Cmp(want) != 0 {
+			t.Errorf("spacing %d: difficulty mismatch: have %v, want %v", spacing, have, want)
+		}
+		if first := parent.Number.Uint64() - uint64(window); !queried[first] || !queried[parent.Number.Uint64()] {
+			t.Errorf("spacing %d: median times not queried at #%d and #%d: %v", spacing, first, parent.Number, queried)
+		}
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(201), Time: parent.Time + 88, Difficulty: want, GasLimit: parent.GasLimit}
+		if err := ubqhash.VerifyHeader(chain, header, false); err != nil {
+			t.Errorf("spacing %d: header with injected difficulty rejected: %v", spacing, err)
+		}
+	}
+}
+
+// Tests that the per-block bootstrap algorithm adjusts the difficulty of a fresh
+// chain, which the default holds constant until the averaging window is filled.
+func TestBootstrapAlgorithm(t *testing.T) {
+	bootstrap := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.BootstrapAlgorithm, c.BootstrapAlgorithmBlock = params.BootstrapPerBlock, big.NewInt(0)
+	})
+	// Until its fork block, the bootstrap algorithm holds the difficulty too
+	unforked := testUbqhashConfig(bootstrap, func(c *params.UbqhashConfig) {
+		c.BootstrapAlgorithmBlock = big.NewInt(2)
+	})
+
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(32000000)}
+	step := new(big.Int).Div(genesis.Difficulty, big.NewInt(bootstrapBoundDivisor))
+
+	tests := []struct {
+		blocktime uint64
+		want      *big.Int
+	}{
+		{44, new(big.Int).Add(genesis.Difficulty, step)},
+		{88, genesis.Difficulty},
+		{100, new(big.Int).Sub(genesis.Difficulty, step)},
+		{200, new(big.Int).Sub(genesis.Difficulty, new(big.Int).Mul(step, big.NewInt(2)))},
+		{88 * 1000, params.MinimumDifficulty},
+	}
+	for i, tt := range tests {
+		held := CalcDifficulty(newTestChainReader(params.TestChainConfig, []*types.Header{genesis}), genesis.Time+tt.blocktime, genesis)
+		if held.Cmp(genesis.Difficulty) != 0 {
+			t.Errorf("test %d: default bootstrap difficulty mismatch: have %v, want %v", i, held, genesis.Difficulty)
+		}
+		if held := CalcDifficulty(newTestChainReader(unforked, []*types.Header{genesis}), genesis.Time+tt.blocktime, genesis); held.Cmp(genesis.Difficulty) != 0 {
+			t.Errorf("test %d: unforked bootstrap difficulty mismatch: have %v, want %v", i, held, genesis.Difficulty)
+		}
+		adjusted := CalcDifficulty(newTestChainReader(bootstrap, []*types.Header{genesis}), genesis.Time+tt.blocktime, genesis)
+		if adjusted.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: per-block bootstrap difficulty mismatch: have %v, want %v", i, adjusted, tt.want)
+		}
+	}
+	// Past the bootstrap phase both must be back on the regular algorithm
+	var (
+		held   = newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+		parent = genesis
+	)
+	for i := 1; i <= 100; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88 + uint64(i%7), Difficulty: parent.Difficulty}
+		held.headers[header.Number.Uint64()] = header
+		held.hashes[header.Hash()] = header
+		parent = header
+	}
+	adjusted := newTestChainReader(bootstrap, nil)
+	adjusted.headers, adjusted.hashes = held.headers, held.hashes
+
+	if have, want := CalcDifficulty(adjusted, parent.Time+30, parent), CalcDifficulty(held, parent.Time+30, parent); have.Cmp(want) != 0 {
+		t.Errorf("post-bootstrap difficulty mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that the uncles of blocks up to the trusted checkpoint are accepted as
+// they are, while the ones of later blocks are still verified.
+func TestTrustedCheckpointUncles(t *testing.T) {
+	ubqhash := NewFaker()
+	ubqhash.config.TrustedCheckpoint = 10
+
+	chain := newTestChainReader(params.TestChainConfig, nil)
+	uncles := make([]*types.Header, maxUncles+1)
+	for i := range uncles {
+		uncles[i] = &types.Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(131072)}
+	}
+	tests := []struct {
+		number uint64
+		err    error
+	}{
+		{9, nil},
+		{10, nil},
+		{11, errTooManyUncles},
+	}
+	for _, tt := range tests {
+		block := types.NewBlockWithHeader(&types.Header{Number: new(big.Int).SetUint64(tt.number)}).WithBody(nil, uncles)
+		if err := ubqhash.VerifyUncles(chain, block); !errors.Is(err, tt.err) {
+			t.Errorf("block %d: error mismatch: have %v, want %v", tt.number, err, tt.err)
+		}
+	}
+	// Without a checkpoint every block has to be verified
+	ubqhash.config.TrustedCheckpoint = 0
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)}).WithBody(nil, uncles)
+	if err := ubqhash.VerifyUncles(chain, block); !errors.Is(err, errTooManyUncles) {
+		t.Errorf("unchecked block error mismatch: have %v, want %v", err, errTooManyUncles)
+	}
+}
+
+// Tests that the past median time spans the requested window, takes the given
+// parent in place of its block, and is nil if any block in the window is missing.
+func TestPastMedianTime(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000}
+	headers := []*types.Header{genesis}
+	for i := 1; i <= 20; i++ {
+		headers = append(headers, &types.Header{Number: big.NewInt(int64(i)), Time: genesis.Time + uint64(i)*10})
+	}
+	chain := newTestChainReader(params.TestChainConfig, headers)
+
+	if have := consensus.PastMedianTime(0, nil, 11, chain.GetHeaderByNumber); have == nil || have.Uint64() != genesis.Time {
+		t.Errorf("genesis median mismatch: have %v, want %d", have, genesis.Time)
+	}
+	if have := consensus.PastMedianTime(20, nil, 11, chain.GetHeaderByNumber); have == nil || have.Uint64() != headers[15].Time {
+		t.Errorf("median mismatch: have %v, want %d", have, headers[15].Time)
+	}
+	if have := consensus.PastMedianTime(20, nil, 5, chain.GetHeaderByNumber); have == nil || have.Uint64() != headers[18].Time {
+		t.Errorf("narrow median mismatch: have %v, want %d", have, headers[18].Time)
+	}
+	parent := &types.Header{Number: big.NewInt(20), Time: 0}
+	if have := consensus.PastMedianTime(20, parent, 3, chain.GetHeaderByNumber); have == nil || have.Uint64() != headers[18].Time {
+		t.Errorf("substituted median mismatch: have %v, want %d", have, headers[18].Time)
+	}
+	delete(chain.headers, 12)
+	if have := consensus.PastMedianTime(20, nil, 11, chain.GetHeaderByNumber); have != nil {
+		t.Errorf("median over missing header: have %v, want nil", have)
+	}
+	if have := chain.CalcPastMedianTime(20, nil); have != nil {
+		t.Errorf("chain median over missing header: have %v, want nil", have)
+	}
+}
+
+// Tests that the median time window of the difficulty algorithm is configurable,
+// with a narrower window letting a run of outlier timestamps through.
+func TestMedianTimeWindow(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	headers := []*types.Header{genesis}
+
+	// Make the timestamps of the last three blocks jump far ahead
+	parent := genesis
+	for i := 1; i <= 200; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, Difficulty: parent.Difficulty}
+		if i == 198 {
+			header.Time += 5000
+		}
+		headers = append(headers, header)
+		parent = header
+	}
+	tests := []struct {
+		window  uint64
+		fork    int64
+		lowered bool
+	}{
+		{0, 0, false},
+		{11, 0, false},
+		{5, 0, true},
+		{5, 201, true},
+		{5, 202, false}, // window not yet active for the next block
+	}
+	for _, tt := range tests {
+		config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+			c.MedianTimeWindow, c.MedianTimeWindowBlock = tt.window, big.NewInt(tt.fork)
+		})
+
+		diff := CalcDifficulty(newTestChainReader(config, headers), parent.Time+88, parent)
+		if lowered := diff.Cmp(parent.Difficulty) < 0; lowered != tt.lowered || (!lowered && diff.Cmp(parent.Difficulty) != 0) {
+			t.Errorf("window %d at %d: difficulty mismatch: have %v, parent %v, want lowered %v", tt.window, tt.fork, diff, parent.Difficulty, tt.lowered)
+		}
+	}
+}
+
+// Tests that Flux, with its tighter bounds, retargets a volatile block time series
+// more smoothly than the modified DigiShield V3 algorithm.
+func TestCompareAlgorithms(t *testing.T) {
+	rand := rand.New(rand.NewSource(1))
+
+	blockTimes := make([]uint64, 400)
+	for i := range blockTimes {
+		blockTimes[i] = 1 + uint64(rand.Intn(300))
+	}
+	start := big.NewInt(1000000000)
+	digishield, flux := CompareAlgorithms(blockTimes, start)
+	if len(digishield) != len(blockTimes) || len(flux) != len(blockTimes) {
+		t.Fatalf("series length mismatch: digishield %d, flux %d, want %d", len(digishield), len(flux), len(blockTimes))
+	}
+	// Both must hold the difficulty until the averaging window fills up
+	for i := 0; i < int(fluxConfig.AveragingWindow.Int64()); i++ {
+		if digishield[i].Cmp(start) != 0 || flux[i].Cmp(start) != 0 {
+			t.Fatalf("block %d: bootstrap difficulty mismatch: digishield %v, flux %v, want %v", i+1, digishield[i], flux[i], start)
+		}
+	}
+	// Measure the total relative change between consecutive blocks
+	volatility := func(diffs []*big.Int) float64 {
+		var total float64
+		for i := 1; i < len(diffs); i++ {
+			prev, _ := new(big.Float).SetInt(diffs[i-1]).Float64()
+			next, _ := new(big.Float).SetInt(diffs[i]).Float64()
+			total += math.Abs(next-prev) / prev
+		}
+		return total
+	}
+	if d, f := volatility(digishield), volatility(flux); f >= d {
+		t.Errorf("flux not smoother than digishield: flux %f, digishield %f", f, d)
+	}
+}
+
+// Tests that the adjustment bounds are relaxed during the grace period after a
+// difficulty fork, and only then.
+func TestDifficultyForkGrace(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	headers := []*types.Header{genesis}
+
+	// Mine consistently slow blocks, making every retarget hit the bounds
+	parent := genesis
+	for i := 1; i <= 200; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 120, Difficulty: parent.Difficulty}
+		headers = append(headers, header)
+		parent = header
+	}
+	difficulty := func(grace uint64, number uint64) *big.Int {
+		config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+			c.FluxBlock = big.NewInt(150)
+			c.DifficultyForkGrace, c.DifficultyForkGraceBlock = grace, big.NewInt(0)
+		})
+
+		parent := headers[number]
+		return CalcDifficulty(newTestChainReader(config, headers), parent.Time+120, parent)
+	}
+	tests := []struct {
+		number  uint64
+		relaxed bool
+	}{
+		{149, false}, // last DigiShield V3 mod block, whose fork at genesis has no grace
+		{150, true},  // first Flux block
+		{159, true},  // last block within the grace period
+		{160, false}, // first block after the grace period
+	}
+	for _, tt := range tests {
+		strict, graced := difficulty(0, tt.number), difficulty(10, tt.number)
+		if relaxed := graced.Cmp(strict) < 0; relaxed != tt.relaxed || (!relaxed && graced.Cmp(strict) != 0) {
+			t.Errorf("parent %d: difficulty mismatch: graced %v, strict %v, want relaxed %v", tt.number, graced, strict, tt.relaxed)
+		}
+	}
+	// Ensure the relaxed Flux bound is the widened 2% decrease
+	window := big.NewInt(88 * 88)
+	want := new(big.Int).Mul(genesis.Difficulty, window)
+	want.Div(want, new(big.Int).Div(new(big.Int).Mul(window, big.NewInt(1020)), big.NewInt(1000)))
+	if have := difficulty(10, 150); have.Cmp(want) != 0 {
+		t.Errorf("relaxed difficulty mismatch: have %v, want %v", have, want)
+	}
+	// Ensure the grace period only applies from its own fork block on
+	config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.FluxBlock = big.NewInt(150)
+		c.DifficultyForkGrace, c.DifficultyForkGraceBlock = 10, big.NewInt(155)
+	})
+	chain := newTestChainReader(config, headers)
+	if have, want := CalcDifficulty(chain, headers[153].Time+120, headers[153]), difficulty(0, 153); have.Cmp(want) != 0 {
+		t.Errorf("difficulty relaxed before grace fork: have %v, want %v", have, want)
+	}
+	if have, want := CalcDifficulty(chain, headers[154].Time+120, headers[154]), difficulty(10, 154); have.Cmp(want) != 0 {
+		t.Errorf("difficulty not relaxed after grace fork: have %v, want %v", have, want)
+	}
+	// Ensure the audited retarget mirrors the relaxed bounds
+	if r := Flux.retargetAt(chain, headers[154].Time+120, headers[154], big88); r == nil || r.clamp != RetargetMaxDecrease {
+		t.Errorf("audited retarget mismatch: %+v", r)
+	} else if relaxed := maxActualTimespan(fluxConfig.relaxed(), big88, false); r.clamped.Cmp(relaxed) != 0 {
+		t.Errorf("audited clamp mismatch: have %v, want %v", r.clamped, relaxed)
+	}
+}
+
+// Tests that the total issuance matches the block rewards summed block by block,
+// and that a proposed earlier step down issues less than the current policy.
+func TestCompareIssuance(t *testing.T) {
+	current := &params.UbqhashConfig{
+		MonetaryPolicy: []params.UbqhashMPStep{
+			{Block: big.NewInt(0), Reward: big.NewInt(8e18)},
+			{Block: big.NewInt(100), Reward: big.NewInt(7e18)},
+			{Block: big.NewInt(150), Reward: big.NewInt(6e18)},
+		},
+		LaunchBonusBlocks: 20,
+		LaunchBonusFactor: 15000,
+		LaunchBonusBlock:  big.NewInt(0),
+	}
+	proposed := &params.UbqhashConfig{
+		MonetaryPolicy: []params.UbqhashMPStep{
+			{Block: big.NewInt(0), Reward: big.NewInt(8e18)},
+			{Block: big.NewInt(50), Reward: big.NewInt(6e18)},
+		},
+		LaunchBonusBlocks: 20,
+		LaunchBonusFactor: 15000,
+		LaunchBonusBlock:  big.NewInt(30),
+	}
+	upTo := big.NewInt(200)
+
+	currentTotal, proposedTotal := CompareIssuance(current, proposed, upTo)
+	for _, tt := range []struct {
+		config *params.UbqhashConfig
+		total  *big.Int
+	}{{current, currentTotal}, {proposed, proposedTotal}} {
+		want := new(big.Int)
+		for n := int64(1); n <= upTo.Int64(); n++ {
+			_, reward := CalcBaseBlockReward(tt.config, big.NewInt(n))
+			want.Add(want, CalcLaunchBlockReward(tt.config, big.NewInt(n), reward))
+		}
+		if tt.total.Cmp(want) != 0 {
+			t.Errorf("issuance mismatch: have %v, want %v", tt.total, want)
+		}
+	}
+	if proposedTotal.Cmp(currentTotal) >= 0 {
+		t.Errorf("proposed policy not issuing less: proposed %v, current %v", proposedTotal, currentTotal)
+	}
+	if total := TotalIssuance(current, new(big.Int)); total.Sign() != 0 {
+		t.Errorf("issuance before the first block: have %v, want 0", total)
+	}
+}
+
+// Tests that preparing a header on a missing parent clears its difficulty, making
+// a subsequent verification fail instead of accepting a stale value.
+func TestPrepareMissingParent(t *testing.T) {
+	ubqhash := NewFaker()
+
+	parent := &types.Header{Number: big.NewInt(1), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(2), Time: parent.Time + 88, Difficulty: parent.Difficulty, GasLimit: parent.GasLimit}
+
+	chain := newTestChainReader(params.TestChainConfig, nil)
+	if err := ubqhash.Prepare(chain, header); err != consensus.ErrUnknownAncestor {
+		t.Fatalf("prepare error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+	if header.Difficulty != nil {
+		t.Fatalf("difficulty set without parent: %v", header.Difficulty)
+	}
+	if err := ubqhash.verifyHeader(newTestChainReader(params.TestChainConfig, []*types.Header{parent}), header, parent, false, false); err != errInvalidDifficulty {
+		t.Errorf("verification error mismatch: have %v, want %v", err, errInvalidDifficulty)
+	}
+}
+
+// Tests that the difficulty over a range of candidate timestamps changes where
+// Flux's dampening thresholds are crossed, and only there.
+func TestDifficultyForTimeRange(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	// Mine consistently slow blocks, making the retarget hit the decrease bound
+	parent := genesis
+	for i := 1; i <= 100; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 120, Difficulty: parent.Difficulty}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	times := []uint64{parent.Time + 10, parent.Time + 43, parent.Time + 44, parent.Time + 60, parent.Time + 300}
+	diffs := DifficultyForTimeRange(chain, parent, times)
+	if len(diffs) != len(times) {
+		t.Fatalf("difficulty count mismatch: have %d, want %d", len(diffs), len(times))
+	}
+	for i, time := range times {
+		if want := CalcDifficulty(chain, time, parent); diffs[i].Cmp(want) != 0 {
+			t.Errorf("time +%d: difficulty mismatch: have %v, want %v", time-parent.Time, diffs[i], want)
+		}
+	}
+	// Blocks within half the target block time are dampened to a smaller decrease
+	if diffs[0].Cmp(diffs[1]) != 0 || diffs[2].Cmp(diffs[3]) != 0 || diffs[3].Cmp(diffs[4]) != 0 {
+		t.Errorf("difficulty changed within a dampening range: %v", diffs)
+	}
+	if diffs[1].Cmp(diffs[2]) <= 0 {
+		t.Errorf("dampening threshold not crossed: %v at +43, %v at +44", diffs[1], diffs[2])
+	}
+}
+
+// Tests that a chain reader failing to provide past median times makes both
+// difficulty algorithms keep the parent's difficulty instead of panicking.
+func TestNilMedianTime(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072)}
+	parent := &types.Header{Number: big.NewInt(200), Time: 1000000 + 200*88, Difficulty: big.NewInt(1000000000)}
+
+	digishield := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+		c.FluxBlock = big.NewInt(1000)
+	})
+
+	for _, config := range []*params.ChainConfig{params.TestChainConfig, digishield} {
+		chain := &medianTimeChainReader{
+			ChainHeaderReader: newTestChainReader(config, []*types.Header{genesis}),
+			medianTime:        func(number uint64, parent *types.Header) *big.Int { return nil },
+		}
+		algo := difficultyAlgorithmAt(config.Ubqhash, parent.Number)
+		if have := CalcDifficulty(chain, parent.Time+88, parent); have.Cmp(parent.Difficulty) != 0 {
+			t.Errorf("algorithm %d: difficulty mismatch: have %v, want %v", algo, have, parent.Difficulty)
+		}
+		if r := algo.retargetAt(chain, parent.Time+88, parent, big88); r != nil {
+			t.Errorf("algorithm %d: retarget without median times: %+v", algo, r)
+		}
+	}
+}
+
+// Tests that a run of backward-then-forward timestamp swings is flagged as a
+// time-warp attempt, while the variance of a normal chain is not.
+func TestDetectTimeWarp(t *testing.T) {
+	build := func(blockTimes []uint64) *testChainReader {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072)}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+		parent := genesis
+		for i, blockTime := range blockTimes {
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i + 1)), Time: parent.Time + blockTime, Difficulty: parent.Difficulty}
+			chain.headers[header.Number.Uint64()] = header
+			parent = header
+		}
+		return chain
+	}
+	normal := make([]uint64, 60)
+	for i := range normal {
+		normal[i] = 60 + uint64(i*37%60)
+	}
+	// A single quick block followed by a slow one happens naturally
+	natural := append(append([]uint64{}, normal[:30]...), append([]uint64{5, 300, 5, 88}, normal[30:]...)...)
+	warped := append(append([]uint64{}, normal[:30]...), append([]uint64{1, 400, 1, 400, 1, 400}, normal[30:]...)...)
+
+	tests := []struct {
+		name       string
+		blockTimes []uint64
+		flagged    bool
+	}{
+		{"normal", normal, false},
+		{"natural", natural, false},
+		{"warped", warped, true},
+	}
+	for _, tt := range tests {
+		chain := build(tt.blockTimes)
+		if flagged := DetectTimeWarp(chain, 0, uint64(len(tt.blockTimes))); flagged != tt.flagged {
+			t.Errorf("%s: detection mismatch: have %v, want %v", tt.name, flagged, tt.flagged)
+		}
+	}
+	// Ranges ending before the warp completes must not be flagged
+	if DetectTimeWarp(build(warped), 0, 34) {
+		t.Errorf("incomplete warp flagged")
+	}
+}
+
+// Tests that the block time implied by a difficulty change is below the target
+// for an increase, above it for a decrease, and at it if unchanged.
+func TestImpliedBlockTime(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 100; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, Difficulty: parent.Difficulty}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+	imply := func(difficulty int64) float64 {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(101), Time: parent.Time + 88, Difficulty: big.NewInt(difficulty)}
+		return ImpliedBlockTime(chain, header)
+	}
+	if blockTime := imply(1000000); blockTime < 87.99 || blockTime > 88.01 {
+		t.Errorf("unchanged difficulty implied block time mismatch: have %v, want 88", blockTime)
+	}
+	// A 0.2% increase scales the timespan by 1/1.002, undamped four times over
+	if blockTime := imply(1002000); blockTime >= 88 || blockTime < 87.2 {
+		t.Errorf("increased difficulty implied block time mismatch: have %v, want just below 88", blockTime)
+	}
+	if blockTime := imply(998000); blockTime <= 88 {
+		t.Errorf("decreased difficulty implied block time mismatch: have %v, want above 88", blockTime)
+	}
+	// Difficulties not produced by a retarget imply nothing
+	if blockTime := ImpliedBlockTime(chain, chain.headers[50]); blockTime != 0 {
+		t.Errorf("pre-window implied block time mismatch: have %v, want 0", blockTime)
+	}
+}
+
+// Tests that uncles within the ancestry window are still rejected if their
+// timestamp is further behind the including block's than the maximum uncle age.
+func TestMaxUncleAge(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+	builder := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	headers := []*types.Header{genesis}
+	for i := 1; i <= 3; i++ {
+		parent := headers[i-1]
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+		header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+		builder.headers[header.Number.Uint64()] = header
+		builder.hashes[header.Hash()] = header
+		headers = append(headers, header)
+	}
+	blocks := make([]*types.Block, len(headers))
+	for i, header := range headers {
+		blocks[i] = types.NewBlockWithHeader(header)
+	}
+	chain := newTestBlockChainReader(params.TestChainConfig, blocks)
+
+	// Include an uncle of block 2, 174 seconds older than the including block
+	uncle := &types.Header{ParentHash: headers[1].Hash(), Number: big.NewInt(2), Time: headers[1].Time + 90, GasLimit: headers[1].GasLimit, Coinbase: common.HexToAddress("0x01")}
+	uncle.Difficulty = CalcDifficulty(chain, uncle.Time, headers[1])
+
+	header := &types.Header{ParentHash: headers[3].Hash(), Number: big.NewInt(4), Time: headers[3].Time + 88}
+	block := types.NewBlockWithHeader(header).WithBody(nil, []*types.Header{uncle})
+
+	tests := []struct {
+		maxAge uint64
+		fork   int64
+		err    error
+	}{
+		{0, 0, nil},
+		{200, 0, nil},
+		{174, 0, nil},
+		{173, 0, errStaleUncle},
+		{173, 4, errStaleUncle},
+		{173, 5, nil}, // limit not yet active
+	}
+	for _, tt := range tests {
+		config := testUbqhashConfig(params.TestChainConfig, func(c *params.UbqhashConfig) {
+			c.MaxUncleAge, c.MaxUncleAgeBlock = tt.maxAge, big.NewInt(tt.fork)
+		})
+		chain := newTestBlockChainReader(config, blocks)
+
+		if err := NewFaker().VerifyUncles(chain, block); err != tt.err {
+			t.Errorf("max age %d at %d: error mismatch: have %v, want %v", tt.maxAge, tt.fork, err, tt.err)
+		}
+	}
+}
+
+// Tests that a registered external difficulty algorithm replaces the built-in ones
+// if selected by a test engine, but never in a production engine.
+func TestRegisterDifficultyAlgorithm(t *testing.T) {
+	constant := big.NewInt(123456789)
+	RegisterDifficultyAlgorithm("constant", func(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int {
+		return new(big.Int).Set(constant)
+	})
+	defer RegisterDifficultyAlgorithm("constant", nil)
+
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072)}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+	builtin := CalcDifficulty(chain, genesis.Time+88, genesis)
+
+	tests := []struct {
+		mode      Mode
+		algorithm string
+		want      *big.Int
+	}{
+		{ModeFake, "constant", constant},
+		{ModeTest, "constant", constant},
+		{ModeFake, "", builtin},
+		{ModeFake, "unknown", builtin},
+		{ModeNormal, "constant", builtin},
+		{ModeShared, "constant", builtin},
+	}
+	for i, tt := range tests {
+		ubqhash := &Ubqhash{config: Config{PowMode: tt.mode, ExternalDifficultyAlgorithm: tt.algorithm}}
+		if diff := ubqhash.CalcDifficulty(chain, genesis.Time+88, genesis); diff.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: difficulty mismatch: have %v, want %v", i, diff, tt.want)
+		}
+	}
+}
+
+// Tests that detailed header verification warns about a difficulty pinned at the
+// minimum floor without rejecting the header.
+func TestVerifyHeaderDetailed(t *testing.T) {
+	for i, difficulty := range []*big.Int{params.MinimumDifficulty, big.NewInt(1000000)} {
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: difficulty, GasLimit: params.GenesisGasLimit}
+		chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+		header := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: genesis.Time + 88, GasLimit: genesis.GasLimit}
+		header.Difficulty = CalcDifficulty(chain, header.Time, genesis)
+
+		warnings, err := NewFaker().VerifyHeaderDetailed(chain, header, false)
+		if err != nil {
+			t.Fatalf("test %d: failed to verify header: %v", i, err)
+		}
+		floored := difficulty.Cmp(params.MinimumDifficulty) == 0
+		if floored && (len(warnings) != 1 || !strings.Contains(warnings[0], "minimum floor")) {
+			t.Errorf("test %d: warnings mismatch: have %q, want minimum floor", i, warnings)
+		}
+		if !floored && len(warnings) != 0 {
+			t.Errorf("test %d: unexpected warnings: %q", i, warnings)
+		}
+	}
+	// Invalid headers report the error only
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: params.MinimumDifficulty, GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	header := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Time: genesis.Time, GasLimit: genesis.GasLimit, Difficulty: params.MinimumDifficulty}
+	if warnings, err := NewFaker().VerifyHeaderDetailed(chain, header, false); err != errZeroBlockTime || warnings != nil {
+		t.Errorf("invalid header result mismatch: have %q, %v, want none, %v", warnings, err, errZeroBlockTime)
+	}
+}
+
+// Tests that the total issuance of a block equals the sum of every credit made
+// when accumulating its rewards.
+func TestTotalBlockIssuance(t *testing.T) {
+	var (
+		miner  = common.HexToAddress("0x01")
+		uncle1 = common.HexToAddress("0x02")
+		uncle2 = common.HexToAddress("0x03")
+	)
+	for _, number := range []int64{1000, 1100000, 3000000} {
+		header := &types.Header{Number: big.NewInt(number), Coinbase: miner}
+		uncles := []*types.Header{
+			{Number: big.NewInt(number - 1), Coinbase: uncle1},
+			{Number: big.NewInt(number - 1), Coinbase: uncle2},
+		}
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		accumulateRewards(params.MainnetChainConfig, statedb, header, uncles)
+
+		credited := new(big.Int)
+		for _, addr := range []common.Address{miner, uncle1, uncle2} {
+			credited.Add(credited, statedb.GetBalance(addr))
+		}
+		if statedb.GetBalance(uncle2).Sign() == 0 {
+			t.Errorf("block %d: second uncle not rewarded", number)
+		}
+		if total := TotalBlockIssuance(params.MainnetChainConfig, header, uncles); total.Cmp(credited) != 0 {
+			t.Errorf("block %d: issuance mismatch: have %v, want %v", number, total, credited)
+		}
+	}
+}
+
+// Tests that past the lenient uncle seal fork, an uncle with an invalid seal no
+// longer invalidates the including block, but is denied its reward.
+func TestLenientUncleSeal(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		config := testUbqhashConfig(params.MainnetChainConfig, nil)
+		if lenient {
+			config.Ubqhash.LenientUncleSealBlock = big.NewInt(4)
+		}
+		genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(131072), GasLimit: params.GenesisGasLimit}
+		builder := newTestChainReader(config, []*types.Header{genesis})
+
+		headers := []*types.Header{genesis}
+		for i := 1; i <= 3; i++ {
+			parent := headers[i-1]
+			header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 88, GasLimit: parent.GasLimit}
+			header.Difficulty = CalcDifficulty(builder, header.Time, parent)
+
+			builder.headers[header.Number.Uint64()] = header
+			builder.hashes[header.Hash()] = header
+			headers = append(headers, header)
+		}
+		blocks := make([]*types.Block, len(headers))
+		for i, header := range headers {
+			blocks[i] = types.NewBlockWithHeader(header)
+		}
+		chain := newTestBlockChainReader(config, blocks)
+
+		// Include an uncle of block 3, whose seal the engine fails
+		miner, uncleMiner := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+		uncle := &types.Header{ParentHash: headers[2].Hash(), Number: big.NewInt(3), Time: headers[2].Time + 90, GasLimit: headers[2].GasLimit, Coinbase: uncleMiner}
+		uncle.Difficulty = CalcDifficulty(chain, uncle.Time, headers[2])
+
+		header := &types.Header{ParentHash: headers[3].Hash(), Number: big.NewInt(4), Time: headers[3].Time + 88, Coinbase: miner}
+		block := types.NewBlockWithHeader(header).WithBody(nil, []*types.Header{uncle})
+
+		ubqhash := NewFakeFailer(3)
+		err := ubqhash.VerifyUncles(chain, block)
+		if !lenient {
+			if err != errInvalidPoW {
+				t.Errorf("strict: error mismatch: have %v, want %v", err, errInvalidPoW)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("lenient: failed to verify uncles: %v", err)
+		}
+		// The seal outcome of VerifyUncles must be reused when settling rewards,
+		// even though verifying the seal again would now pass
+		ubqhash.config.FakeFail = 0
+
+		// Assembling and importing the block must come to the same state
+		assembled := types.CopyHeader(header)
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		if _, err := ubqhash.FinalizeAndAssemble(chain, assembled, statedb, nil, []*types.Header{uncle}, nil); err != nil {
+			t.Fatalf("lenient: failed to assemble block: %v", err)
+		}
+		statedb, _ = state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		ubqhash.Finalize(chain, header, statedb, nil, []*types.Header{uncle})
+
+		if assembled.Root != header.Root {
+			t.Errorf("lenient: state root mismatch: assembled %x, imported %x", assembled.Root, header.Root)
+		}
+		if balance := statedb.GetBalance(uncleMiner); balance.Sign() != 0 {
+			t.Errorf("lenient: invalid uncle rewarded with %v", balance)
+		}
+		if _, ok := ubqhash.uncleDecision(block.Hash(), false); ok {
+			t.Errorf("lenient: uncle decision retained after import")
+		}
+		if have, want := statedb.GetBalance(miner), NetMinerReward(config, header, nil); have.Sign() == 0 || have.Cmp(want) != 0 {
+			t.Errorf("lenient: miner reward mismatch: have %v, want %v", have, want)
+		}
+		// A trusted checkpoint skipping the uncle checks must come to the same state
+		trusted := NewFakeFailer(3)
+		trusted.config.TrustedCheckpoint = header.Number.Uint64()
+		if err := trusted.VerifyUncles(chain, block); err != nil {
+			t.Fatalf("trusted: failed to verify uncles: %v", err)
+		}
+		checkpointed := types.CopyHeader(header)
+		statedb, _ = state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		trusted.Finalize(chain, checkpointed, statedb, nil, []*types.Header{uncle})
+		if checkpointed.Root != header.Root {
+			t.Errorf("trusted: state root mismatch: have %x, want %x", checkpointed.Root, header.Root)
+		}
+		// Uncles with valid seals are still rewarded
+		statedb, _ = state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		NewFaker().Finalize(chain, header, statedb, nil, []*types.Header{uncle})
+		if balance := statedb.GetBalance(uncleMiner); balance.Sign() == 0 {
+			t.Errorf("lenient: valid uncle not rewarded")
+		}
+	}
+}
+
+// Tests that uncle reward decisions of blocks never finalized are dropped once
+// the chain has moved on.
+func TestUncleDecisionPruning(t *testing.T) {
+	ubqhash := NewFaker()
+
+	old, recent := common.HexToHash("0x01"), common.HexToHash("0x02")
+	ubqhash.recordUncleDecision(old, 1, nil)
+	ubqhash.recordUncleDecision(recent, 1+uncleDecisionDepth, nil)
+	if _, ok := ubqhash.uncleDecision(old, false); !ok {
+		t.Errorf("decision within depth dropped")
+	}
+	ubqhash.recordUncleDecision(common.HexToHash("0x03"), 2+uncleDecisionDepth, nil)
+	if _, ok := ubqhash.uncleDecision(old, false); ok {
+		t.Errorf("decision beyond depth retained")
+	}
+	if _, ok := ubqhash.uncleDecision(recent, true); !ok {
+		t.Errorf("recent decision dropped")
+	}
+	if _, ok := ubqhash.uncleDecision(recent, false); ok {
+		t.Errorf("consumed decision retained")
+	}
+}
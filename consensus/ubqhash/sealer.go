@@ -28,6 +28,7 @@ import (
 	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ubiq/go-ubiq/v5/common"
@@ -39,11 +40,20 @@ import (
 const (
 	// staleThreshold is the maximum depth of the acceptable stale but valid ubqhash solution.
 	staleThreshold = 7
+
+	// uncleDecisionDepth is the number of blocks an uncle reward decision is kept
+	// for while its block isn't finalized.
+	uncleDecisionDepth = 64
+
+	// closeVerifyTimeout is how long closing the engine waits for the header
+	// verifications in flight to finish.
+	closeVerifyTimeout = 5 * time.Second
 )
 
 var (
 	errNoMiningWork      = errors.New("no mining work available yet")
 	errInvalidSealResult = errors.New("invalid or stale proof-of-work solution")
+	errNoSolutionFound   = errors.New("no proof-of-work solution found within nonce attempts")
 )
 
 // Seal implements consensus.Engine, attempting to find a nonce that satisfies
@@ -77,6 +87,9 @@ func (ubqhash *Ubqhash) Seal(chain consensus.ChainHeaderReader, block *types.Blo
 		}
 		ubqhash.rand = rand.New(rand.NewSource(seed.Int64()))
 	}
+	if ubqhash.sealing++; ubqhash.sealing == 1 {
+		ubqhash.since = time.Now()
+	}
 	ubqhash.lock.Unlock()
 	if threads == 0 {
 		threads = runtime.NumCPU()
@@ -84,19 +97,26 @@ func (ubqhash *Ubqhash) Seal(chain consensus.ChainHeaderReader, block *types.Blo
 	if threads < 0 {
 		threads = 0 // Allows disabling local mining without extra logic around local/remote
 	}
+	// Derive the seal hash by the rules of the chain the block is sealed for
+	sealHash := ubqhash.sealHashAt(ubqhash.chainConfig(chain), block.Header())
+
 	// Push new work to remote sealer
 	if ubqhash.remote != nil {
-		ubqhash.remote.workCh <- &sealTask{block: block, results: results}
+		ubqhash.remote.workCh <- &sealTask{block: block, sealHash: sealHash, results: results}
 	}
 	var (
-		pend   sync.WaitGroup
-		locals = make(chan *types.Block)
+		pend      sync.WaitGroup
+		locals    = make(chan *types.Block)
+		exhausted = make(chan struct{})
+		searching = int32(threads)
 	)
 	for i := 0; i < threads; i++ {
 		pend.Add(1)
 		go func(id int, nonce uint64) {
 			defer pend.Done()
-			ubqhash.mine(block, id, nonce, abort, locals)
+			if err := ubqhash.mine(block, sealHash, id, nonce, abort, locals); err == errNoSolutionFound && atomic.AddInt32(&searching, -1) == 0 {
+				close(exhausted)
+			}
 		}(i, uint64(ubqhash.rand.Int63()))
 	}
 	// Wait until sealing is terminated or a nonce is found
@@ -111,9 +131,16 @@ func (ubqhash *Ubqhash) Seal(chain consensus.ChainHeaderReader, block *types.Blo
 			select {
 			case results <- result:
 			default:
-				ubqhash.config.Log.Warn("Sealing result is not read by miner", "mode", "local", "sealhash", ubqhash.SealHash(block.Header()))
+				ubqhash.config.Log.Warn("Sealing result is not read by miner", "mode", "local", "sealhash", sealHash)
 			}
 			close(abort)
+		case <-exhausted:
+			// All threads used up their nonce attempts, give up
+			ubqhash.config.Log.Warn("Failed to seal block", "sealhash", sealHash, "err", errNoSolutionFound)
+			close(abort)
+			if failed := ubqhash.config.OnSealFailed; failed != nil {
+				failed(block, errNoSolutionFound)
+			}
 		case <-ubqhash.update:
 			// Thread count was changed on user request, restart
 			close(abort)
@@ -123,18 +150,24 @@ func (ubqhash *Ubqhash) Seal(chain consensus.ChainHeaderReader, block *types.Blo
 		}
 		// Wait for all miners to terminate and return the block
 		pend.Wait()
+
+		ubqhash.lock.Lock()
+		ubqhash.sealing--
+		ubqhash.lock.Unlock()
 	}()
 	return nil
 }
 
 // mine is the actual proof-of-work miner that searches for a nonce starting from
-// seed that results in correct final block difficulty.
-func (ubqhash *Ubqhash) mine(block *types.Block, id int, seed uint64, abort chan struct{}, found chan *types.Block) {
+// seed that results in correct final block difficulty for the given seal hash. If
+// the configured number of nonce attempts is used up without finding one,
+// errNoSolutionFound is returned.
+func (ubqhash *Ubqhash) mine(block *types.Block, sealHash common.Hash, id int, seed uint64, abort chan struct{}, found chan *types.Block) (err error) {
 	// Extract some data from the header
 	var (
 		header  = block.Header()
-		hash    = ubqhash.SealHash(header).Bytes()
-		target  = new(big.Int).Div(two256, header.Difficulty)
+		hash    = sealHash.Bytes()
+		target  = new(big.Int).Div(two256, ubqhash.sealDifficulty(header.Difficulty))
 		number  = header.Number.Uint64()
 		dataset = ubqhash.dataset(number, false)
 	)
@@ -155,6 +188,13 @@ search:
 			break search
 
 		default:
+			// Give up if the nonce attempts are used up
+			if limit := ubqhash.config.MaxNonceAttempts; limit > 0 && nonce-seed >= limit {
+				logger.Trace("Ubqhash nonce search exhausted", "attempts", nonce-seed)
+				ubqhash.hashrate.Mark(attempts)
+				err = errNoSolutionFound
+				break search
+			}
 			// We don't have to update hash rate on every nonce, so update after after 2^X nonces
 			attempts++
 			if (attempts % (1 << 15)) == 0 {
@@ -184,11 +224,15 @@ search:
 	// Datasets are unmapped in a finalizer. Ensure that the dataset stays live
 	// during sealing so it's not unmapped while being read.
 	runtime.KeepAlive(dataset)
+	return err
 }
 
 // This is the timeout for HTTP requests to notify external miners.
 const remoteSealerTimeout = 1 * time.Second
 
+// This is how long submitted hash rates count by default without resubmission.
+const defaultHashrateTTL = 10 * time.Second
+
 type remoteSealer struct {
 	works        map[common.Hash]*types.Block
 	rates        map[common.Hash]hashrate
@@ -212,8 +256,9 @@ type remoteSealer struct {
 
 // sealTask wraps a seal block with relative result channel for remote sealer thread.
 type sealTask struct {
-	block   *types.Block
-	results chan<- *types.Block
+	block    *types.Block
+	sealHash common.Hash // Seal hash of the block by the rules of its chain
+	results  chan<- *types.Block
 }
 
 // mineResult wraps the pow solution parameters for the specified block.
@@ -279,7 +324,7 @@ func (s *remoteSealer) loop() {
 			// Update current work with new received block.
 			// Note same work can be past twice, happens when changing CPU threads.
 			s.results = work.results
-			s.makeWork(work.block)
+			s.makeWork(work.block, work.sealHash)
 			s.notifyWork()
 
 		case work := <-s.fetchWorkCh:
@@ -304,9 +349,12 @@ func (s *remoteSealer) loop() {
 			close(result.done)
 
 		case req := <-s.fetchRateCh:
-			// Gather all hash rate submitted by remote sealer.
+			// Gather all fresh hash rate submitted by remote sealer.
 			var total uint64
 			for _, rate := range s.rates {
+				if time.Since(rate.ping) > s.hashrateTTL() {
+					continue
+				}
 				// this could overflow
 				total += rate.rate
 			}
@@ -315,7 +363,7 @@ func (s *remoteSealer) loop() {
 		case <-ticker.C:
 			// Clear stale submitted hash rate.
 			for id, rate := range s.rates {
-				if time.Since(rate.ping) > 10*time.Second {
+				if time.Since(rate.ping) > s.hashrateTTL() {
 					delete(s.rates, id)
 				}
 			}
@@ -334,6 +382,14 @@ func (s *remoteSealer) loop() {
 	}
 }
 
+// hashrateTTL returns how long submitted hash rates are considered fresh.
+func (s *remoteSealer) hashrateTTL() time.Duration {
+	if ttl := s.ubqhash.config.HashrateTTL; ttl > 0 {
+		return ttl
+	}
+	return defaultHashrateTTL
+}
+
 // makeWork creates a work package for external miner.
 //
 // The work package consists of 3 strings:
@@ -341,11 +397,10 @@ func (s *remoteSealer) loop() {
 //   result[1], 32 bytes hex encoded seed hash used for DAG
 //   result[2], 32 bytes hex encoded boundary condition ("target"), 2^256/difficulty
 //   result[3], hex encoded block number
-func (s *remoteSealer) makeWork(block *types.Block) {
-	hash := s.ubqhash.SealHash(block.Header())
+func (s *remoteSealer) makeWork(block *types.Block, hash common.Hash) {
 	s.currentWork[0] = hash.Hex()
 	s.currentWork[1] = common.BytesToHash(SeedHash(block.NumberU64())).Hex()
-	s.currentWork[2] = common.BytesToHash(new(big.Int).Div(two256, block.Difficulty()).Bytes()).Hex()
+	s.currentWork[2] = TargetHex(s.ubqhash.sealDifficulty(block.Difficulty()))
 	s.currentWork[3] = hexutil.EncodeBig(block.Number())
 
 	// Trace the seal work fetched by remote sealer.
@@ -353,6 +408,66 @@ func (s *remoteSealer) makeWork(block *types.Block) {
 	s.works[hash] = block
 }
 
+// MaxTarget returns 2^256, the numerator all PoW boundaries derive from. A seal
+// is valid for a difficulty if its hashimoto result, read as a big-endian number,
+// doesn't exceed MaxTarget divided by the difficulty.
+func MaxTarget() *big.Int {
+	return new(big.Int).Set(two256)
+}
+
+// DifficultyToTarget returns the PoW boundary for the given difficulty, i.e.
+// 2^256/difficulty. A non-positive difficulty has no valid target and yields nil.
+func DifficultyToTarget(difficulty *big.Int) *big.Int {
+	if difficulty == nil || difficulty.Sign() <= 0 {
+		return nil
+	}
+	return new(big.Int).Div(two256, difficulty)
+}
+
+// TargetHex returns the PoW boundary for the given difficulty (2^256/difficulty)
+// as a 0x-prefixed, zero-padded 32 byte big-endian hex string, the format remote
+// miners expect it in. A difficulty of 1 yields the largest 256 bit target, while
+// a non-positive difficulty has no valid target and yields an empty string.
+func TargetHex(difficulty *big.Int) string {
+	target := DifficultyToTarget(difficulty)
+	if target == nil {
+		return ""
+	}
+	if target.Cmp(two256) == 0 {
+		target.Sub(target, common.Big1)
+	}
+	return common.BytesToHash(target.Bytes()).Hex()
+}
+
+// ExpectedAttempts returns the expected number of hashes needed to find a seal
+// for the given difficulty, i.e. 2^256 divided by its PoW boundary, which is the
+// difficulty itself save for rounding. A non-positive difficulty yields zero.
+func ExpectedAttempts(difficulty *big.Int) *big.Int {
+	target := DifficultyToTarget(difficulty)
+	if target == nil {
+		return new(big.Int)
+	}
+	return target.Div(two256, target)
+}
+
+// ExpectedTimeToBlock returns the expected time a miner with the given hashrate,
+// in hashes per second, needs to find a seal for the given difficulty. Without a
+// positive hashrate no block is ever found, which is reported as the largest
+// representable duration, time.Duration(math.MaxInt64), as are times exceeding
+// it. Given a hashrate, a non-positive difficulty has no valid seal and yields
+// zero.
+func ExpectedTimeToBlock(difficulty *big.Int, hashrate *big.Int) time.Duration {
+	if hashrate == nil || hashrate.Sign() <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	nanos := new(big.Int).Mul(ExpectedAttempts(difficulty), big.NewInt(int64(time.Second)))
+	nanos.Div(nanos, hashrate)
+	if !nanos.IsInt64() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(nanos.Int64())
+}
+
 // notifyWork notifies all the specified mining endpoints of the availability of
 // new work to be processed.
 func (s *remoteSealer) notifyWork() {
@@ -407,7 +522,7 @@ func (s *remoteSealer) submitWork(nonce types.BlockNonce, mixDigest common.Hash,
 
 	start := time.Now()
 	if !s.noverify {
-		if err := s.ubqhash.verifySeal(nil, header, true); err != nil {
+		if err := s.ubqhash.verifyPoW(header, sealhash, header.Difficulty, true); err != nil {
 			s.ubqhash.config.Log.Warn("Invalid proof-of-work submitted", "sealhash", sealhash, "elapsed", common.PrettyDuration(time.Since(start)), "err", err)
 			return false
 		}
@@ -19,6 +19,7 @@ package ubqhash
 import (
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
@@ -202,3 +203,173 @@ func TestStaleSubmission(t *testing.T) {
 		}
 	}
 }
+
+// Tests that sealing at an impossible difficulty gives up once the nonce attempts
+// are used up instead of searching forever, reporting the failure to the caller.
+func TestMaxNonceAttempts(t *testing.T) {
+	failed := make(chan error, 1)
+
+	ubqhash := NewTester(nil, false)
+	ubqhash.config.MaxNonceAttempts = 1000
+	ubqhash.config.OnSealFailed = func(block *types.Block, err error) { failed <- err }
+	ubqhash.SetThreads(2)
+	defer ubqhash.Close()
+
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Difficulty: new(big.Int).Lsh(big.NewInt(1), 255)})
+	results := make(chan *types.Block)
+	if err := ubqhash.Seal(nil, block, results, nil); err != nil {
+		t.Fatalf("failed to start sealing: %v", err)
+	}
+	select {
+	case <-results:
+		t.Fatalf("block sealed at impossible difficulty")
+	case err := <-failed:
+		if err != errNoSolutionFound {
+			t.Errorf("exhausted search error mismatch: have %v, want %v", err, errNoSolutionFound)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sealing didn't give up after the nonce attempts")
+	}
+	// Solvable difficulties must still be sealed within the limit
+	block = types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(10)})
+	results = make(chan *types.Block, 1)
+	if err := ubqhash.Seal(nil, block, results, nil); err != nil {
+		t.Fatalf("failed to start sealing: %v", err)
+	}
+	select {
+	case result := <-results:
+		if err := ubqhash.VerifySeal(nil, result.Header()); err != nil {
+			t.Errorf("sealed block failed verification: %v", err)
+		}
+	case err := <-failed:
+		t.Fatalf("failed to seal solvable block: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sealing solvable block timed out")
+	}
+}
+
+// Tests that the maximum target is 2^256 and the target of the lowest difficulty.
+func TestMaxTarget(t *testing.T) {
+	want := new(big.Int).Lsh(big.NewInt(1), 256)
+	if have := MaxTarget(); have.Cmp(want) != 0 {
+		t.Errorf("max target mismatch: have %v, want %v", have, want)
+	}
+	if have := DifficultyToTarget(big.NewInt(1)); have.Cmp(MaxTarget()) != 0 {
+		t.Errorf("difficulty 1 target mismatch: have %v, want %v", have, MaxTarget())
+	}
+	// Ensure callers can't corrupt the constant
+	MaxTarget().SetInt64(0)
+	if two256.Cmp(want) != 0 {
+		t.Errorf("max target modified through the accessor: %v", two256)
+	}
+	if have := DifficultyToTarget(big.NewInt(0)); have != nil {
+		t.Errorf("zero difficulty target mismatch: have %v, want nil", have)
+	}
+}
+
+// Tests that PoW targets are rendered in the format remote miners expect.
+func TestTargetHex(t *testing.T) {
+	tests := []struct {
+		difficulty *big.Int
+		target     string
+	}{
+		{big.NewInt(1), "0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"},
+		{big.NewInt(2), "0x8000000000000000000000000000000000000000000000000000000000000000"},
+		{big.NewInt(1000000), "0x000010c6f7a0b5ed8d36b4c7f34938583621fafc8b0079a2834d26fa3fcc9ea9"},
+		{new(big.Int).Lsh(big.NewInt(1), 256), "0x0000000000000000000000000000000000000000000000000000000000000001"},
+		{big.NewInt(0), ""},
+		{big.NewInt(-1), ""},
+		{nil, ""},
+	}
+	for i, tt := range tests {
+		if have := TargetHex(tt.difficulty); have != tt.target {
+			t.Errorf("test %d: target mismatch: have %s, want %s", i, have, tt.target)
+		}
+	}
+}
+
+// Tests that the work package of a block of difficulty 1 carries the largest 256
+// bit target, rather than 2^256 truncated to zero.
+func TestWorkTargetMinimumDifficulty(t *testing.T) {
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	api := &API{ubqhash}
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1)})
+	ubqhash.Seal(nil, block, make(chan *types.Block), nil)
+
+	work, err := api.GetWork()
+	if err != nil {
+		t.Fatalf("failed to retrieve work: %v", err)
+	}
+	if want := "0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"; work[2] != want {
+		t.Errorf("work packet target mismatch: have %s, want %s", work[2], want)
+	}
+}
+
+// Tests that the expected hashing effort and block time are derived from the
+// difficulty, and that a missing hashrate is guarded against.
+func TestExpectedTimeToBlock(t *testing.T) {
+	tests := []struct {
+		difficulty *big.Int
+		hashrate   *big.Int
+		attempts   *big.Int
+		duration   time.Duration
+	}{
+		{big.NewInt(88000000000), big.NewInt(1000000000), big.NewInt(88000000000), 88 * time.Second},
+		{big.NewInt(88000000000), big.NewInt(4000000000), big.NewInt(88000000000), 22 * time.Second},
+		{big.NewInt(1), big.NewInt(2), big.NewInt(1), 500 * time.Millisecond},
+		{big.NewInt(88000000000), big.NewInt(0), big.NewInt(88000000000), time.Duration(math.MaxInt64)},
+		{big.NewInt(88000000000), big.NewInt(-1), big.NewInt(88000000000), time.Duration(math.MaxInt64)},
+		{big.NewInt(88000000000), nil, big.NewInt(88000000000), time.Duration(math.MaxInt64)},
+		{big.NewInt(0), big.NewInt(1000000000), big.NewInt(0), 0},
+		{new(big.Int).Lsh(common.Big1, 128), big.NewInt(1), new(big.Int).Lsh(common.Big1, 128), time.Duration(math.MaxInt64)},
+	}
+	for i, tt := range tests {
+		if attempts := ExpectedAttempts(tt.difficulty); attempts.Cmp(tt.attempts) != 0 {
+			t.Errorf("test %d: attempts mismatch: have %v, want %v", i, attempts, tt.attempts)
+		}
+		if duration := ExpectedTimeToBlock(tt.difficulty, tt.hashrate); duration != tt.duration {
+			t.Errorf("test %d: duration mismatch: have %v, want %v", i, duration, tt.duration)
+		}
+	}
+}
+
+// Tests that the sealing state is reported while a block is being sealed, and
+// cleared once sealing is stopped.
+func TestMiningState(t *testing.T) {
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	if ubqhash.IsMining() {
+		t.Fatalf("idle engine reports mining")
+	}
+	if since := ubqhash.MiningSince(); !since.IsZero() {
+		t.Fatalf("idle engine reports mining since %v", since)
+	}
+	// Start sealing a block that's practically impossible to seal
+	header := &types.Header{Number: big.NewInt(1), Difficulty: new(big.Int).Lsh(big.NewInt(1), 200)}
+	stop := make(chan struct{})
+
+	start := time.Now()
+	if err := ubqhash.Seal(nil, types.NewBlockWithHeader(header), make(chan *types.Block), stop); err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	if !ubqhash.IsMining() {
+		t.Errorf("sealing engine doesn't report mining")
+	}
+	if since := ubqhash.MiningSince(); since.Before(start) || since.After(time.Now()) {
+		t.Errorf("mining start time mismatch: have %v, want between %v and now", since, start)
+	}
+	// Stop sealing and ensure the state is cleared
+	close(stop)
+	for deadline := time.Now().Add(3 * time.Second); ubqhash.IsMining(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("engine still reports mining after stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if since := ubqhash.MiningSince(); !since.IsZero() {
+		t.Errorf("stopped engine reports mining since %v", since)
+	}
+}
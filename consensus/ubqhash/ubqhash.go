@@ -35,10 +35,15 @@ import (
 
 	mmap "github.com/edsrzf/mmap-go"
 	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/ubiq/go-ubiq/v5/common"
+	"github.com/ubiq/go-ubiq/v5/common/hexutil"
 	"github.com/ubiq/go-ubiq/v5/consensus"
+	"github.com/ubiq/go-ubiq/v5/core/types"
 	"github.com/ubiq/go-ubiq/v5/log"
 	"github.com/ubiq/go-ubiq/v5/metrics"
+	"github.com/ubiq/go-ubiq/v5/params"
 	"github.com/ubiq/go-ubiq/v5/rpc"
+	"golang.org/x/crypto/sha3"
 )
 
 var ErrInvalidDumpMagic = errors.New("invalid dump magic")
@@ -48,7 +53,7 @@ var (
 	two256 = new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
 
 	// sharedUbqhash is a full instance that can be shared between multiple users.
-	sharedUbqhash = New(Config{"", 3, 0, false, "", 1, 0, false, ModeNormal, nil}, nil, false)
+	sharedUbqhash = New(Config{CachesInMem: 3, DatasetsInMem: 1, PowMode: ModeNormal, ChainConfig: params.MainnetChainConfig.Ubqhash}, nil, false)
 
 	// algorithmRevision is the data structure version used for file naming.
 	algorithmRevision = 23
@@ -165,17 +170,44 @@ type lru struct {
 }
 
 // newlru create a new least-recently-used cache for either the verification caches
-// or the mining datasets.
-func newlru(what string, maxItems int, new func(epoch uint64) interface{}) *lru {
+// or the mining datasets, running evict, if set, for every epoch dropped.
+func newlru(what string, maxItems int, new func(epoch uint64) interface{}, evict func(epoch uint64)) *lru {
 	if maxItems <= 0 {
 		maxItems = 1
 	}
 	cache, _ := simplelru.NewLRU(maxItems, func(key, value interface{}) {
 		log.Trace("Evicted ubqhash "+what, "epoch", key)
+		if evict != nil {
+			evict(key.(uint64))
+		}
 	})
 	return &lru{what: what, new: new, cache: cache}
 }
 
+// purge drops all items, including the future one, leaving their resources to
+// be released by their finalizers once no longer in use.
+func (lru *lru) purge() {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.cache.Purge()
+	lru.future, lru.futureItem = 0, nil
+}
+
+// peek retrieves the item for the given epoch, without creating it if missing.
+func (lru *lru) peek(epoch uint64) interface{} {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	if item, ok := lru.cache.Peek(epoch); ok {
+		return item
+	}
+	if lru.future > 0 && lru.future == epoch {
+		return lru.futureItem
+	}
+	return nil
+}
+
 // get retrieves or creates an item for the given epoch. The first return value is always
 // non-nil. The second return value is non-nil if lru thinks that an item will be useful in
 // the near future.
@@ -296,8 +328,9 @@ func newDataset(epoch uint64) interface{} {
 	return &dataset{epoch: epoch}
 }
 
-// generate ensures that the dataset content is generated before use.
-func (d *dataset) generate(dir string, limit int, lock bool, test bool) {
+// generate ensures that the dataset content is generated before use, using the
+// given number of goroutines (0 = GOMAXPROCS).
+func (d *dataset) generate(dir string, limit int, lock bool, test bool, threads int) {
 	d.once.Do(func() {
 		// Mark the dataset generated after we're done. This is needed for remote
 		defer atomic.StoreUint32(&d.done, 1)
@@ -315,7 +348,7 @@ func (d *dataset) generate(dir string, limit int, lock bool, test bool) {
 			generateCache(cache, d.epoch, seed)
 
 			d.dataset = make([]uint32, dsize/4)
-			generateDataset(d.dataset, d.epoch, cache)
+			generateDataset(d.dataset, d.epoch, cache, threads)
 
 			return
 		}
@@ -344,12 +377,12 @@ func (d *dataset) generate(dir string, limit int, lock bool, test bool) {
 		cache := make([]uint32, csize/4)
 		generateCache(cache, d.epoch, seed)
 
-		d.dump, d.mmap, d.dataset, err = memoryMapAndGenerate(path, dsize, lock, func(buffer []uint32) { generateDataset(buffer, d.epoch, cache) })
+		d.dump, d.mmap, d.dataset, err = memoryMapAndGenerate(path, dsize, lock, func(buffer []uint32) { generateDataset(buffer, d.epoch, cache, threads) })
 		if err != nil {
 			logger.Error("Failed to generate mapped ubqhash dataset", "err", err)
 
 			d.dataset = make([]uint32, dsize/2)
-			generateDataset(d.dataset, d.epoch, cache)
+			generateDataset(d.dataset, d.epoch, cache, threads)
 		}
 		// Iterate over all previous instances and delete old ones
 		for ep := int(d.epoch) - limit; ep >= 0; ep-- {
@@ -385,7 +418,7 @@ func MakeCache(block uint64, dir string) {
 // MakeDataset generates a new ubqhash dataset and optionally stores it to disk.
 func MakeDataset(block uint64, dir string) {
 	d := dataset{epoch: block / epochLength}
-	d.generate(dir, math.MaxInt32, false, false)
+	d.generate(dir, math.MaxInt32, false, false, 0)
 }
 
 // Mode defines the type and amount of PoW verification an ubqhash engine makes.
@@ -399,6 +432,45 @@ const (
 	ModeFullFake
 )
 
+// String implements fmt.Stringer, returning the lowercase name of the mode.
+func (mode Mode) String() string {
+	switch mode {
+	case ModeNormal:
+		return "normal"
+	case ModeShared:
+		return "shared"
+	case ModeTest:
+		return "test"
+	case ModeFake:
+		return "fake"
+	case ModeFullFake:
+		return "fullfake"
+	default:
+		return "unknown"
+	}
+}
+
+// ModeInfo describes the semantics of a PoW mode, for tooling presenting the
+// available modes to users.
+type ModeInfo struct {
+	Mode          Mode
+	Name          string // Name of the mode, as returned by Mode.String
+	Description   string // Human readable summary of the mode
+	VerifiesSeals bool   // Whether block seals are checked against the difficulty
+	GeneratesDAGs bool   // Whether verification caches and mining datasets are generated
+}
+
+// SupportedModes returns the description of every PoW mode the engine supports.
+func SupportedModes() []ModeInfo {
+	return []ModeInfo{
+		{ModeNormal, ModeNormal.String(), "Full proof-of-work verification and mining", true, true},
+		{ModeShared, ModeShared.String(), "Verification through an engine shared across the process", true, true},
+		{ModeTest, ModeTest.String(), "Verification and mining on tiny test caches and datasets", true, true},
+		{ModeFake, ModeFake.String(), "Full header verification accepting any seal", false, false},
+		{ModeFullFake, ModeFullFake.String(), "No verification at all, accepting any header", false, false},
+	}
+}
+
 // Config are the configuration parameters of the ubqhash.
 type Config struct {
 	CacheDir         string
@@ -411,6 +483,126 @@ type Config struct {
 	DatasetsLockMmap bool
 	PowMode          Mode
 
+	// GenerationThreads is the number of goroutines generating a mining dataset
+	// (0 = GOMAXPROCS). Verification caches are inherently sequential to generate.
+	GenerationThreads int
+
+	// FutureBlockRetryTime is the extra tolerance past allowedFutureBlockTime
+	// within which future blocks are reported as retryable (0 = never).
+	FutureBlockRetryTime time.Duration
+
+	// FutureBoundaryInclusive makes headers timestamped exactly at the future
+	// block tolerance count as future blocks. By default only headers past the
+	// tolerance are.
+	FutureBoundaryInclusive bool
+
+	// StrictHeaderBatches makes batch header verification refuse batches whose
+	// block numbers don't form a contiguous increasing sequence up front, failing
+	// every header of the batch with an error identifying the gap.
+	StrictHeaderBatches bool
+
+	// ChainTimeMargin, if set, makes the future block check measure against the
+	// chain's own clock instead of the system one, for nodes with unreliable system
+	// clocks. The current time is then taken to be the past median time of the
+	// parent plus this margin, which has to cover the lag of the median behind the
+	// chain head (0 = use the system clock).
+	ChainTimeMargin time.Duration
+
+	// HashrateTTL is how long a hash rate submitted by a remote miner counts
+	// towards the reported hashrate without being resubmitted (0 = 10 seconds).
+	HashrateTTL time.Duration
+
+	// DifficultyDivisor scales down the difficulty the PoW seal is checked
+	// against in ModeTest, making local mining near-instant (0 or 1 = disabled).
+	DifficultyDivisor uint64
+
+	// MaxNonceAttempts limits the number of nonces each local mining thread tries
+	// for a block before giving up on sealing it, for tests and capped mining
+	// (0 = search until aborted).
+	MaxNonceAttempts uint64
+
+	// FixedTestDifficulty, if set, replaces the calculated difficulty of every
+	// block in ModeTest, sparing test chains the median time based retargeting.
+	FixedTestDifficulty *big.Int
+
+	// ExternalDifficultyAlgorithm names a difficulty algorithm registered through
+	// RegisterDifficultyAlgorithm that replaces the built-in ones, bypassing the
+	// fork selection, for experiments and simulations. It is only honoured in
+	// ModeTest and ModeFake; production engines always use the built-in algorithms.
+	ExternalDifficultyAlgorithm string
+
+	// ChainConfig is the ubqhash config of the chain the engine runs on, filled in
+	// by the node from the genesis. It selects the seal hash function for callers
+	// not supplying a chain, such as SealHash; verification and sealing use the
+	// config of the chain they're handed. New requires it, the testing and shared
+	// engines use the main network's.
+	ChainConfig *params.UbqhashConfig `toml:"-"`
+
+	// TrustedCheckpoint is the number of a block the chain is trusted up to, such
+	// as a fast sync checkpoint. The uncles of blocks at or below it are accepted
+	// without verification (0 = verify all uncles). It is purely a sync shortcut
+	// that only skips checks: uncle rewards are still settled on their verified
+	// seals, so a node with a checkpoint never rejects, nor derives a different
+	// state for, a block a node without one accepts.
+	TrustedCheckpoint uint64
+
+	// CheckBodyGasUsed makes VerifyHeaderWithBody flag blocks carrying transactions
+	// while claiming less gas used than a single plain transfer costs. The check is
+	// advisory and not part of consensus.
+	CheckBodyGasUsed bool
+
+	// OnHeaderRejected, if set, is invoked with every header that fails header
+	// verification and the reason it was rejected. It is not called in fake modes.
+	OnHeaderRejected func(header *types.Header, err error) `toml:"-"`
+
+	// ExtraDataValidator, if set, is invoked during header verification with the
+	// block number and extra-data of every header that passed the size check.
+	// Headers for which it returns an error are rejected.
+	//
+	// Note, the validator is a consensus rule local to this node. Unless every
+	// node of the network runs the same validator, a block it refuses splits the
+	// node off from the rest of the network, which keeps accepting it.
+	ExtraDataValidator func(number uint64, extra []byte) error `toml:"-"`
+
+	// CoinbaseValidator, if set, is invoked during header verification with the
+	// coinbase and block number of every header, uncles included, allowing chains
+	// to restrict mining to registered miners. Headers for which it returns an
+	// error are rejected.
+	//
+	// Note, like ExtraDataValidator, the validator is a consensus rule local to
+	// this node, which splits off from any network not running the same one.
+	CoinbaseValidator func(addr common.Address, number uint64) error `toml:"-"`
+
+	// MedianTimeFunc, if set, replaces the chain's past median time calculation
+	// in the engine's difficulty calculation and header checks, letting tests inject
+	// arbitrary median time series without assembling a full header chain.
+	MedianTimeFunc func(number uint64, parent *types.Header) *big.Int `toml:"-"`
+
+	// DifficultyAuditLog, if set, is invoked with the complete trail of every
+	// difficulty calculated by the engine, for audit logging.
+	DifficultyAuditLog func(record DifficultyAuditRecord) `toml:"-"`
+
+	// ParentProvider, if set, is asked for the parent of a header being verified
+	// before looking it up in the chain, letting callers that already hold the
+	// verified parent spare the database lookup. Returning nil, or a header not
+	// matching the requested hash and number, falls back to the chain.
+	ParentProvider func(hash common.Hash, number uint64) *types.Header `toml:"-"`
+
+	// OnRewardChange, if set, is invoked when finalizing the first block paying a
+	// different base block reward than its parent, such as at a monetary policy
+	// step down. It fires once per block number, even though blocks are finalized
+	// both while mining and on import.
+	OnRewardChange func(block *big.Int, oldReward, newReward *big.Int) `toml:"-"`
+
+	// OnSealFailed, if set, is invoked with blocks local sealing gave up on and the
+	// reason, such as every mining thread using up its MaxNonceAttempts, as Seal
+	// has already returned by then and no result will be delivered.
+	OnSealFailed func(block *types.Block, err error) `toml:"-"`
+
+	// The fields below are hooks for testing
+	FakeFail  uint64        `toml:"-"` // Block number which fails PoW check even in fake mode
+	FakeDelay time.Duration `toml:"-"` // Time delay to sleep for before returning from verify
+
 	Log log.Logger `toml:"-"`
 }
 
@@ -422,17 +614,29 @@ type Ubqhash struct {
 	caches   *lru // In memory caches to avoid regenerating too often
 	datasets *lru // In memory datasets to avoid regenerating too often
 
+	hotCache atomic.Value // Generated *cache of the last epoch verified, read without locking
+
 	// Mining related fields
 	rand     *rand.Rand    // Properly seeded random source for nonces
 	threads  int           // Number of threads to mine on if mining
 	update   chan struct{} // Notification channel to update mining parameters
 	hashrate metrics.Meter // Meter tracking the average hashrate
 	remote   *remoteSealer
+	sealing  int       // Number of sealing operations currently in progress
+	since    time.Time // Time the current streak of sealing operations started
+
+	uncleDecisions map[common.Hash]*uncleRewardDecision // Uncle reward decisions of verified blocks awaiting finalization
+	uncleLock      sync.Mutex                           // Ensures thread safety for the uncle reward decisions
+
+	rewardNotified uint64     // Number of the block the reward change hook last fired for
+	rewardLock     sync.Mutex // Ensures the reward change hook fires once per block number
+
+	quit      chan struct{}  // Closed when the engine is closed, aborting verification batches
+	verifiers sync.WaitGroup // Goroutines of the verification batches in flight
 
 	// The fields below are hooks for testing
-	shared    *Ubqhash      // Shared PoW verifier to avoid cache regeneration
-	fakeFail  uint64        // Block number which fails PoW check even in fake mode
-	fakeDelay time.Duration // Time delay to sleep for before returning from verify
+	shared *Ubqhash         // Shared PoW verifier to avoid cache regeneration
+	now    func() time.Time // Clock to check future blocks against, defaulting to time.Now
 
 	lock      sync.Mutex // Ensures thread safety for the in-memory caches and mining fields
 	closeOnce sync.Once  // Ensures exit channel will not be closed twice.
@@ -440,8 +644,12 @@ type Ubqhash struct {
 
 // New creates a full sized ubqhash PoW scheme and starts a background thread for
 // remote mining, also optionally notifying a batch of remote services of new work
-// packages.
+// packages. It panics if the config lacks the chain config, without which seal
+// hashes would silently follow the wrong rules.
 func New(config Config, notify []string, noverify bool) *Ubqhash {
+	if config.ChainConfig == nil {
+		panic("ubqhash: missing chain config")
+	}
 	if config.Log == nil {
 		config.Log = log.Root()
 	}
@@ -455,13 +663,20 @@ func New(config Config, notify []string, noverify bool) *Ubqhash {
 	if config.DatasetDir != "" && config.DatasetsOnDisk > 0 {
 		config.Log.Info("Disk storage enabled for ubqhash DAGs", "dir", config.DatasetDir, "count", config.DatasetsOnDisk)
 	}
+	if config.ExtraDataValidator != nil {
+		config.Log.Warn("Custom extra-data validation enabled, blocks it refuses split the node off the network")
+	}
+	if config.CoinbaseValidator != nil {
+		config.Log.Warn("Custom coinbase validation enabled, blocks it refuses split the node off the network")
+	}
 	ubqhash := &Ubqhash{
 		config:   config,
-		caches:   newlru("cache", config.CachesInMem, newCache),
-		datasets: newlru("dataset", config.DatasetsInMem, newDataset),
+		datasets: newlru("dataset", config.DatasetsInMem, newDataset, nil),
 		update:   make(chan struct{}),
 		hashrate: metrics.NewMeterForced(),
+		now:      time.Now,
 	}
+	ubqhash.caches = newlru("cache", config.CachesInMem, newCache, ubqhash.evictCache)
 	ubqhash.remote = startRemoteSealer(ubqhash, notify, noverify)
 	return ubqhash
 }
@@ -470,12 +685,13 @@ func New(config Config, notify []string, noverify bool) *Ubqhash {
 // purposes.
 func NewTester(notify []string, noverify bool) *Ubqhash {
 	ubqhash := &Ubqhash{
-		config:   Config{PowMode: ModeTest, Log: log.Root()},
-		caches:   newlru("cache", 1, newCache),
-		datasets: newlru("dataset", 1, newDataset),
+		config:   Config{PowMode: ModeTest, Log: log.Root(), ChainConfig: params.MainnetChainConfig.Ubqhash},
+		datasets: newlru("dataset", 1, newDataset, nil),
 		update:   make(chan struct{}),
 		hashrate: metrics.NewMeterForced(),
+		now:      time.Now,
 	}
+	ubqhash.caches = newlru("cache", 1, newCache, ubqhash.evictCache)
 	ubqhash.remote = startRemoteSealer(ubqhash, notify, noverify)
 	return ubqhash
 }
@@ -486,9 +702,11 @@ func NewTester(notify []string, noverify bool) *Ubqhash {
 func NewFaker() *Ubqhash {
 	return &Ubqhash{
 		config: Config{
-			PowMode: ModeFake,
-			Log:     log.Root(),
+			PowMode:     ModeFake,
+			Log:         log.Root(),
+			ChainConfig: params.MainnetChainConfig.Ubqhash,
 		},
+		now: time.Now,
 	}
 }
 
@@ -498,10 +716,12 @@ func NewFaker() *Ubqhash {
 func NewFakeFailer(fail uint64) *Ubqhash {
 	return &Ubqhash{
 		config: Config{
-			PowMode: ModeFake,
-			Log:     log.Root(),
+			PowMode:     ModeFake,
+			FakeFail:    fail,
+			Log:         log.Root(),
+			ChainConfig: params.MainnetChainConfig.Ubqhash,
 		},
-		fakeFail: fail,
+		now: time.Now,
 	}
 }
 
@@ -511,10 +731,12 @@ func NewFakeFailer(fail uint64) *Ubqhash {
 func NewFakeDelayer(delay time.Duration) *Ubqhash {
 	return &Ubqhash{
 		config: Config{
-			PowMode: ModeFake,
-			Log:     log.Root(),
+			PowMode:     ModeFake,
+			FakeDelay:   delay,
+			Log:         log.Root(),
+			ChainConfig: params.MainnetChainConfig.Ubqhash,
 		},
-		fakeDelay: delay,
+		now: time.Now,
 	}
 }
 
@@ -523,22 +745,50 @@ func NewFakeDelayer(delay time.Duration) *Ubqhash {
 func NewFullFaker() *Ubqhash {
 	return &Ubqhash{
 		config: Config{
-			PowMode: ModeFullFake,
-			Log:     log.Root(),
+			PowMode:     ModeFullFake,
+			Log:         log.Root(),
+			ChainConfig: params.MainnetChainConfig.Ubqhash,
 		},
+		now: time.Now,
 	}
 }
 
 // NewShared creates a full sized ubqhash PoW shared between all requesters running
 // in the same process.
 func NewShared() *Ubqhash {
-	return &Ubqhash{shared: sharedUbqhash}
+	return &Ubqhash{config: Config{ChainConfig: params.MainnetChainConfig.Ubqhash}, shared: sharedUbqhash, now: time.Now}
 }
 
 // Close closes the exit channel to notify all backend threads exiting.
 func (ubqhash *Ubqhash) Close() error {
 	var err error
 	ubqhash.closeOnce.Do(func() {
+		// Abort the verification batches in flight and wait for their workers
+		ubqhash.lock.Lock()
+		if ubqhash.quit == nil {
+			ubqhash.quit = make(chan struct{})
+		}
+		close(ubqhash.quit)
+		ubqhash.lock.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			ubqhash.verifiers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(closeVerifyTimeout):
+			log.Warn("Timed out waiting for header verification to finish")
+		}
+		// Drop the in-memory caches and datasets, unmapping them once unused
+		if ubqhash.caches != nil {
+			ubqhash.caches.purge()
+		}
+		ubqhash.hotCache.Store((*cache)(nil))
+		if ubqhash.datasets != nil {
+			ubqhash.datasets.purge()
+		}
 		// Short circuit if the exit channel is not allocated.
 		if ubqhash.remote == nil {
 			return
@@ -549,11 +799,36 @@ func (ubqhash *Ubqhash) Close() error {
 	return err
 }
 
+// trackVerifiers registers the given number of verification goroutines about to
+// be started, returning the channel signalling the engine closing. It returns
+// false without registering anything if the engine is already closed.
+func (ubqhash *Ubqhash) trackVerifiers(n int) (<-chan struct{}, bool) {
+	ubqhash.lock.Lock()
+	defer ubqhash.lock.Unlock()
+
+	if ubqhash.quit == nil {
+		ubqhash.quit = make(chan struct{})
+	}
+	select {
+	case <-ubqhash.quit:
+		return nil, false
+	default:
+	}
+	ubqhash.verifiers.Add(n)
+	return ubqhash.quit, true
+}
+
 // cache tries to retrieve a verification cache for the specified block number
-// by first checking against a list of in-memory caches, then against caches
-// stored on disk, and finally generating one if none can be found.
+// by first checking the cache of the last epoch retrieved, then against a list
+// of in-memory caches, then against caches stored on disk, and finally
+// generating one if none can be found.
 func (ubqhash *Ubqhash) cache(block uint64) *cache {
-	epoch := block / epochLength
+	epoch, _, _ := EpochBounds(block)
+
+	// Serve the epoch most verifications hit without contending on the LRU lock
+	if hot, _ := ubqhash.hotCache.Load().(*cache); hot != nil && hot.epoch == epoch {
+		return hot
+	}
 	currentI, futureI := ubqhash.caches.get(epoch)
 	current := currentI.(*cache)
 
@@ -565,9 +840,19 @@ func (ubqhash *Ubqhash) cache(block uint64) *cache {
 		future := futureI.(*cache)
 		go future.generate(ubqhash.config.CacheDir, ubqhash.config.CachesOnDisk, ubqhash.config.CachesLockMmap, ubqhash.config.PowMode == ModeTest)
 	}
+	ubqhash.hotCache.Store(current)
 	return current
 }
 
+// evictCache releases the per-epoch state kept alongside a verification cache
+// the LRU dropped, so the hot cache doesn't keep serving (and pinning) it.
+func (ubqhash *Ubqhash) evictCache(epoch uint64) {
+	if hot, _ := ubqhash.hotCache.Load().(*cache); hot != nil && hot.epoch == epoch {
+		ubqhash.hotCache.Store((*cache)(nil))
+	}
+	metrics.DefaultRegistry.Unregister(sealVerifyTimerName(epoch))
+}
+
 // dataset tries to retrieve a mining dataset for the specified block number
 // by first checking against a list of in-memory datasets, then against DAGs
 // stored on disk, and finally generating one if none can be found.
@@ -576,32 +861,135 @@ func (ubqhash *Ubqhash) cache(block uint64) *cache {
 // generates on a background thread.
 func (ubqhash *Ubqhash) dataset(block uint64, async bool) *dataset {
 	// Retrieve the requested ubqhash dataset
-	epoch := block / epochLength
+	epoch, _, _ := EpochBounds(block)
 	currentI, futureI := ubqhash.datasets.get(epoch)
 	current := currentI.(*dataset)
 
 	// If async is specified, generate everything in a background thread
 	if async && !current.generated() {
 		go func() {
-			current.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest)
+			current.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest, ubqhash.config.GenerationThreads)
 
 			if futureI != nil {
 				future := futureI.(*dataset)
-				future.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest)
+				future.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest, ubqhash.config.GenerationThreads)
 			}
 		}()
 	} else {
 		// Either blocking generation was requested, or already done
-		current.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest)
+		current.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest, ubqhash.config.GenerationThreads)
 
 		if futureI != nil {
 			future := futureI.(*dataset)
-			go future.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest)
+			go future.generate(ubqhash.config.DatasetDir, ubqhash.config.DatasetsOnDisk, ubqhash.config.DatasetsLockMmap, ubqhash.config.PowMode == ModeTest, ubqhash.config.GenerationThreads)
 		}
 	}
 	return current
 }
 
+// VerifyDatasetIntegrity checks the loaded mining dataset of the given epoch for
+// corruption, such as a damaged DAG file on disk, by comparing its checksum to the
+// one of the dataset regenerated from the epoch's verification cache. The check
+// takes about as long as generating the dataset single threaded.
+func (ubqhash *Ubqhash) VerifyDatasetIntegrity(epoch uint64) error {
+	item := ubqhash.datasets.peek(epoch)
+	if item == nil || !item.(*dataset).generated() {
+		return fmt.Errorf("ubqhash dataset for epoch %d not loaded", epoch)
+	}
+	d := item.(*dataset)
+
+	size := datasetSize(epoch*epochLength + 1)
+	if ubqhash.config.PowMode == ModeTest {
+		size = 32 * 1024
+	}
+	if have := uint64(len(d.dataset)) * 4; have != size {
+		return fmt.Errorf("corrupted ubqhash dataset for epoch %d: size %d, want %d", epoch, have, size)
+	}
+	cache := ubqhash.cache(epoch*epochLength + 1)
+	want := expectedDatasetChecksum(cache.cache, size)
+
+	// Caches are unmapped in a finalizer. Ensure that the cache stays alive
+	// until after the dataset items have been generated from it.
+	runtime.KeepAlive(cache)
+
+	if have := datasetChecksum(d.dataset); have != want {
+		return fmt.Errorf("corrupted ubqhash dataset for epoch %d: checksum %x, want %x", epoch, have, want)
+	}
+	// Datasets are unmapped in a finalizer. Ensure that the dataset stays alive
+	// until after the checksum has been calculated.
+	runtime.KeepAlive(d)
+	return nil
+}
+
+// ConfigSnapshot returns a copy of the configuration the engine is running with.
+// Modifying the returned value does not affect the engine, apart from the hooks
+// it shares with it.
+func (ubqhash *Ubqhash) ConfigSnapshot() Config {
+	config := ubqhash.config
+	if config.FixedTestDifficulty != nil {
+		config.FixedTestDifficulty = new(big.Int).Set(config.FixedTestDifficulty)
+	}
+	if config.ChainConfig != nil {
+		config.ChainConfig = config.ChainConfig.Copy()
+	}
+	return config
+}
+
+// PowModeString returns the name of the PoW mode the engine is running in, one
+// of "normal", "shared", "test", "fake" or "fullfake".
+func (ubqhash *Ubqhash) PowModeString() string {
+	return ubqhash.config.PowMode.String()
+}
+
+// fixedTestDifficulty returns a copy of the difficulty every block is pinned to
+// in test mode, or nil if difficulties are calculated as usual.
+func (ubqhash *Ubqhash) fixedTestDifficulty() *big.Int {
+	if ubqhash.config.PowMode != ModeTest || ubqhash.config.FixedTestDifficulty == nil {
+		return nil
+	}
+	return new(big.Int).Set(ubqhash.config.FixedTestDifficulty)
+}
+
+// sealDifficulty returns the difficulty the PoW seal of a block is checked
+// against. This is the block difficulty itself, apart from test mode, where it
+// may be scaled down by the configured DifficultyDivisor.
+func (ubqhash *Ubqhash) sealDifficulty(difficulty *big.Int) *big.Int {
+	if ubqhash.config.PowMode != ModeTest || ubqhash.config.DifficultyDivisor <= 1 {
+		return difficulty
+	}
+	scaled := new(big.Int).Div(difficulty, new(big.Int).SetUint64(ubqhash.config.DifficultyDivisor))
+	if scaled.Sign() <= 0 {
+		scaled.SetUint64(1)
+	}
+	return scaled
+}
+
+// IsMining returns whether the engine is currently sealing a block.
+func (ubqhash *Ubqhash) IsMining() bool {
+	if ubqhash.shared != nil {
+		return ubqhash.shared.IsMining()
+	}
+	ubqhash.lock.Lock()
+	defer ubqhash.lock.Unlock()
+
+	return ubqhash.sealing > 0
+}
+
+// MiningSince returns the time the engine started sealing blocks without a break,
+// or the zero time if it's not sealing.
+func (ubqhash *Ubqhash) MiningSince() time.Time {
+	if ubqhash.shared != nil {
+		return ubqhash.shared.MiningSince()
+	}
+	ubqhash.lock.Lock()
+	defer ubqhash.lock.Unlock()
+
+	if ubqhash.sealing == 0 {
+		return time.Time{}
+	}
+	return ubqhash.since
+}
+
 // Threads returns the number of mining threads currently enabled. This doesn't
 // necessarily mean that mining is running!
 func (ubqhash *Ubqhash) Threads() int {
@@ -655,6 +1043,24 @@ func (ubqhash *Ubqhash) Hashrate() float64 {
 	return ubqhash.hashrate.Rate1() + float64(<-res)
 }
 
+// SubmitHashRate records the hash rate of the remote miner with the given id, so
+// it is included in the reported hashrate until it goes stale. The id must be
+// unique among miners. It returns false if the remote sealer is not running.
+func (ubqhash *Ubqhash) SubmitHashRate(id common.Hash, rate hexutil.Uint64) bool {
+	if ubqhash.remote == nil {
+		return false
+	}
+	var done = make(chan struct{}, 1)
+	select {
+	case ubqhash.remote.submitRateCh <- &hashrate{done: done, rate: uint64(rate), id: id}:
+	case <-ubqhash.remote.exitCh:
+		return false
+	}
+	// Block until hash rate submitted successfully.
+	<-done
+	return true
+}
+
 // APIs implements consensus.Engine, returning the user facing RPC APIs.
 func (ubqhash *Ubqhash) APIs(chain consensus.ChainHeaderReader) []rpc.API {
 	// In order to ensure backward compatibility, we exposes ubqhash RPC APIs
@@ -680,3 +1086,19 @@ func (ubqhash *Ubqhash) APIs(chain consensus.ChainHeaderReader) []rpc.API {
 func SeedHash(block uint64) []byte {
 	return seedHash(block)
 }
+
+// SeedHashChain returns the seed hashes of every epoch from the genesis one up to
+// and including upToEpoch, for light clients bootstrapping their verification
+// caches. Each seed is the Keccak-256 hash of the previous one.
+func SeedHashChain(upToEpoch uint64) [][]byte {
+	seeds := make([][]byte, 0, upToEpoch+1)
+	seed := make([]byte, 32)
+	seeds = append(seeds, common.CopyBytes(seed))
+
+	keccak256 := makeHasher(sha3.NewLegacyKeccak256())
+	for i := uint64(0); i < upToEpoch; i++ {
+		keccak256(seed, seed)
+		seeds = append(seeds, common.CopyBytes(seed))
+	}
+	return seeds
+}
@@ -21,6 +21,7 @@ import (
 	"math/big"
 	"math/rand"
 	"os"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -28,6 +29,8 @@ import (
 	"github.com/ubiq/go-ubiq/v5/common"
 	"github.com/ubiq/go-ubiq/v5/common/hexutil"
 	"github.com/ubiq/go-ubiq/v5/core/types"
+	"github.com/ubiq/go-ubiq/v5/metrics"
+	"github.com/ubiq/go-ubiq/v5/params"
 )
 
 // Tests that ubqhash works correctly in test mode.
@@ -62,7 +65,7 @@ func TestCacheFileEvict(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpdir)
-	e := New(Config{CachesInMem: 3, CachesOnDisk: 10, CacheDir: tmpdir, PowMode: ModeTest}, nil, false)
+	e := New(Config{CachesInMem: 3, CachesOnDisk: 10, CacheDir: tmpdir, PowMode: ModeTest, ChainConfig: params.TestChainConfig.Ubqhash}, nil, false)
 	defer e.Close()
 
 	workers := 8
@@ -153,6 +156,24 @@ func TestHashRate(t *testing.T) {
 	}
 }
 
+// Tests that hash rates submitted by remote miners are aggregated while fresh,
+// and stop counting once they outlive the configured TTL.
+func TestHashRateExpiry(t *testing.T) {
+	ubqhash := New(Config{PowMode: ModeTest, HashrateTTL: 200 * time.Millisecond, ChainConfig: params.TestChainConfig.Ubqhash}, nil, false)
+	defer ubqhash.Close()
+
+	if !ubqhash.SubmitHashRate(common.HexToHash("a"), 100) || !ubqhash.SubmitHashRate(common.HexToHash("b"), 250) {
+		t.Fatalf("remote miner failed to submit hashrate")
+	}
+	if tot := ubqhash.Hashrate(); tot != 350 {
+		t.Errorf("total hashrate mismatch: have %v, want %v", tot, 350)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if tot := ubqhash.Hashrate(); tot != 0 {
+		t.Errorf("stale hashrate mismatch: have %v, want %v", tot, 0)
+	}
+}
+
 func TestClosedRemoteSealer(t *testing.T) {
 	ubqhash := NewTester(nil, false)
 	time.Sleep(1 * time.Second) // ensure exit channel is listening
@@ -167,3 +188,422 @@ func TestClosedRemoteSealer(t *testing.T) {
 		t.Error("expect to return false when submit hashrate to a stopped ubqhash")
 	}
 }
+
+// Tests that the configuration snapshot reflects the values the engine was
+// constructed with and that modifying it doesn't leak back into the engine.
+func TestConfigSnapshot(t *testing.T) {
+	config := Config{
+		CacheDir:       "caches",
+		CachesInMem:    2,
+		CachesOnDisk:   3,
+		DatasetDir:     "dags",
+		DatasetsInMem:  1,
+		DatasetsOnDisk: 2,
+		PowMode:        ModeTest,
+
+		FixedTestDifficulty: big.NewInt(1000),
+		ChainConfig:         params.MainnetChainConfig.Ubqhash.Copy(),
+	}
+	ubqhash := New(config, nil, false)
+	defer ubqhash.Close()
+
+	snapshot := ubqhash.ConfigSnapshot()
+	if snapshot.CacheDir != config.CacheDir || snapshot.CachesInMem != config.CachesInMem || snapshot.CachesOnDisk != config.CachesOnDisk {
+		t.Errorf("cache config mismatch: have %+v, want %+v", snapshot, config)
+	}
+	if snapshot.DatasetDir != config.DatasetDir || snapshot.DatasetsInMem != config.DatasetsInMem || snapshot.DatasetsOnDisk != config.DatasetsOnDisk {
+		t.Errorf("dataset config mismatch: have %+v, want %+v", snapshot, config)
+	}
+	if snapshot.PowMode != ModeTest {
+		t.Errorf("pow mode mismatch: have %v, want %v", snapshot.PowMode, ModeTest)
+	}
+	snapshot.CachesInMem = 10
+	snapshot.PowMode = ModeFullFake
+	if ubqhash.config.CachesInMem != 2 || ubqhash.config.PowMode != ModeTest {
+		t.Errorf("snapshot modification leaked into engine: %+v", ubqhash.config)
+	}
+	// Ensure the referenced values are copied too
+	snapshot.FixedTestDifficulty.SetInt64(1)
+	snapshot.ChainConfig.FluxBlock.SetInt64(1)
+	snapshot.ChainConfig.MonetaryPolicy[0].Reward.SetInt64(1)
+
+	if ubqhash.config.FixedTestDifficulty.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("snapshot fixed difficulty leaked into engine: have %v, want %v", ubqhash.config.FixedTestDifficulty, 1000)
+	}
+	if flux := ubqhash.config.ChainConfig.FluxBlock; flux.Cmp(params.MainnetChainConfig.Ubqhash.FluxBlock) != 0 {
+		t.Errorf("snapshot flux block leaked into engine: have %v, want %v", flux, params.MainnetChainConfig.Ubqhash.FluxBlock)
+	}
+	if reward := ubqhash.config.ChainConfig.MonetaryPolicy[0].Reward; reward.Cmp(params.MainnetChainConfig.Ubqhash.MonetaryPolicy[0].Reward) != 0 {
+		t.Errorf("snapshot monetary policy leaked into engine: have %v, want %v", reward, params.MainnetChainConfig.Ubqhash.MonetaryPolicy[0].Reward)
+	}
+	// Ensure the testing hooks are reported too
+	if fail := NewFakeFailer(5).ConfigSnapshot().FakeFail; fail != 5 {
+		t.Errorf("fake fail mismatch: have %d, want %d", fail, 5)
+	}
+	if delay := NewFakeDelayer(time.Second).ConfigSnapshot().FakeDelay; delay != time.Second {
+		t.Errorf("fake delay mismatch: have %v, want %v", delay, time.Second)
+	}
+}
+
+// Tests that every engine knows the chain config its seal hashes follow, and
+// that a full engine refuses to start without one.
+func TestChainConfigRequired(t *testing.T) {
+	engines := map[string]*Ubqhash{
+		"tester":     NewTester(nil, false),
+		"faker":      NewFaker(),
+		"failer":     NewFakeFailer(5),
+		"delayer":    NewFakeDelayer(time.Second),
+		"full faker": NewFullFaker(),
+		"shared":     NewShared(),
+	}
+	for name, engine := range engines {
+		if engine.config.ChainConfig == nil {
+			t.Errorf("%s engine: missing chain config", name)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("engine created without chain config")
+		}
+	}()
+	New(Config{PowMode: ModeTest}, nil, false)
+}
+
+// Tests that each PoW mode is reported by its expected name.
+func TestPowModeString(t *testing.T) {
+	tests := []struct {
+		mode Mode
+		want string
+	}{
+		{ModeNormal, "normal"},
+		{ModeShared, "shared"},
+		{ModeTest, "test"},
+		{ModeFake, "fake"},
+		{ModeFullFake, "fullfake"},
+	}
+	for _, tt := range tests {
+		ubqhash := &Ubqhash{config: Config{PowMode: tt.mode}}
+		if have := ubqhash.PowModeString(); have != tt.want {
+			t.Errorf("mode %d: name mismatch: have %q, want %q", uint(tt.mode), have, tt.want)
+		}
+	}
+}
+
+// Tests that the cache of the last epoch retrieved is served without a lookup,
+// replaced once another epoch is requested and dropped once evicted.
+func TestHotCache(t *testing.T) {
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	first := ubqhash.cache(1)
+	if hot := ubqhash.cache(epochLength - 1); hot != first {
+		t.Fatalf("same epoch cache not reused")
+	}
+	next := ubqhash.cache(epochLength + 1)
+	if next == first || next.epoch != 1 {
+		t.Fatalf("next epoch cache mismatch: have epoch %d, want 1", next.epoch)
+	}
+	if hot, _ := ubqhash.hotCache.Load().(*cache); hot != next {
+		t.Errorf("hot cache not replaced by the next epoch")
+	}
+	// Evict the hot epoch behind the hot cache's back
+	ubqhash.caches.get(2)
+	if hot, _ := ubqhash.hotCache.Load().(*cache); hot != nil {
+		t.Errorf("hot cache retained after eviction")
+	}
+	if again := ubqhash.cache(epochLength + 1); again == next {
+		t.Errorf("evicted cache served")
+	}
+	ubqhash.Close()
+	if hot, _ := ubqhash.hotCache.Load().(*cache); hot != nil {
+		t.Errorf("hot cache retained after close")
+	}
+}
+
+// Benchmarks 64 goroutines retrieving the verification cache of the same epoch,
+// through the lock free hot cache and, with the hot cache reset before every
+// retrieval, through the locked LRU lookup.
+func BenchmarkCacheConcurrent(b *testing.B) {
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+	ubqhash.cache(1)
+
+	parallelism := 64 / runtime.GOMAXPROCS(0)
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	b.Run("hot", func(b *testing.B) {
+		b.SetParallelism(parallelism)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ubqhash.cache(1)
+			}
+		})
+	})
+	b.Run("locked", func(b *testing.B) {
+		b.SetParallelism(parallelism)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ubqhash.hotCache.Store((*cache)(nil))
+				ubqhash.cache(1)
+			}
+		})
+	})
+}
+
+// Tests that corrupting a single word of a loaded dataset is detected by the
+// integrity check.
+func TestVerifyDatasetIntegrity(t *testing.T) {
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	if err := ubqhash.VerifyDatasetIntegrity(0); err == nil {
+		t.Fatalf("missing dataset passed integrity check")
+	}
+	dataset := ubqhash.dataset(1, false)
+	if err := ubqhash.VerifyDatasetIntegrity(0); err != nil {
+		t.Fatalf("intact dataset failed integrity check: %v", err)
+	}
+	dataset.dataset[123] ^= 1
+	if err := ubqhash.VerifyDatasetIntegrity(0); err == nil {
+		t.Fatalf("corrupted dataset passed integrity check")
+	}
+}
+
+// Tests that the supported mode list covers every mode of the engine.
+func TestSupportedModes(t *testing.T) {
+	modes := make(map[Mode]ModeInfo)
+	for _, info := range SupportedModes() {
+		if info.Name != info.Mode.String() {
+			t.Errorf("mode %d: name mismatch: have %q, want %q", uint(info.Mode), info.Name, info.Mode.String())
+		}
+		modes[info.Mode] = info
+	}
+	for mode := ModeNormal; mode.String() != "unknown"; mode++ {
+		if _, ok := modes[mode]; !ok {
+			t.Errorf("mode %v missing from supported modes", mode)
+		}
+	}
+	if info := modes[ModeFullFake]; info.VerifiesSeals || info.GeneratesDAGs {
+		t.Errorf("full fake mode claims verification work: %+v", info)
+	}
+	if info := modes[ModeNormal]; !info.VerifiesSeals || !info.GeneratesDAGs {
+		t.Errorf("normal mode denies verification work: %+v", info)
+	}
+}
+
+// Tests that verifying a seal with a caller supplied cache gives the same results
+// as the regular seal verification.
+func TestVerifySealWithCache(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(100)}
+
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	results := make(chan *types.Block)
+	if err := ubqhash.Seal(nil, types.NewBlockWithHeader(header), results, nil); err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	select {
+	case block := <-results:
+		header.Nonce = types.EncodeNonce(block.Nonce())
+		header.MixDigest = block.MixDigest()
+	case <-time.NewTimer(2 * time.Second).C:
+		t.Fatalf("sealing result timeout")
+	}
+	cache, size := ubqhash.VerificationCache(header.Number.Uint64())
+	if size != 32*1024 {
+		t.Fatalf("test dataset size mismatch: have %d, want %d", size, 32*1024)
+	}
+	if err := ubqhash.VerifySealWithCache(header, cache, size); err != nil {
+		t.Errorf("valid seal rejected: %v", err)
+	}
+	if err := ubqhash.VerifySeal(nil, header); err != nil {
+		t.Errorf("valid seal rejected by regular verification: %v", err)
+	}
+	// Tamper with the nonce and ensure both paths reject it the same way
+	header.Nonce = types.EncodeNonce(header.Nonce.Uint64() + 1)
+
+	want := ubqhash.VerifySeal(nil, header)
+	if want == nil {
+		t.Fatalf("tampered seal accepted by regular verification")
+	}
+	if err := ubqhash.VerifySealWithCache(header, cache, size); err != want {
+		t.Errorf("tampered seal error mismatch: have %v, want %v", err, want)
+	}
+	// Headers without a difficulty are rejected rather than crashing
+	header.Difficulty = nil
+	if err := ubqhash.VerifySealWithCache(header, cache, size); err != errInvalidDifficulty {
+		t.Errorf("nil difficulty error mismatch: have %v, want %v", err, errInvalidDifficulty)
+	}
+}
+
+// Tests that a seal whose mix digest was computed with the previous epoch's cache
+// is rejected, even though in test mode both epochs share the same dataset size.
+func TestVerifySealWrongEpoch(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(epochLength + 1), Difficulty: big.NewInt(1)}
+
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	for _, epoch := range []uint64{0, 1} {
+		c := &cache{epoch: epoch}
+		c.generate("", 0, false, true)
+
+		digest, _ := hashimotoLight(32*1024, c.cache, ubqhash.SealHash(header).Bytes(), header.Nonce.Uint64())
+		header.MixDigest = common.BytesToHash(digest)
+
+		err := ubqhash.VerifySeal(nil, header)
+		switch {
+		case epoch == 0 && err != errInvalidMixDigest:
+			t.Errorf("previous epoch seal error mismatch: have %v, want %v", err, errInvalidMixDigest)
+		case epoch == 1 && err != nil:
+			t.Errorf("current epoch seal rejected: %v", err)
+		}
+	}
+}
+
+// Tests that a share meeting the pool difficulty but not the block difficulty is
+// accepted at the share difficulty, while its mix digest is still checked.
+func TestVerifySealAtDifficulty(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(1), Difficulty: new(big.Int).Lsh(big.NewInt(1), 200)}
+	shareDifficulty := big.NewInt(100)
+
+	ubqhash := NewTester(nil, false)
+	defer ubqhash.Close()
+
+	// Search for a nonce meeting the share difficulty
+	c := &cache{epoch: 0}
+	c.generate("", 0, false, true)
+
+	target := new(big.Int).Div(two256, shareDifficulty)
+	for nonce := uint64(0); ; nonce++ {
+		digest, result := hashimotoLight(32*1024, c.cache, ubqhash.SealHash(header).Bytes(), nonce)
+		if new(big.Int).SetBytes(result).Cmp(target) <= 0 {
+			header.Nonce = types.EncodeNonce(nonce)
+			header.MixDigest = common.BytesToHash(digest)
+			break
+		}
+	}
+	if err := ubqhash.VerifySealAtDifficulty(header, shareDifficulty); err != nil {
+		t.Errorf("share rejected at pool difficulty: %v", err)
+	}
+	if err := ubqhash.VerifySeal(nil, header); err != errInvalidPoW {
+		t.Errorf("share block seal error mismatch: have %v, want %v", err, errInvalidPoW)
+	}
+	header.MixDigest = common.Hash{}
+	if err := ubqhash.VerifySealAtDifficulty(header, shareDifficulty); err != errInvalidMixDigest {
+		t.Errorf("share mix digest error mismatch: have %v, want %v", err, errInvalidMixDigest)
+	}
+	if err := ubqhash.VerifySealAtDifficulty(header, new(big.Int)); err != errInvalidDifficulty {
+		t.Errorf("zero share difficulty error mismatch: have %v, want %v", err, errInvalidDifficulty)
+	}
+}
+
+// Tests that a difficulty divisor in test mode makes blocks of a high difficulty
+// quickly mineable, and that the resulting seal verifies.
+func TestDifficultyDivisor(t *testing.T) {
+	header := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(1000000)}
+
+	ubqhash := NewTester(nil, false)
+	ubqhash.config.DifficultyDivisor = 1000
+	defer ubqhash.Close()
+
+	results := make(chan *types.Block)
+	if err := ubqhash.Seal(nil, types.NewBlockWithHeader(header), results, nil); err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	select {
+	case block := <-results:
+		if block.Difficulty().Cmp(header.Difficulty) != 0 {
+			t.Errorf("block difficulty modified: have %v, want %v", block.Difficulty(), header.Difficulty)
+		}
+		header.Nonce = types.EncodeNonce(block.Nonce())
+		header.MixDigest = block.MixDigest()
+		if err := ubqhash.VerifySeal(nil, header); err != nil {
+			t.Fatalf("unexpected verification error: %v", err)
+		}
+	case <-time.NewTimer(5 * time.Second).C:
+		t.Error("sealing result timeout")
+	}
+}
+
+// Tests that a fixed test difficulty is assigned to and verified against every
+// block of a chain mined in test mode, regardless of the retargeting algorithm.
+func TestFixedTestDifficulty(t *testing.T) {
+	ubqhash := NewTester(nil, false)
+	ubqhash.config.FixedTestDifficulty = big.NewInt(100)
+	defer ubqhash.Close()
+
+	genesis := &types.Header{Number: big.NewInt(0), Time: 1000000, Difficulty: big.NewInt(1000000000), GasLimit: params.GenesisGasLimit}
+	chain := newTestChainReader(params.TestChainConfig, []*types.Header{genesis})
+
+	parent := genesis
+	for i := 1; i <= 10; i++ {
+		header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(int64(i)), Time: parent.Time + 10, GasLimit: parent.GasLimit}
+		header.Difficulty = ubqhash.CalcDifficulty(chain, header.Time, parent)
+		if header.Difficulty.Cmp(ubqhash.config.FixedTestDifficulty) != 0 {
+			t.Fatalf("block %d: difficulty mismatch: have %v, want %v", i, header.Difficulty, ubqhash.config.FixedTestDifficulty)
+		}
+		results := make(chan *types.Block)
+		if err := ubqhash.Seal(nil, types.NewBlockWithHeader(header), results, nil); err != nil {
+			t.Fatalf("block %d: failed to seal: %v", i, err)
+		}
+		select {
+		case block := <-results:
+			header = block.Header()
+		case <-time.NewTimer(5 * time.Second).C:
+			t.Fatalf("block %d: sealing result timeout", i)
+		}
+		if err := ubqhash.VerifyHeader(chain, header, true); err != nil {
+			t.Fatalf("block %d: verification failed: %v", i, err)
+		}
+		chain.headers[header.Number.Uint64()] = header
+		chain.hashes[header.Hash()] = header
+		parent = header
+	}
+}
+
+// Tests that seal verification times are tracked by a timer per epoch, which is
+// unregistered once the epoch's verification cache is evicted.
+func TestSealVerifyMetrics(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	ubqhash := New(Config{PowMode: ModeTest, CachesInMem: 2, ChainConfig: params.TestChainConfig.Ubqhash}, nil, false)
+	defer ubqhash.Close()
+
+	verify := func(number uint64) {
+		header := &types.Header{Number: new(big.Int).SetUint64(number), Difficulty: big.NewInt(1)}
+		digest, _ := hashimotoLight(32*1024, ubqhash.cache(number).cache, ubqhash.SealHash(header).Bytes(), 0)
+		header.MixDigest = common.BytesToHash(digest)
+
+		if err := ubqhash.VerifySeal(nil, header); err != nil {
+			t.Fatalf("block %d: failed to verify seal: %v", number, err)
+		}
+	}
+	for _, epoch := range []uint64{0, 1} {
+		metrics.DefaultRegistry.Unregister(sealVerifyTimerName(epoch))
+	}
+	verify(1)
+	verify(epochLength + 1)
+	verify(epochLength + 2)
+
+	for epoch, want := range []int64{1, 2} {
+		timer, ok := metrics.DefaultRegistry.Get(sealVerifyTimerName(uint64(epoch))).(metrics.Timer)
+		if !ok {
+			t.Fatalf("epoch %d: timer not registered", epoch)
+		}
+		if count := timer.Count(); count != want {
+			t.Errorf("epoch %d: sample count mismatch: have %d, want %d", epoch, count, want)
+		}
+	}
+	// Move on to a third epoch, evicting the first one
+	verify(2*epochLength + 1)
+	if timer := metrics.DefaultRegistry.Get(sealVerifyTimerName(0)); timer != nil {
+		t.Errorf("evicted epoch timer still registered")
+	}
+	if timer := metrics.DefaultRegistry.Get(sealVerifyTimerName(2)); timer == nil {
+		t.Errorf("current epoch timer not registered")
+	}
+}
@@ -261,6 +261,7 @@ func CreateConsensusEngine(stack *node.Node, chainConfig *params.ChainConfig, co
 			DatasetsInMem:    config.DatasetsInMem,
 			DatasetsOnDisk:   config.DatasetsOnDisk,
 			DatasetsLockMmap: config.DatasetsLockMmap,
+			ChainConfig:      chainConfig.Ubqhash,
 		}, notify, noverify)
 		engine.SetThreads(-1) // Disable CPU mining
 		return engine
@@ -225,7 +225,7 @@ var (
 	//
 	// This configuration is intentionally not using keyed fields to force anyone
 	// adding flags to the config to also have to set these fields.
-	AllUbqhashProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, &UbqhashConfig{big.NewInt(0), big.NewInt(0), []UbqhashMPStep{}}, nil}
+	AllUbqhashProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, &UbqhashConfig{big.NewInt(0), big.NewInt(0), []UbqhashMPStep{{big.NewInt(0), big.NewInt(0)}}, nil, nil, 0, 0, nil, 0, nil, nil, nil, nil, nil, false, 0, nil, nil, BootstrapHold, nil, 0, nil, 0, nil, nil, nil, nil, big.NewInt(0), 0, nil, 0, nil, 0, nil, nil}, nil}
 
 	// AllCliqueProtocolChanges contains every protocol change (EIPs) introduced
 	// and accepted by the Ubiq core developers into the Clique consensus.
@@ -234,7 +234,7 @@ var (
 	// adding flags to the config to also have to set these fields.
 	AllCliqueProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, &CliqueConfig{Period: 0, Epoch: 30000}}
 
-	TestChainConfig = &ChainConfig{big.NewInt(1), big.NewInt(0), big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, &UbqhashConfig{big.NewInt(0), big.NewInt(0), []UbqhashMPStep{}}, nil}
+	TestChainConfig = &ChainConfig{big.NewInt(1), big.NewInt(0), big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, &UbqhashConfig{big.NewInt(0), big.NewInt(0), []UbqhashMPStep{{big.NewInt(0), big.NewInt(0)}}, nil, nil, 0, 0, nil, 0, nil, nil, nil, nil, nil, false, 0, nil, nil, BootstrapHold, nil, 0, nil, 0, nil, nil, nil, nil, big.NewInt(0), 0, nil, 0, nil, 0, nil, nil}, nil}
 	TestRules       = TestChainConfig.Rules(new(big.Int))
 )
 
@@ -314,11 +314,132 @@ type UbqhashMPStep struct {
 	Reward *big.Int `json:"reward"`
 }
 
+// Ubqhash base block reward recipient
+type UbqhashRewardRecipient struct {
+	Address common.Address `json:"address"`
+	Weight  uint64         `json:"weight"`
+}
+
+// Ubqhash difficulty bootstrap algorithms
+const (
+	BootstrapHold     = ""         // Keep the parent's difficulty
+	BootstrapPerBlock = "perblock" // Adjust the difficulty by the time since the parent block
+)
+
 // UbqhashConfig is the consensus engine configs for proof-of-work based sealing.
 type UbqhashConfig struct {
 	DigishieldModBlock *big.Int        `json:"digishieldModBlock,omitempty"` // Block to activate the DigiShield V3 mod
 	FluxBlock          *big.Int        `json:"fluxBlock"`                    // Block to activate the Flux difficulty algorithm
 	MonetaryPolicy     []UbqhashMPStep `json:"monetaryPolicy"`               // Blocks to step the block reward down
+
+	// UncleBonusCurve is the percentage of the uncle inclusion bonus paid out
+	// per uncle depth, starting at depth 1, from UncleBonusCurveBlock on. Uncles
+	// deeper than the curve use its last entry. An empty curve pays the flat bonus
+	// regardless of depth.
+	UncleBonusCurve      []uint64 `json:"uncleBonusCurve,omitempty"`
+	UncleBonusCurveBlock *big.Int `json:"uncleBonusCurveBlock,omitempty"` // Block to activate the uncle bonus curve (nil = no fork)
+
+	LaunchBonusBlocks uint64   `json:"launchBonusBlocks,omitempty"` // Number of blocks after LaunchBonusBlock paying a launch bonus
+	LaunchBonusFactor uint64   `json:"launchBonusFactor,omitempty"` // Block reward multiplier during the launch bonus, in basis points (0 or 10000 = no bonus)
+	LaunchBonusBlock  *big.Int `json:"launchBonusBlock,omitempty"`  // Block the launch bonus window starts after (nil = no fork, 0 = from genesis)
+
+	TargetBlockTime      uint64   `json:"targetBlockTime,omitempty"`      // Block time in seconds the difficulty adjustment aims for from TargetBlockTimeBlock on (0 = 88)
+	TargetBlockTimeBlock *big.Int `json:"targetBlockTimeBlock,omitempty"` // Block to activate the target block time (nil = no fork)
+
+	// MaxPerBlockDifficultyIncrease caps how far a block's difficulty may exceed
+	// its parent's, in basis points, regardless of the difficulty algorithm's own
+	// smoothing, from MaxPerBlockDifficultyIncreaseBlock on. Nil leaves the
+	// increase unbounded.
+	MaxPerBlockDifficultyIncrease      *uint64  `json:"maxPerBlockDifficultyIncrease,omitempty"`
+	MaxPerBlockDifficultyIncreaseBlock *big.Int `json:"maxPerBlockDifficultyIncreaseBlock,omitempty"` // Block to activate the difficulty increase cap (nil = no fork)
+
+	// RewardRecipients, if their weights sum to more than zero, receive the base
+	// block reward split proportionally by weight instead of the block's coinbase,
+	// from RewardRecipientsBlock on. Bonuses on top of the base reward are still
+	// paid to the coinbase.
+	RewardRecipients      []UbqhashRewardRecipient `json:"rewardRecipients,omitempty"`
+	RewardRecipientsBlock *big.Int                 `json:"rewardRecipientsBlock,omitempty"` // Block to activate the reward recipients (nil = no fork)
+
+	// FluxArithmeticTimespan makes Flux measure the actual timespan from the raw
+	// time since the parent block instead of past median times. It exists to study
+	// the median's resistance to time-warp attacks in tests, and chain configs
+	// enabling it are rejected when loaded.
+	FluxArithmeticTimespan bool `json:"fluxArithmeticTimespan,omitempty"`
+
+	MaxDifficultyBits      uint64   `json:"maxDifficultyBits,omitempty"`      // Bit width difficulties are clamped to from MaxDifficultyBitsBlock on, as a guard against runaways (0 = 256)
+	MaxDifficultyBitsBlock *big.Int `json:"maxDifficultyBitsBlock,omitempty"` // Block to activate the difficulty bit width (nil = no fork)
+
+	// UncleBonusByGasUsedBlock is the block from which the uncle inclusion bonus is
+	// scaled by the share of its gas limit the uncle used, so only uncles that did
+	// real work pay the full bonus (nil = no fork).
+	UncleBonusByGasUsedBlock *big.Int `json:"uncleBonusByGasUsedBlock,omitempty"`
+
+	// BootstrapAlgorithm selects how the difficulty adjusts while the chain is
+	// still shorter than the averaging window of the difficulty algorithm, which
+	// by default holds the difficulty constant, leaving a freshly launched chain
+	// open to an early miner with lots of hashrate. It applies to the blocks from
+	// BootstrapAlgorithmBlock on.
+	BootstrapAlgorithm      string   `json:"bootstrapAlgorithm,omitempty"`
+	BootstrapAlgorithmBlock *big.Int `json:"bootstrapAlgorithmBlock,omitempty"` // Block to activate the bootstrap algorithm (nil = no fork)
+
+	MedianTimeWindow      uint64   `json:"medianTimeWindow,omitempty"`      // Number of blocks the difficulty algorithm's past median times span from MedianTimeWindowBlock on (0 = 11)
+	MedianTimeWindowBlock *big.Int `json:"medianTimeWindowBlock,omitempty"` // Block to activate the median time window (nil = no fork)
+
+	// DifficultyForkGrace is the number of blocks after each difficulty algorithm
+	// fork during which the newly activated algorithm retargets within relaxed
+	// bounds, smoothing the transition while its averaging window still spans
+	// blocks of the previous algorithm (0 = no grace period). It applies to the
+	// blocks from DifficultyForkGraceBlock on.
+	DifficultyForkGrace      uint64   `json:"difficultyForkGrace,omitempty"`
+	DifficultyForkGraceBlock *big.Int `json:"difficultyForkGraceBlock,omitempty"` // Block to activate the difficulty fork grace period (nil = no fork)
+
+	// ExtraDataRewardAddressBlock is the block from which the rewards of a block,
+	// and of the uncles it includes, are paid to the address their extra-data
+	// consists of instead of their coinbase, for miners whose signing key differs
+	// from their reward address. Blocks whose extra-data isn't exactly a non-zero
+	// address are paid to the coinbase (nil = no fork).
+	ExtraDataRewardAddressBlock *big.Int `json:"extraDataRewardAddressBlock,omitempty"`
+
+	// LenientUncleSealBlock is the block from which uncles with invalid seals no
+	// longer invalidate the including block, but are merely denied their rewards,
+	// accommodating a historical period of buggy uncle seals (nil = no fork).
+	LenientUncleSealBlock *big.Int `json:"lenientUncleSealBlock,omitempty"`
+
+	// SHA3SealHashBlock is the block from which seal hashes are derived with the
+	// standard SHA3-256 instead of the legacy Keccak-256 used since genesis
+	// (nil = no fork).
+	SHA3SealHashBlock *big.Int `json:"sha3SealHashBlock,omitempty"`
+
+	// AncestryMedianTimeBlock is the block from which the difficulty algorithms
+	// take the past median times over the parent's own ancestry instead of the
+	// canonical chain, which only differ for side chain parents such as uncles
+	// promoted in a reorg (nil = no fork).
+	AncestryMedianTimeBlock *big.Int `json:"ancestryMedianTimeBlock,omitempty"`
+
+	// RetargetSmoothingDivisor is the divisor the difficulty algorithms scale the
+	// deviation of the actual timespan from the averaging window timespan down by
+	// before clamping, from RetargetSmoothingBlock on. Lower values respond faster
+	// to hash rate changes (0 = 4).
+	RetargetSmoothingDivisor uint64   `json:"retargetSmoothingDivisor,omitempty"`
+	RetargetSmoothingBlock   *big.Int `json:"retargetSmoothingBlock,omitempty"` // Block to activate the retarget smoothing divisor (nil = no fork)
+
+	// MaxUncleAge limits how many seconds older than the including block an uncle
+	// may be by timestamp, from MaxUncleAgeBlock on, rejecting stale uncles that
+	// are still within the ancestry window by block count (0 = unlimited).
+	MaxUncleAge      uint64   `json:"maxUncleAge,omitempty"`
+	MaxUncleAgeBlock *big.Int `json:"maxUncleAgeBlock,omitempty"` // Block to activate the uncle age limit (nil = no fork)
+
+	// MaxMedianTimeGap is the furthest, in seconds, a block's timestamp may be
+	// ahead of the past median time of its parent from MaxMedianTimeGapBlock on
+	// (0 = unlimited). The median spans the same window as the difficulty
+	// algorithm's, see MedianTimeWindow.
+	MaxMedianTimeGap      uint64   `json:"maxMedianTimeGap,omitempty"`
+	MaxMedianTimeGapBlock *big.Int `json:"maxMedianTimeGapBlock,omitempty"` // Block to activate the median time gap limit (nil = no fork)
+
+	// RejectMinimumDifficultyBlock is the block from which blocks whose difficulty
+	// is pinned at the minimum floor, i.e. an effectively unsecured chain, are
+	// rejected (nil = no fork).
+	RejectMinimumDifficultyBlock *big.Int `json:"rejectMinimumDifficultyBlock,omitempty"`
 }
 
 // String implements the stringer interface, returning the consensus engine details.
@@ -326,6 +447,206 @@ func (c *UbqhashConfig) String() string {
 	return "ubqhash"
 }
 
+// Copy returns a deep copy of the config, sharing no fork blocks, rewards or
+// slices with the original.
+func (c *UbqhashConfig) Copy() *UbqhashConfig {
+	cpy := *c
+	cpy.DigishieldModBlock = copyBigInt(c.DigishieldModBlock)
+	cpy.FluxBlock = copyBigInt(c.FluxBlock)
+	cpy.UncleBonusCurveBlock = copyBigInt(c.UncleBonusCurveBlock)
+	cpy.LaunchBonusBlock = copyBigInt(c.LaunchBonusBlock)
+	cpy.TargetBlockTimeBlock = copyBigInt(c.TargetBlockTimeBlock)
+	cpy.MaxPerBlockDifficultyIncreaseBlock = copyBigInt(c.MaxPerBlockDifficultyIncreaseBlock)
+	cpy.MaxDifficultyBitsBlock = copyBigInt(c.MaxDifficultyBitsBlock)
+	cpy.MedianTimeWindowBlock = copyBigInt(c.MedianTimeWindowBlock)
+	cpy.DifficultyForkGraceBlock = copyBigInt(c.DifficultyForkGraceBlock)
+	cpy.BootstrapAlgorithmBlock = copyBigInt(c.BootstrapAlgorithmBlock)
+	cpy.ExtraDataRewardAddressBlock = copyBigInt(c.ExtraDataRewardAddressBlock)
+	cpy.RewardRecipientsBlock = copyBigInt(c.RewardRecipientsBlock)
+	cpy.UncleBonusByGasUsedBlock = copyBigInt(c.UncleBonusByGasUsedBlock)
+	cpy.LenientUncleSealBlock = copyBigInt(c.LenientUncleSealBlock)
+	cpy.SHA3SealHashBlock = copyBigInt(c.SHA3SealHashBlock)
+	cpy.AncestryMedianTimeBlock = copyBigInt(c.AncestryMedianTimeBlock)
+	cpy.RetargetSmoothingBlock = copyBigInt(c.RetargetSmoothingBlock)
+	cpy.MaxUncleAgeBlock = copyBigInt(c.MaxUncleAgeBlock)
+	cpy.MaxMedianTimeGapBlock = copyBigInt(c.MaxMedianTimeGapBlock)
+	cpy.RejectMinimumDifficultyBlock = copyBigInt(c.RejectMinimumDifficultyBlock)
+
+	if c.MonetaryPolicy != nil {
+		cpy.MonetaryPolicy = make([]UbqhashMPStep, len(c.MonetaryPolicy))
+		for i, step := range c.MonetaryPolicy {
+			cpy.MonetaryPolicy[i] = UbqhashMPStep{Block: copyBigInt(step.Block), Reward: copyBigInt(step.Reward)}
+		}
+	}
+	if c.UncleBonusCurve != nil {
+		cpy.UncleBonusCurve = append([]uint64{}, c.UncleBonusCurve...)
+	}
+	if c.MaxPerBlockDifficultyIncrease != nil {
+		increase := *c.MaxPerBlockDifficultyIncrease
+		cpy.MaxPerBlockDifficultyIncrease = &increase
+	}
+	if c.RewardRecipients != nil {
+		cpy.RewardRecipients = append([]UbqhashRewardRecipient{}, c.RewardRecipients...)
+	}
+	return &cpy
+}
+
+// copyBigInt returns a copy of x, or nil if x is nil.
+func copyBigInt(x *big.Int) *big.Int {
+	if x == nil {
+		return nil
+	}
+	return new(big.Int).Set(x)
+}
+
+// IsUncleBonusCurve returns whether num is either equal to the uncle bonus curve
+// fork block or greater.
+func (c *UbqhashConfig) IsUncleBonusCurve(num *big.Int) bool {
+	return isForked(c.UncleBonusCurveBlock, num)
+}
+
+// IsLaunchBonus returns whether num is within the launch bonus window, which are
+// the LaunchBonusBlocks blocks following the launch bonus fork block.
+func (c *UbqhashConfig) IsLaunchBonus(num *big.Int) bool {
+	if c.LaunchBonusBlock == nil || num == nil || num.Cmp(c.LaunchBonusBlock) <= 0 {
+		return false
+	}
+	end := new(big.Int).Add(c.LaunchBonusBlock, new(big.Int).SetUint64(c.LaunchBonusBlocks))
+	return num.Cmp(end) <= 0
+}
+
+// IsTargetBlockTime returns whether num is either equal to the target block time
+// fork block or greater.
+func (c *UbqhashConfig) IsTargetBlockTime(num *big.Int) bool {
+	return isForked(c.TargetBlockTimeBlock, num)
+}
+
+// IsMaxPerBlockDifficultyIncrease returns whether num is either equal to the
+// difficulty increase cap fork block or greater.
+func (c *UbqhashConfig) IsMaxPerBlockDifficultyIncrease(num *big.Int) bool {
+	return isForked(c.MaxPerBlockDifficultyIncreaseBlock, num)
+}
+
+// IsMaxDifficultyBits returns whether num is either equal to the difficulty bit
+// width fork block or greater.
+func (c *UbqhashConfig) IsMaxDifficultyBits(num *big.Int) bool {
+	return isForked(c.MaxDifficultyBitsBlock, num)
+}
+
+// IsMedianTimeWindow returns whether num is either equal to the median time
+// window fork block or greater.
+func (c *UbqhashConfig) IsMedianTimeWindow(num *big.Int) bool {
+	return isForked(c.MedianTimeWindowBlock, num)
+}
+
+// IsDifficultyForkGrace returns whether num is either equal to the difficulty
+// fork grace period fork block or greater.
+func (c *UbqhashConfig) IsDifficultyForkGrace(num *big.Int) bool {
+	return isForked(c.DifficultyForkGraceBlock, num)
+}
+
+// IsBootstrapAlgorithm returns whether num is either equal to the bootstrap
+// algorithm fork block or greater.
+func (c *UbqhashConfig) IsBootstrapAlgorithm(num *big.Int) bool {
+	return isForked(c.BootstrapAlgorithmBlock, num)
+}
+
+// IsExtraDataRewardAddress returns whether num is either equal to the extra-data
+// reward address fork block or greater.
+func (c *UbqhashConfig) IsExtraDataRewardAddress(num *big.Int) bool {
+	return isForked(c.ExtraDataRewardAddressBlock, num)
+}
+
+// IsRewardRecipients returns whether num is either equal to the reward recipients
+// fork block or greater.
+func (c *UbqhashConfig) IsRewardRecipients(num *big.Int) bool {
+	return isForked(c.RewardRecipientsBlock, num)
+}
+
+// IsUncleBonusByGasUsed returns whether num is either equal to the uncle bonus by
+// gas used fork block or greater.
+func (c *UbqhashConfig) IsUncleBonusByGasUsed(num *big.Int) bool {
+	return isForked(c.UncleBonusByGasUsedBlock, num)
+}
+
+// IsLenientUncleSeal returns whether num is either equal to the lenient uncle seal
+// fork block or greater.
+func (c *UbqhashConfig) IsLenientUncleSeal(num *big.Int) bool {
+	return isForked(c.LenientUncleSealBlock, num)
+}
+
+// IsSHA3SealHash returns whether num is either equal to the SHA3 seal hash fork
+// block or greater.
+func (c *UbqhashConfig) IsSHA3SealHash(num *big.Int) bool {
+	return isForked(c.SHA3SealHashBlock, num)
+}
+
+// IsAncestryMedianTime returns whether num is either equal to the ancestry median
+// time fork block or greater.
+func (c *UbqhashConfig) IsAncestryMedianTime(num *big.Int) bool {
+	return isForked(c.AncestryMedianTimeBlock, num)
+}
+
+// IsRetargetSmoothing returns whether num is either equal to the retarget
+// smoothing fork block or greater.
+func (c *UbqhashConfig) IsRetargetSmoothing(num *big.Int) bool {
+	return isForked(c.RetargetSmoothingBlock, num)
+}
+
+// IsMaxUncleAge returns whether num is either equal to the uncle age limit fork
+// block or greater.
+func (c *UbqhashConfig) IsMaxUncleAge(num *big.Int) bool {
+	return isForked(c.MaxUncleAgeBlock, num)
+}
+
+// IsMaxMedianTimeGap returns whether num is either equal to the median time gap
+// limit fork block or greater.
+func (c *UbqhashConfig) IsMaxMedianTimeGap(num *big.Int) bool {
+	return isForked(c.MaxMedianTimeGapBlock, num)
+}
+
+// IsRejectMinimumDifficulty returns whether num is either equal to the minimum
+// difficulty rejection fork block or greater.
+func (c *UbqhashConfig) IsRejectMinimumDifficulty(num *big.Int) bool {
+	return isForked(c.RejectMinimumDifficultyBlock, num)
+}
+
+// ValidateMonetaryPolicy checks that the monetary policy defines at least one
+// reward step, that every step is fully specified and that the steps are sorted
+// by strictly increasing block number, as the block reward lookup relies on it.
+func (c *UbqhashConfig) ValidateMonetaryPolicy() error {
+	if len(c.MonetaryPolicy) == 0 {
+		return fmt.Errorf("empty monetary policy")
+	}
+	for i, step := range c.MonetaryPolicy {
+		if step.Block == nil || step.Reward == nil {
+			return fmt.Errorf("incomplete monetary policy step %d", i)
+		}
+		if step.Block.Sign() < 0 || step.Reward.Sign() < 0 {
+			return fmt.Errorf("negative monetary policy step %d: block %v, reward %v", i, step.Block, step.Reward)
+		}
+		if i > 0 && step.Block.Cmp(c.MonetaryPolicy[i-1].Block) <= 0 {
+			return fmt.Errorf("unsorted monetary policy: step %d at block %v, but step %d at block %v",
+				i-1, c.MonetaryPolicy[i-1].Block, i, step.Block)
+		}
+	}
+	return nil
+}
+
+// ValidateForkOrder checks that the DigiShield V3 mod doesn't activate after Flux,
+// as the algorithm selection relies on it. Forks left unset never activate, so
+// the ordering is only checked if both are set.
+func ValidateForkOrder(c *UbqhashConfig) error {
+	if c == nil || c.DigishieldModBlock == nil || c.FluxBlock == nil {
+		return nil
+	}
+	if c.DigishieldModBlock.Cmp(c.FluxBlock) > 0 {
+		return fmt.Errorf("unsupported fork ordering: digishieldModBlock enabled at %v, but fluxBlock enabled at %v",
+			c.DigishieldModBlock, c.FluxBlock)
+	}
+	return nil
+}
+
 // CliqueConfig is the consensus engine configs for proof-of-authority based sealing.
 type CliqueConfig struct {
 	Period uint64 `json:"period"` // Number of seconds between blocks to enforce
@@ -464,6 +785,24 @@ func (c *ChainConfig) CheckConfigForkOrder() error {
 			lastFork = cur
 		}
 	}
+	if c.Ubqhash != nil {
+		// A chain without reward steps pays no rewards, but one with malformed
+		// steps would pay the wrong ones
+		if len(c.Ubqhash.MonetaryPolicy) > 0 {
+			if err := c.Ubqhash.ValidateMonetaryPolicy(); err != nil {
+				return err
+			}
+		}
+		if c.Ubqhash.FluxArithmeticTimespan {
+			return fmt.Errorf("unsupported ubqhash option: fluxArithmeticTimespan is test only")
+		}
+		switch c.Ubqhash.BootstrapAlgorithm {
+		case BootstrapHold, BootstrapPerBlock:
+		default:
+			return fmt.Errorf("unsupported ubqhash bootstrap algorithm %q", c.Ubqhash.BootstrapAlgorithm)
+		}
+		return ValidateForkOrder(c.Ubqhash)
+	}
 	return nil
 }
 
@@ -502,6 +841,111 @@ func (c *ChainConfig) checkCompatible(newcfg *ChainConfig, head *big.Int) *Confi
 	if isForkIncompatible(c.EWASMBlock, newcfg.EWASMBlock, head) {
 		return newCompatError("ewasm fork block", c.EWASMBlock, newcfg.EWASMBlock)
 	}
+	if c.Ubqhash != nil && newcfg.Ubqhash != nil {
+		return c.Ubqhash.checkCompatible(newcfg.Ubqhash, head)
+	}
+	return nil
+}
+
+// checkCompatible checks whether the ubqhash forks scheduled in newcfg can be
+// applied to a chain at the given head that was built with c.
+func (c *UbqhashConfig) checkCompatible(newcfg *UbqhashConfig, head *big.Int) *ConfigCompatError {
+	if isForkIncompatible(c.DigishieldModBlock, newcfg.DigishieldModBlock, head) {
+		return newCompatError("DigishieldMod fork block", c.DigishieldModBlock, newcfg.DigishieldModBlock)
+	}
+	if isForkIncompatible(c.FluxBlock, newcfg.FluxBlock, head) {
+		return newCompatError("Flux fork block", c.FluxBlock, newcfg.FluxBlock)
+	}
+	if isForkIncompatible(c.UncleBonusCurveBlock, newcfg.UncleBonusCurveBlock, head) {
+		return newCompatError("uncle bonus curve fork block", c.UncleBonusCurveBlock, newcfg.UncleBonusCurveBlock)
+	}
+	if c.IsUncleBonusCurve(head) && !uint64sEqual(c.UncleBonusCurve, newcfg.UncleBonusCurve) {
+		return newCompatError("uncle bonus curve", c.UncleBonusCurveBlock, newcfg.UncleBonusCurveBlock)
+	}
+	if isForkIncompatible(c.LaunchBonusBlock, newcfg.LaunchBonusBlock, head) {
+		return newCompatError("launch bonus fork block", c.LaunchBonusBlock, newcfg.LaunchBonusBlock)
+	}
+	if isForked(c.LaunchBonusBlock, head) && (c.LaunchBonusBlocks != newcfg.LaunchBonusBlocks || c.LaunchBonusFactor != newcfg.LaunchBonusFactor) {
+		return newCompatError("launch bonus", c.LaunchBonusBlock, newcfg.LaunchBonusBlock)
+	}
+	if isForkIncompatible(c.TargetBlockTimeBlock, newcfg.TargetBlockTimeBlock, head) {
+		return newCompatError("target block time fork block", c.TargetBlockTimeBlock, newcfg.TargetBlockTimeBlock)
+	}
+	if c.IsTargetBlockTime(head) && c.TargetBlockTime != newcfg.TargetBlockTime {
+		return newCompatError("target block time", c.TargetBlockTimeBlock, newcfg.TargetBlockTimeBlock)
+	}
+	if isForkIncompatible(c.MaxPerBlockDifficultyIncreaseBlock, newcfg.MaxPerBlockDifficultyIncreaseBlock, head) {
+		return newCompatError("difficulty increase cap fork block", c.MaxPerBlockDifficultyIncreaseBlock, newcfg.MaxPerBlockDifficultyIncreaseBlock)
+	}
+	if c.IsMaxPerBlockDifficultyIncrease(head) && !uint64PtrEqual(c.MaxPerBlockDifficultyIncrease, newcfg.MaxPerBlockDifficultyIncrease) {
+		return newCompatError("difficulty increase cap", c.MaxPerBlockDifficultyIncreaseBlock, newcfg.MaxPerBlockDifficultyIncreaseBlock)
+	}
+	if isForkIncompatible(c.MaxDifficultyBitsBlock, newcfg.MaxDifficultyBitsBlock, head) {
+		return newCompatError("difficulty bit width fork block", c.MaxDifficultyBitsBlock, newcfg.MaxDifficultyBitsBlock)
+	}
+	if c.IsMaxDifficultyBits(head) && c.MaxDifficultyBits != newcfg.MaxDifficultyBits {
+		return newCompatError("difficulty bit width", c.MaxDifficultyBitsBlock, newcfg.MaxDifficultyBitsBlock)
+	}
+	if isForkIncompatible(c.MedianTimeWindowBlock, newcfg.MedianTimeWindowBlock, head) {
+		return newCompatError("median time window fork block", c.MedianTimeWindowBlock, newcfg.MedianTimeWindowBlock)
+	}
+	if c.IsMedianTimeWindow(head) && c.MedianTimeWindow != newcfg.MedianTimeWindow {
+		return newCompatError("median time window", c.MedianTimeWindowBlock, newcfg.MedianTimeWindowBlock)
+	}
+	if isForkIncompatible(c.DifficultyForkGraceBlock, newcfg.DifficultyForkGraceBlock, head) {
+		return newCompatError("difficulty fork grace fork block", c.DifficultyForkGraceBlock, newcfg.DifficultyForkGraceBlock)
+	}
+	if c.IsDifficultyForkGrace(head) && c.DifficultyForkGrace != newcfg.DifficultyForkGrace {
+		return newCompatError("difficulty fork grace", c.DifficultyForkGraceBlock, newcfg.DifficultyForkGraceBlock)
+	}
+	if isForkIncompatible(c.BootstrapAlgorithmBlock, newcfg.BootstrapAlgorithmBlock, head) {
+		return newCompatError("bootstrap algorithm fork block", c.BootstrapAlgorithmBlock, newcfg.BootstrapAlgorithmBlock)
+	}
+	if c.IsBootstrapAlgorithm(head) && c.BootstrapAlgorithm != newcfg.BootstrapAlgorithm {
+		return newCompatError("bootstrap algorithm", c.BootstrapAlgorithmBlock, newcfg.BootstrapAlgorithmBlock)
+	}
+	if isForkIncompatible(c.ExtraDataRewardAddressBlock, newcfg.ExtraDataRewardAddressBlock, head) {
+		return newCompatError("extra-data reward address fork block", c.ExtraDataRewardAddressBlock, newcfg.ExtraDataRewardAddressBlock)
+	}
+	if isForkIncompatible(c.RewardRecipientsBlock, newcfg.RewardRecipientsBlock, head) {
+		return newCompatError("reward recipients fork block", c.RewardRecipientsBlock, newcfg.RewardRecipientsBlock)
+	}
+	if c.IsRewardRecipients(head) && !recipientsEqual(c.RewardRecipients, newcfg.RewardRecipients) {
+		return newCompatError("reward recipients", c.RewardRecipientsBlock, newcfg.RewardRecipientsBlock)
+	}
+	if isForkIncompatible(c.UncleBonusByGasUsedBlock, newcfg.UncleBonusByGasUsedBlock, head) {
+		return newCompatError("uncle bonus by gas used fork block", c.UncleBonusByGasUsedBlock, newcfg.UncleBonusByGasUsedBlock)
+	}
+	if isForkIncompatible(c.LenientUncleSealBlock, newcfg.LenientUncleSealBlock, head) {
+		return newCompatError("lenient uncle seal fork block", c.LenientUncleSealBlock, newcfg.LenientUncleSealBlock)
+	}
+	if isForkIncompatible(c.SHA3SealHashBlock, newcfg.SHA3SealHashBlock, head) {
+		return newCompatError("SHA3 seal hash fork block", c.SHA3SealHashBlock, newcfg.SHA3SealHashBlock)
+	}
+	if isForkIncompatible(c.AncestryMedianTimeBlock, newcfg.AncestryMedianTimeBlock, head) {
+		return newCompatError("ancestry median time fork block", c.AncestryMedianTimeBlock, newcfg.AncestryMedianTimeBlock)
+	}
+	if isForkIncompatible(c.RetargetSmoothingBlock, newcfg.RetargetSmoothingBlock, head) {
+		return newCompatError("retarget smoothing fork block", c.RetargetSmoothingBlock, newcfg.RetargetSmoothingBlock)
+	}
+	if c.IsRetargetSmoothing(head) && c.RetargetSmoothingDivisor != newcfg.RetargetSmoothingDivisor {
+		return newCompatError("retarget smoothing divisor", c.RetargetSmoothingBlock, newcfg.RetargetSmoothingBlock)
+	}
+	if isForkIncompatible(c.MaxUncleAgeBlock, newcfg.MaxUncleAgeBlock, head) {
+		return newCompatError("uncle age limit fork block", c.MaxUncleAgeBlock, newcfg.MaxUncleAgeBlock)
+	}
+	if c.IsMaxUncleAge(head) && c.MaxUncleAge != newcfg.MaxUncleAge {
+		return newCompatError("uncle age limit", c.MaxUncleAgeBlock, newcfg.MaxUncleAgeBlock)
+	}
+	if isForkIncompatible(c.MaxMedianTimeGapBlock, newcfg.MaxMedianTimeGapBlock, head) {
+		return newCompatError("median time gap limit fork block", c.MaxMedianTimeGapBlock, newcfg.MaxMedianTimeGapBlock)
+	}
+	if c.IsMaxMedianTimeGap(head) && c.MaxMedianTimeGap != newcfg.MaxMedianTimeGap {
+		return newCompatError("median time gap limit", c.MaxMedianTimeGapBlock, newcfg.MaxMedianTimeGapBlock)
+	}
+	if isForkIncompatible(c.RejectMinimumDifficultyBlock, newcfg.RejectMinimumDifficultyBlock, head) {
+		return newCompatError("minimum difficulty rejection fork block", c.RejectMinimumDifficultyBlock, newcfg.RejectMinimumDifficultyBlock)
+	}
 	return nil
 }
 
@@ -519,6 +963,42 @@ func isForked(s, head *big.Int) bool {
 	return s.Cmp(head) <= 0
 }
 
+// uint64sEqual returns whether x and y hold the same values, treating nil and
+// empty slices alike.
+func uint64sEqual(x, y []uint64) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// uint64PtrEqual returns whether x and y are both nil or point to the same value.
+func uint64PtrEqual(x, y *uint64) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	return *x == *y
+}
+
+// recipientsEqual returns whether x and y list the same reward recipients with
+// the same weights in the same order, treating nil and empty slices alike.
+func recipientsEqual(x, y []UbqhashRewardRecipient) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func configNumEqual(x, y *big.Int) bool {
 	if x == nil {
 		return y == nil
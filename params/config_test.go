@@ -17,6 +17,7 @@
 package params
 
 import (
+	"encoding/json"
 	"math/big"
 	"reflect"
 	"testing"
@@ -28,6 +29,7 @@ func TestCheckCompatible(t *testing.T) {
 		head        uint64
 		wantErr     *ConfigCompatError
 	}
+	storedCap, equalCap, raisedCap := uint64(500), uint64(500), uint64(600)
 	tests := []test{
 		{stored: AllUbqhashProtocolChanges, new: AllUbqhashProtocolChanges, head: 0, wantErr: nil},
 		{stored: AllUbqhashProtocolChanges, new: AllUbqhashProtocolChanges, head: 100, wantErr: nil},
@@ -87,6 +89,211 @@ func TestCheckCompatible(t *testing.T) {
 				RewindTo:     30,
 			},
 		},
+		{
+			stored:  &ChainConfig{Ubqhash: &UbqhashConfig{}},
+			new:     &ChainConfig{Ubqhash: &UbqhashConfig{LaunchBonusBlocks: 100, LaunchBonusFactor: 15000, LaunchBonusBlock: big.NewInt(30)}},
+			head:    20,
+			wantErr: nil,
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{LaunchBonusBlocks: 100, LaunchBonusFactor: 15000, LaunchBonusBlock: big.NewInt(30)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{LaunchBonusBlocks: 200, LaunchBonusFactor: 15000, LaunchBonusBlock: big.NewInt(30)}},
+			head:   40,
+			wantErr: &ConfigCompatError{
+				What:         "launch bonus",
+				StoredConfig: big.NewInt(30),
+				NewConfig:    big.NewInt(30),
+				RewindTo:     29,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{UncleBonusCurve: []uint64{100, 50}, UncleBonusCurveBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{UncleBonusCurve: []uint64{100, 25}, UncleBonusCurveBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "uncle bonus curve",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{RewardRecipients: []UbqhashRewardRecipient{{Weight: 70}, {Weight: 30}}, RewardRecipientsBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{RewardRecipients: []UbqhashRewardRecipient{{Weight: 60}, {Weight: 40}}, RewardRecipientsBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "reward recipients",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{TargetBlockTime: 15, TargetBlockTimeBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{TargetBlockTime: 15, TargetBlockTimeBlock: big.NewInt(30)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "target block time fork block",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(30),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored:  &ChainConfig{Ubqhash: &UbqhashConfig{MaxPerBlockDifficultyIncrease: &storedCap, MaxPerBlockDifficultyIncreaseBlock: big.NewInt(10)}},
+			new:     &ChainConfig{Ubqhash: &UbqhashConfig{MaxPerBlockDifficultyIncrease: &equalCap, MaxPerBlockDifficultyIncreaseBlock: big.NewInt(10)}},
+			head:    20,
+			wantErr: nil,
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{MaxPerBlockDifficultyIncrease: &storedCap, MaxPerBlockDifficultyIncreaseBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{MaxPerBlockDifficultyIncrease: &raisedCap, MaxPerBlockDifficultyIncreaseBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "difficulty increase cap",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{MaxDifficultyBits: 64, MaxDifficultyBitsBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{MaxDifficultyBits: 128, MaxDifficultyBitsBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "difficulty bit width",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{MedianTimeWindow: 21, MedianTimeWindowBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{MedianTimeWindow: 5, MedianTimeWindowBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "median time window",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{DifficultyForkGrace: 10, DifficultyForkGraceBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{DifficultyForkGrace: 20, DifficultyForkGraceBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "difficulty fork grace",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{BootstrapAlgorithm: BootstrapPerBlock, BootstrapAlgorithmBlock: big.NewInt(5)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{BootstrapAlgorithm: BootstrapHold, BootstrapAlgorithmBlock: big.NewInt(5)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "bootstrap algorithm",
+				StoredConfig: big.NewInt(5),
+				NewConfig:    big.NewInt(5),
+				RewindTo:     4,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{ExtraDataRewardAddressBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "extra-data reward address fork block",
+				StoredConfig: nil,
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{MaxUncleAge: 600, MaxUncleAgeBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{MaxUncleAge: 300, MaxUncleAgeBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "uncle age limit",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{MaxMedianTimeGap: 3600, MaxMedianTimeGapBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{MaxMedianTimeGap: 3600, MaxMedianTimeGapBlock: big.NewInt(30)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "median time gap limit fork block",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(30),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{RejectMinimumDifficultyBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "minimum difficulty rejection fork block",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    nil,
+				RewindTo:     9,
+			},
+		},
+		{
+			stored:  &ChainConfig{Ubqhash: &UbqhashConfig{SHA3SealHashBlock: big.NewInt(30)}},
+			new:     &ChainConfig{Ubqhash: &UbqhashConfig{SHA3SealHashBlock: big.NewInt(40)}},
+			head:    20,
+			wantErr: nil,
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{SHA3SealHashBlock: big.NewInt(30)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{SHA3SealHashBlock: big.NewInt(40)}},
+			head:   35,
+			wantErr: &ConfigCompatError{
+				What:         "SHA3 seal hash fork block",
+				StoredConfig: big.NewInt(30),
+				NewConfig:    big.NewInt(40),
+				RewindTo:     29,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{AncestryMedianTimeBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "ancestry median time fork block",
+				StoredConfig: nil,
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{RetargetSmoothingDivisor: 2, RetargetSmoothingBlock: big.NewInt(10)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{RetargetSmoothingDivisor: 3, RetargetSmoothingBlock: big.NewInt(10)}},
+			head:   20,
+			wantErr: &ConfigCompatError{
+				What:         "retarget smoothing divisor",
+				StoredConfig: big.NewInt(10),
+				NewConfig:    big.NewInt(10),
+				RewindTo:     9,
+			},
+		},
+		{
+			stored: &ChainConfig{Ubqhash: &UbqhashConfig{FluxBlock: big.NewInt(8000)}},
+			new:    &ChainConfig{Ubqhash: &UbqhashConfig{FluxBlock: big.NewInt(9000)}},
+			head:   8500,
+			wantErr: &ConfigCompatError{
+				What:         "Flux fork block",
+				StoredConfig: big.NewInt(8000),
+				NewConfig:    big.NewInt(9000),
+				RewindTo:     7999,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -96,3 +303,103 @@ func TestCheckCompatible(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateMonetaryPolicy(t *testing.T) {
+	tests := []struct {
+		policy []UbqhashMPStep
+		valid  bool
+	}{
+		{MainnetChainConfig.Ubqhash.MonetaryPolicy, true},
+		{[]UbqhashMPStep{{Block: big.NewInt(0), Reward: big.NewInt(8e+18)}}, true},
+		{nil, false},
+		{[]UbqhashMPStep{}, false},
+		{[]UbqhashMPStep{{Block: big.NewInt(0)}}, false},
+		{[]UbqhashMPStep{{Block: big.NewInt(0), Reward: big.NewInt(-1)}}, false},
+		{[]UbqhashMPStep{{Block: big.NewInt(10), Reward: big.NewInt(2)}, {Block: big.NewInt(10), Reward: big.NewInt(1)}}, false},
+		{[]UbqhashMPStep{{Block: big.NewInt(10), Reward: big.NewInt(2)}, {Block: big.NewInt(5), Reward: big.NewInt(1)}}, false},
+	}
+	for i, test := range tests {
+		err := (&UbqhashConfig{MonetaryPolicy: test.policy}).ValidateMonetaryPolicy()
+		if test.valid && err != nil {
+			t.Errorf("test %d: valid policy rejected: %v", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("test %d: invalid policy accepted", i)
+		}
+	}
+	// Ensure the chain config validation rejects malformed policies only
+	config := *MainnetChainConfig
+	config.Ubqhash = MainnetChainConfig.Ubqhash.Copy()
+	config.Ubqhash.MonetaryPolicy[0].Reward = big.NewInt(-1)
+	if err := config.CheckConfigForkOrder(); err == nil {
+		t.Errorf("malformed monetary policy accepted")
+	}
+	var empty ChainConfig
+	if err := json.Unmarshal([]byte(`{"chainId": 1, "ubqhash": {}}`), &empty); err != nil {
+		t.Fatalf("failed to decode chain config: %v", err)
+	}
+	if err := empty.CheckConfigForkOrder(); err != nil {
+		t.Errorf("empty ubqhash section rejected: %v", err)
+	}
+}
+
+func TestValidateForkOrder(t *testing.T) {
+	tests := []struct {
+		digishieldMod, flux *big.Int
+		valid               bool
+	}{
+		{MainnetChainConfig.Ubqhash.DigishieldModBlock, MainnetChainConfig.Ubqhash.FluxBlock, true},
+		{big.NewInt(0), big.NewInt(0), true},
+		{big.NewInt(10), big.NewInt(20), true},
+		{big.NewInt(20), big.NewInt(10), false},
+		{nil, big.NewInt(10), true},
+		{big.NewInt(10), nil, true},
+		{nil, nil, true},
+	}
+	for i, test := range tests {
+		config := &UbqhashConfig{DigishieldModBlock: test.digishieldMod, FluxBlock: test.flux}
+		err := ValidateForkOrder(config)
+		if test.valid && err != nil {
+			t.Errorf("test %d: valid ordering rejected: %v", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("test %d: invalid ordering accepted", i)
+		}
+	}
+	// Ensure the chain config validation picks up a reversed ordering
+	ubqhash := *MainnetChainConfig.Ubqhash
+	ubqhash.DigishieldModBlock, ubqhash.FluxBlock = ubqhash.FluxBlock, ubqhash.DigishieldModBlock
+	config := *MainnetChainConfig
+	config.Ubqhash = &ubqhash
+	if err := config.CheckConfigForkOrder(); err == nil {
+		t.Errorf("reversed ubqhash fork ordering accepted")
+	}
+	// Ensure the chain config validation lets a missing monetary policy through,
+	// which merely pays no rewards
+	ubqhash = *MainnetChainConfig.Ubqhash
+	ubqhash.MonetaryPolicy = nil
+	if err := config.CheckConfigForkOrder(); err != nil {
+		t.Errorf("empty monetary policy rejected: %v", err)
+	}
+	// Ensure the chain config validation rejects test only options
+	ubqhash = *MainnetChainConfig.Ubqhash
+	ubqhash.FluxArithmeticTimespan = true
+	if err := config.CheckConfigForkOrder(); err == nil {
+		t.Errorf("arithmetic flux timespans accepted")
+	}
+	// Ensure the chain config validation rejects unknown bootstrap algorithms
+	ubqhash = *MainnetChainConfig.Ubqhash
+	ubqhash.BootstrapAlgorithm = "perblok"
+	if err := config.CheckConfigForkOrder(); err == nil {
+		t.Errorf("unknown bootstrap algorithm accepted")
+	}
+	ubqhash.BootstrapAlgorithm = BootstrapPerBlock
+	if err := config.CheckConfigForkOrder(); err != nil {
+		t.Errorf("per block bootstrap algorithm rejected: %v", err)
+	}
+	for _, config := range []*ChainConfig{MainnetChainConfig, TestChainConfig, AllUbqhashProtocolChanges} {
+		if err := config.CheckConfigForkOrder(); err != nil {
+			t.Errorf("chain %v: valid config rejected: %v", config.ChainID, err)
+		}
+	}
+}